@@ -8,18 +8,28 @@ import (
 	"github.com/scionproto/scion/go/lib/addr"
 	"io/ioutil"
 	"log"
+	"os"
 	"strings"
 	"sync"
 	"time"
 )
 
+// AccessController decides which sources may scrape which mappings and read which metrics. It is safe for concurrent
+// use: the Casbin enforcer isn't, so every access to it and to active is guarded by mutex. The unexported methods
+// using the enforcer expect the caller to hold the mutex.
 type AccessController struct {
-	enforcer        *casbin.Enforcer
-	active          bool
-	lastScrape      map[string]time.Time
-	rwMutex         sync.RWMutex
+	enforcer *casbin.Enforcer
+	active   bool
+	mutex    sync.RWMutex // Guards enforcer, active and the compiled patterns
+	// Source patterns among the subjects of the policy, compiled whenever the policy changes
+	patterns        map[string]*sourcePattern
+	orderedPatterns []*sourcePattern
+	patternRoles    map[string][]*sourcePattern // Patterns by the internal role bound to them
+	Limiter         *RateLimiter                // Enforces the frequency permissions
+	Redactor        *Redactor                   // Applies the redaction rules of the roles
 	CoreASes        []*addr.IA
 	NeighboringASes []*addr.IA
+	asMutex         sync.RWMutex // Guards CoreASes and NeighboringASes
 }
 
 const ScrapePermission = "scrape"
@@ -29,14 +39,129 @@ const OwnerRole = "owner"
 
 func NewAccessController(modelFile, policyFile string, active bool, ia *addr.IA) *AccessController {
 	enforcer := casbin.NewEnforcer(modelFile, policyFile)
-	return &AccessController{
-		enforcer,
-		active,
-		make(map[string]time.Time),
-		sync.RWMutex{},
-		make([]*addr.IA, 0), // TODO (issue #38): replace with `GetCoreASes(*ia),`
-		make([]*addr.IA, 0), // TODO (issue #38): replace with `GetNeighboringASes(*ia),`
+	ac := &AccessController{
+		enforcer:        enforcer,
+		active:          active,
+		Limiter:         &RateLimiter{burst: 1, buckets: make(map[string]*tokenBucket)}, // In memory, without burst nor tolerance
+		CoreASes:        make([]*addr.IA, 0),                                            // Filled by WatchASes
+		NeighboringASes: make([]*addr.IA, 0),                                            // Filled by WatchASes
 	}
+	// Functions for source patterns, used by the matcher in the model file. They run within Enforce, with the mutex
+	// held.
+	enforcer.AddFunction("sourceMatch", func(args ...interface{}) (interface{}, error) {
+		p, ok := ac.patterns[args[1].(string)]
+		return ok && p.matches(args[0].(string)), nil
+	})
+	enforcer.AddFunction("patternRole", func(args ...interface{}) (interface{}, error) {
+		return ac.hasPatternRole(args[0].(string), args[1].(string)), nil
+	})
+	// The reserved roles are given to sources by their AS, without grouping rules
+	enforcer.AddFunction("reservedRole", func(args ...interface{}) (interface{}, error) {
+		return ac.hasReservedRole(args[0].(string), args[1].(string)), nil
+	})
+	ac.compilePatterns()
+	ac.dropReservedRoleBindings()
+	return ac
+}
+
+// Compiles the source patterns in the policy, so that the matcher doesn't parse them at every evaluation. The caller
+// must hold the mutex for writing.
+func (ac *AccessController) compilePatterns() {
+	patterns := make(map[string]*sourcePattern)
+	ordered := []*sourcePattern{}
+	roles := make(map[string][]*sourcePattern)
+	compile := func(subject string) *sourcePattern {
+		if p, ok := patterns[subject]; ok || !IsSourcePattern(subject) {
+			return p
+		}
+		p, err := parseSourcePattern(subject)
+		if err != nil {
+			log.Printf("Ignoring invalid source pattern %q in the policy: %v", subject, err)
+			return nil
+		}
+		patterns[subject] = p
+		ordered = append(ordered, p)
+		return p
+	}
+	for _, subject := range ac.enforcer.GetAllSubjects() {
+		compile(subject)
+	}
+	for _, grouping := range ac.enforcer.GetGroupingPolicy() {
+		if len(grouping) > 1 {
+			if p := compile(grouping[0]); p != nil {
+				roles[grouping[1]] = append(roles[grouping[1]], p)
+			}
+		}
+	}
+	ac.patterns, ac.orderedPatterns, ac.patternRoles = patterns, ordered, roles
+}
+
+// Saves the policy after a change. The caller must hold the mutex for writing.
+func (ac *AccessController) savePolicy() {
+	ac.enforcer.SavePolicy()
+	ac.compilePatterns()
+}
+
+// Whether role is bound to a pattern matching source
+func (ac *AccessController) hasPatternRole(source, role string) bool {
+	for _, p := range ac.patternRoles[role] {
+		if p.matches(source) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the patterns in the policy that match source, either with permissions or with roles bound to them
+func (ac *AccessController) MatchingPatterns(source string) []string {
+	ac.mutex.RLock()
+	defer ac.mutex.RUnlock()
+	return ac.matchingPatterns(source)
+}
+
+func (ac *AccessController) matchingPatterns(source string) []string {
+	patterns := []string{}
+	for _, p := range ac.orderedPatterns {
+		if p.matches(source) {
+			patterns = append(patterns, p.text)
+		}
+	}
+	return patterns
+}
+
+// Returns the role bindings of all patterns as pattern -> roles
+func (ac *AccessController) GetPatternRoles() map[string][]string {
+	ac.mutex.RLock()
+	defer ac.mutex.RUnlock()
+	bindings := make(map[string][]string)
+	for _, grouping := range ac.enforcer.GetGroupingPolicy() {
+		if len(grouping) > 1 && IsSourcePattern(grouping[0]) {
+			bindings[grouping[0]] = append(bindings[grouping[0]], strings.TrimSuffix(grouping[1], "_role"))
+		}
+	}
+	return bindings
+}
+
+// Binds role to all sources matching pattern. Reserved roles can't be bound to patterns.
+func (ac *AccessController) AddPatternRole(pattern, role string) error {
+	if err := ValidateSourcePattern(pattern); err != nil {
+		return err
+	}
+	if isReservedRole(role, CoreRole) || isReservedRole(role, NeighborRole) {
+		return errors.New("reserved role " + role + " can't be bound to a pattern")
+	}
+	ac.mutex.Lock()
+	defer ac.mutex.Unlock()
+	ac.enforcer.AddRoleForUser(pattern, role+"_role")
+	ac.savePolicy()
+	return nil
+}
+
+func (ac *AccessController) RemovePatternRole(pattern, role string) {
+	ac.mutex.Lock()
+	defer ac.mutex.Unlock()
+	ac.enforcer.DeleteRoleForUser(pattern, role+"_role")
+	ac.savePolicy()
 }
 
 func (ac *AccessController) LoadPermsFromFile(file string) error {
@@ -60,65 +185,121 @@ func (ac *AccessController) LoadPermsFromFile(file string) error {
 }
 
 func (ac *AccessController) Disable() {
+	ac.mutex.Lock()
+	defer ac.mutex.Unlock()
 	ac.active = false
 }
 
 func (ac *AccessController) Enable() {
+	ac.mutex.Lock()
+	defer ac.mutex.Unlock()
 	ac.active = true
 }
 
+func (ac *AccessController) isActive() bool {
+	ac.mutex.RLock()
+	defer ac.mutex.RUnlock()
+	return ac.active
+}
+
+// Reasons for which a scrape is refused
+const (
+	ScrapeNotAuthorized = "not_authorized"
+	ScrapeWindowExpired = "window_expired"
+	ScrapeWindowClosed  = "window_closed"
+	ScrapeTooFrequent   = "too_frequent"
+	ScrapeInvalidToken  = "invalid_capability"
+)
+
+// AuthorizationError tells why a source may not scrape a mapping. It is returned to the scraper in json format.
+type AuthorizationError struct {
+	Reason     string        `json:"error"`
+	Message    string        `json:"message"`
+	RetryAfter time.Duration `json:"-"`                  // Only set for ScrapeTooFrequent
+	RetryAt    *time.Time    `json:"retry_at,omitempty"` // Only set for ScrapeTooFrequent and ScrapeWindowClosed
+}
+
+func (e *AuthorizationError) Error() string {
+	return e.Message
+}
+
+// Checks whether source may scrape the mapping at path now. The returned error, if any, is an *AuthorizationError.
 func (ac *AccessController) Authorized(source, path string) error {
-	if ac.active {
-		if ac.enforcer.Enforce(source, path, ScrapePermission) {
-			// Find window and frequency permissions
-			var window, frequency string
-			for _, perm := range ac.enforcer.GetPermissionsForUser(source) {
-				if strings.HasPrefix(perm[2], "window:") {
-					window = perm[2]
-				} else if strings.HasPrefix(perm[2], "frequency:") {
-					frequency = perm[2]
+	ac.mutex.RLock()
+	active := ac.active
+	allowed := active && source != "" && ac.enforcer.Enforce(source, path, ScrapePermission)
+	// Find window and frequency permissions for the mapping, the ones of the source itself take precedence over the
+	// ones of matching patterns
+	var window, windowSubject, frequency string
+	if allowed {
+		for _, subject := range append([]string{source}, ac.matchingPatterns(source)...) {
+			for _, perm := range ac.permissionsForObject(subject, path) {
+				if strings.HasPrefix(perm, "window:") && window == "" {
+					window, windowSubject = perm, subject
+				} else if strings.HasPrefix(perm, "frequency:") && frequency == "" {
+					frequency = perm
 				}
 			}
+		}
+	}
+	ac.mutex.RUnlock()
+	if active {
+		if allowed {
 			if window != "" {
-				// Ensure window not expired
-				expiration, err := time.Parse(time.RFC3339, strings.SplitAfterN(window, ":", 2)[1])
+				// Ensure window not expired and currently open
+				win, err := ParseWindow(strings.SplitAfterN(window, ":", 2)[1])
 				if err != nil {
 					log.Println(err)
+					return &AuthorizationError{Reason: ScrapeNotAuthorized, Message: "Invalid time window for " + source + " on " + path}
 				}
-				log.Println("expiration time:", expiration)
-				if time.Now().After(expiration) {
-					// Remove "scrape" and window permissions
-					ac.enforcer.DeletePermissionForUser(source, ScrapePermission)
-					ac.enforcer.DeletePermissionForUser(source, window)
-					return errors.New("Time window for " + source + " has expired")
+				now := time.Now()
+				open, _, ok := win.Interval(now)
+				if !ok {
+					ac.mutex.Lock()
+					ac.expireWindow(windowSubject, path, window)
+					ac.mutex.Unlock()
+					return &AuthorizationError{Reason: ScrapeWindowExpired, Message: "Time window for " + source + " on " + path + " has expired"}
+				}
+				if now.Before(open) {
+					return &AuthorizationError{
+						Reason:  ScrapeWindowClosed,
+						Message: "Time window for " + source + " on " + path + " opens at " + open.Format(time.RFC3339),
+						RetryAt: &open,
+					}
 				}
 			}
 			if frequency != "" {
-				// Check last access with current time
-				ac.rwMutex.RLock()
-				last := ac.lastScrape[source]
-				ac.rwMutex.RUnlock()
-				now := time.Now()
-				freqDuration, _ := time.ParseDuration(strings.Split(frequency, ":")[1])
-				if (last == time.Time{}) || now.After(last.Add(freqDuration)) { // TODO: introduce few seconds tolerance?
-					// Write new time
-					ac.rwMutex.Lock()
-					ac.lastScrape[source] = now
-					ac.rwMutex.Unlock()
-				} else {
-					remainingTime := now.Add(freqDuration).Sub(last)
-					return errors.New("Next scrape for " + source + " authorized in " + remainingTime.String())
+				// Take a token from the source's bucket for the mapping
+				freqDuration, err := time.ParseDuration(strings.Split(frequency, ":")[1])
+				if err != nil {
+					log.Println(err)
+					return &AuthorizationError{Reason: ScrapeNotAuthorized, Message: "Invalid frequency for " + source + " on " + path}
+				}
+				if ok, remainingTime := ac.Limiter.Take(source, path, freqDuration); !ok {
+					retryAt := time.Now().Add(remainingTime)
+					return &AuthorizationError{
+						Reason:     ScrapeTooFrequent,
+						Message:    "Next scrape for " + source + " on " + path + " authorized in " + remainingTime.String(),
+						RetryAfter: remainingTime,
+						RetryAt:    &retryAt,
+					}
 				}
 			}
 			return nil
 		} else {
-			return errors.New(source + " not authorized to scrape")
+			return &AuthorizationError{Reason: ScrapeNotAuthorized, Message: source + " not authorized to scrape " + path}
 		}
 	}
 	return nil
 }
 
+// Returns only the metric families that source is allowed to read on the mapping at path
 func (ac *AccessController) FilterMetrics(source, path string, metrics []*MetricFamily) []*MetricFamily {
+	ac.mutex.RLock()
+	defer ac.mutex.RUnlock()
+	if !ac.active {
+		return metrics
+	}
 	filteredMetrics := []*MetricFamily{}
 	for _, fam := range metrics {
 		if ac.enforcer.Enforce(source, path, *fam.Name) {
@@ -129,6 +310,12 @@ func (ac *AccessController) FilterMetrics(source, path string, metrics []*Metric
 }
 
 func (ac *AccessController) GetAllRoles() []string {
+	ac.mutex.RLock()
+	defer ac.mutex.RUnlock()
+	return ac.allRoles()
+}
+
+func (ac *AccessController) allRoles() []string {
 	roles := []string{}
 	for _, subj := range ac.enforcer.GetAllSubjects() {
 		if strings.HasSuffix(subj, "_role") {
@@ -140,21 +327,36 @@ func (ac *AccessController) GetAllRoles() []string {
 
 func (ac *AccessController) CreateRole(role types.Role) {
 	internalRoleName := role.Name + "_role"
+	ac.mutex.Lock()
+	defer ac.mutex.Unlock()
 	for obj, objPerms := range role.Permissions {
 		for _, perm := range objPerms {
 			ac.enforcer.AddPermissionForUser(internalRoleName, obj, perm)
 		}
 	}
-	ac.enforcer.SavePolicy()
+	ac.savePolicy()
 }
 
 func (ac *AccessController) DeleteRole(role string) {
+	ac.mutex.Lock()
 	ac.enforcer.DeleteRole(role + "_role")
-	ac.enforcer.SavePolicy()
+	ac.savePolicy()
+	ac.mutex.Unlock()
+	if ac.Redactor != nil {
+		if err := ac.Redactor.SetRules(role, nil); err != nil {
+			log.Printf("Failed removing redaction rules of deleted role %s: %v", role, err)
+		}
+	}
 }
 
 func (ac *AccessController) GetRoles(source string) []string {
-	roles := ac.enforcer.GetRolesForUser(source)
+	ac.mutex.RLock()
+	defer ac.mutex.RUnlock()
+	return ac.rolesOf(source)
+}
+
+func (ac *AccessController) rolesOf(source string) []string {
+	roles := ac.internalRolesOf(source)
 	roleNames := make([]string, len(roles))
 	for i, role := range roles {
 		roleNames[i] = role[:len(role)-5]
@@ -173,71 +375,189 @@ func (ac *AccessController) GetRoleInfo(role string) *types.Role {
 	return nil
 }
 
-func (ac *AccessController) sourceInCoreAS(source string) bool {
-	for _, coreAS := range ac.CoreASes {
-		if strings.HasPrefix(source, coreAS.String()) {
+// Whether the source (IA:IP) is in one of the ases
+func sourceInASes(source string, ases []*addr.IA) bool {
+	for _, as := range ases {
+		if strings.HasPrefix(source, as.String()+":") {
 			return true
 		}
 	}
 	return false
 }
 
+func (ac *AccessController) sourceInCoreAS(source string) bool {
+	ac.asMutex.RLock()
+	defer ac.asMutex.RUnlock()
+	return sourceInASes(source, ac.CoreASes)
+}
+
 func (ac *AccessController) sourceInNeighborAS(source string) bool {
-	for _, neighAS := range ac.NeighboringASes {
-		if strings.HasPrefix(source, neighAS.String()) {
-			return true
+	ac.asMutex.RLock()
+	defer ac.asMutex.RUnlock()
+	return sourceInASes(source, ac.NeighboringASes)
+}
+
+// Replaces the core and neighboring ASes, which decide the reserved roles of the sources
+func (ac *AccessController) SetReservedASes(coreASes, neighboringASes []*addr.IA) {
+	ac.asMutex.Lock()
+	defer ac.asMutex.Unlock()
+	ac.CoreASes, ac.NeighboringASes = coreASes, neighboringASes
+}
+
+// Loads the core and neighboring ASes of localIA from the topology and TRC files in the SCION gen folder, then reloads
+// them every interval if the files changed
+func (ac *AccessController) WatchASes(genFolder string, localIA addr.IA, interval time.Duration) error {
+	load := func() error {
+		coreASes, err := GetCoreASes(genFolder, localIA)
+		if err != nil {
+			return err
 		}
+		neighboringASes, err := GetNeighboringASes(genFolder, localIA)
+		if err != nil {
+			return err
+		}
+		ac.SetReservedASes(coreASes, neighboringASes)
+		log.Printf("Loaded %d core and %d neighboring ASes", len(coreASes), len(neighboringASes))
+		return nil
+	}
+	modTimes := func() string {
+		times := ""
+		for _, file := range ASFiles(genFolder, localIA) {
+			if info, err := os.Stat(file); err == nil {
+				times += file + info.ModTime().String()
+			}
+		}
+		return times
+	}
+	last := modTimes()
+	if err := load(); err != nil {
+		return err
+	}
+	go func() {
+		for range time.NewTicker(interval).C {
+			current := modTimes()
+			if current == last {
+				continue
+			}
+			if err := load(); err != nil {
+				log.Println("Failed reloading core and neighboring ASes:", err)
+				continue
+			}
+			last = current
+		}
+	}()
+	return nil
+}
+
+// Whether role (without the _role suffix) is reserved to sources in core (or neighboring) ASes: the given kind of role
+// and the ones for single mappings, e.g. br_core
+func isReservedRole(role, kind string) bool {
+	return role == kind || strings.HasSuffix(role, "_"+kind)
+}
+
+// Whether source gets the internal role from its AS. Used by the matcher in the model file, so that the reserved roles
+// follow the core and neighboring ASes without writing grouping rules for every source.
+func (ac *AccessController) hasReservedRole(source, role string) bool {
+	if !strings.HasSuffix(role, "_role") {
+		return false
+	}
+	role = strings.TrimSuffix(role, "_role")
+	return (isReservedRole(role, CoreRole) && ac.sourceInCoreAS(source)) ||
+		(isReservedRole(role, NeighborRole) && ac.sourceInNeighborAS(source))
+}
+
+// Returns the internal names of the roles of source: the ones bound to it and the reserved ones it gets from its AS.
+// The caller must hold the mutex.
+func (ac *AccessController) internalRolesOf(source string) []string {
+	roles := ac.enforcer.GetRolesForUser(source)
+	for _, role := range ac.allRoles() {
+		if ac.hasReservedRole(source, role+"_role") && !contains(roles, role+"_role") {
+			roles = append(roles, role+"_role")
+		}
+	}
+	return roles
+}
+
+// Removes the grouping rules binding sources to reserved roles, which were written by previous versions. The reserved
+// roles are now decided by the matcher.
+func (ac *AccessController) dropReservedRoleBindings() {
+	changed := false
+	for _, grouping := range ac.enforcer.GetGroupingPolicy() {
+		if len(grouping) < 2 || strings.HasSuffix(grouping[0], "_role") {
+			continue
+		}
+		role := strings.TrimSuffix(grouping[1], "_role")
+		if isReservedRole(role, CoreRole) || isReservedRole(role, NeighborRole) {
+			ac.enforcer.DeleteRoleForUser(grouping[0], grouping[1])
+			changed = true
+		}
+	}
+	if changed {
+		ac.savePolicy()
+		log.Println("Removed the bindings of sources to reserved roles, which are now assigned by AS")
 	}
-	return false
 }
 
 func (ac *AccessController) AddRole(source string, role string) error {
-	if (strings.Contains(role, CoreRole) && ac.sourceInCoreAS(source)) ||
-		(strings.Contains(role, NeighborRole) && !ac.sourceInNeighborAS(source)) {
-		return errors.New(source + " is not allowed to have reserved role " + role)
+	if isReservedRole(role, CoreRole) || isReservedRole(role, NeighborRole) {
+		return errors.New("reserved role " + role + " is assigned by AS and can't be bound to " + source)
 	}
+	ac.mutex.Lock()
+	defer ac.mutex.Unlock()
 	ac.enforcer.AddRoleForUser(source, role+"_role")
-	ac.enforcer.SavePolicy()
+	ac.savePolicy()
 	return nil
 }
 
 func (ac *AccessController) RemoveRole(source string, role string) {
+	ac.mutex.Lock()
+	defer ac.mutex.Unlock()
 	ac.enforcer.DeleteRoleForUser(source, role+"_role")
-	ac.enforcer.SavePolicy()
+	ac.savePolicy()
 }
 
 // Expects role to be just the role name and mapping to have e heading /
 func (ac *AccessController) AddRolePermissions(role string, mapping string, permissions []string) {
+	ac.mutex.Lock()
+	defer ac.mutex.Unlock()
 	for _, perm := range permissions {
 		ac.enforcer.AddPermissionForUser(mapping[1:]+"_"+role+"_role", mapping, perm)
 	}
-	ac.enforcer.SavePolicy()
+	ac.savePolicy()
 }
 
 func (ac *AccessController) RemoveRolePermissions(role string, mapping string, permissions []string) {
+	ac.mutex.Lock()
+	defer ac.mutex.Unlock()
 	for _, perm := range permissions {
 		ac.enforcer.DeletePermissionForUser(role, mapping, perm)
 	}
-	ac.enforcer.SavePolicy()
+	ac.savePolicy()
 }
 
 // Blocks the given source from scraping the given mapping
 func (ac *AccessController) BlockSource(source, mapping string) {
+	ac.mutex.Lock()
+	defer ac.mutex.Unlock()
 	ac.enforcer.DeletePermissionForUser(source, mapping, ScrapePermission)
-	ac.enforcer.SavePolicy()
+	ac.savePolicy()
 }
 
 // Allows the given source to scrape the given mapping
 func (ac *AccessController) AllowSource(source, mapping string) {
+	ac.mutex.Lock()
+	defer ac.mutex.Unlock()
 	ac.enforcer.AddPermissionForUser(source, mapping, ScrapePermission)
-	ac.enforcer.SavePolicy()
+	ac.savePolicy()
 }
 
 // Returns all permissions for the given user (this includes permissions from roles)
 func (ac *AccessController) GetAllPermissions(source string) map[string][]string {
-	permsMap := ac.GetSubjectPermissions(source)
+	ac.mutex.RLock()
+	defer ac.mutex.RUnlock()
+	permsMap := ac.subjectPermissions(source)
 	// Get permissions from roles
-	for _, role := range ac.enforcer.GetRolesForUser(source) {
+	for _, role := range ac.internalRolesOf(source) {
 		rolePerms := ac.enforcer.GetPermissionsForUser(role)
 		for _, rolePerm := range rolePerms {
 			permsMap[rolePerm[1]] = append(permsMap[rolePerm[1]], rolePerm[2])
@@ -248,25 +568,41 @@ func (ac *AccessController) GetAllPermissions(source string) map[string][]string
 
 // Deletes all permissions associated with a user (i.e. timing, "scrape" and all role assignments)
 func (ac *AccessController) DeleteAllPermissions(source string) {
+	ac.mutex.Lock()
+	defer ac.mutex.Unlock()
 	ac.enforcer.DeletePermissionsForUser(source)
 	ac.enforcer.DeleteRolesForUser(source)
-	ac.enforcer.SavePolicy()
+	ac.savePolicy()
 }
 
 // Deletes all permissions associated with an object (i.e. owner role, scrape and temporal permissions)
 func (ac *AccessController) DeleteAllMappingPermissions(mapping string) {
 	role := mapping[1:] + "_" + OwnerRole + "_role"
+	ac.mutex.Lock()
+	defer ac.mutex.Unlock()
 	ac.enforcer.DeleteRole(role)
 	ac.enforcer.RemoveFilteredPolicy(1, mapping)
-	ac.enforcer.SavePolicy()
+	ac.savePolicy()
 }
 
 func (ac *AccessController) GetPermissionsForObject(subject, object string) []string {
-	return ac.GetSubjectPermissions(subject)[object]
+	ac.mutex.RLock()
+	defer ac.mutex.RUnlock()
+	return ac.permissionsForObject(subject, object)
+}
+
+func (ac *AccessController) permissionsForObject(subject, object string) []string {
+	return ac.subjectPermissions(subject)[object]
 }
 
 // Returns a map(mapping->permissions) for the given subject
 func (ac *AccessController) GetSubjectPermissions(subject string) map[string][]string {
+	ac.mutex.RLock()
+	defer ac.mutex.RUnlock()
+	return ac.subjectPermissions(subject)
+}
+
+func (ac *AccessController) subjectPermissions(subject string) map[string][]string {
 	allPerms := ac.enforcer.GetPermissionsForUser(subject)
 	permsMap := make(map[string][]string)
 	for _, perm := range allPerms {
@@ -275,26 +611,111 @@ func (ac *AccessController) GetSubjectPermissions(subject string) map[string][]s
 	return permsMap
 }
 
-func (ac *AccessController) AddTimingPermission(source, mapping, typ, duration string) {
-	ac.DeleteTimingPermission(source, mapping, typ)
+// Sets the frequency of source on mapping, or a window ending after duration, replacing the current one. The current
+// permission is kept if duration is invalid.
+func (ac *AccessController) AddTimingPermission(source, mapping, typ, duration string) error {
+	parsed, err := time.ParseDuration(duration)
+	if err != nil {
+		return errors.Wrapf(err, "invalid %s", typ)
+	}
 	var permission string
 	switch typ {
 	case "frequency":
 		permission = typ + ":" + duration
 	case "window":
-		windowDuration, _ := time.ParseDuration(duration) // TODO: handle error
-		exp := time.Now().Add(windowDuration).Format(time.RFC3339)
-		permission = typ + ":" + exp
+		window := &Window{End: time.Now().Add(parsed)}
+		permission = typ + ":" + window.String()
+	default:
+		return errors.Errorf("unknown timing permission %s", typ)
 	}
+	ac.mutex.Lock()
+	defer ac.mutex.Unlock()
+	ac.deleteTimingPermission(source, mapping, typ)
 	ac.enforcer.AddPermissionForUser(source, mapping, permission)
-	ac.enforcer.SavePolicy()
+	ac.savePolicy()
+	return nil
 }
 
-func (ac *AccessController) DeleteTimingPermission(source, mapping, typ string) {
+// Sets the window during which source may scrape mapping, replacing the current one
+func (ac *AccessController) AddWindowPermission(source, mapping string, window *Window) {
+	ac.mutex.Lock()
+	defer ac.mutex.Unlock()
+	ac.deleteTimingPermission(source, mapping, "window")
+	ac.enforcer.AddPermissionForUser(source, mapping, "window:"+window.String())
+	ac.savePolicy()
+}
+
+// Returns the window of source on mapping, or nil if it has none
+func (ac *AccessController) GetWindow(source, mapping string) *Window {
 	for _, perm := range ac.GetPermissionsForObject(source, mapping) {
+		if strings.HasPrefix(perm, "window:") {
+			win, err := ParseWindow(strings.SplitAfterN(perm, ":", 2)[1])
+			if err != nil {
+				log.Println(err)
+				return nil
+			}
+			return win
+		}
+	}
+	return nil
+}
+
+// Removes the scrape permission of source on mapping together with its expired window permission. The caller must
+// hold the mutex for writing.
+func (ac *AccessController) expireWindow(source, mapping, window string) {
+	ac.enforcer.DeletePermissionForUser(source, mapping, ScrapePermission)
+	ac.enforcer.DeletePermissionForUser(source, mapping, window)
+	ac.savePolicy()
+	ac.Limiter.Reset(source, mapping)
+	log.Printf("Time window for %s on %s has expired, removed scrape permission", source, mapping)
+}
+
+// Removes the scrape permissions whose window has expired and returns how many
+func (ac *AccessController) ExpireWindows() int {
+	ac.mutex.Lock()
+	defer ac.mutex.Unlock()
+	expired := 0
+	now := time.Now()
+	for _, policy := range ac.enforcer.GetPolicy() {
+		if len(policy) < 3 || !strings.HasPrefix(policy[2], "window:") {
+			continue
+		}
+		win, err := ParseWindow(strings.SplitAfterN(policy[2], ":", 2)[1])
+		if err != nil {
+			log.Printf("Ignoring invalid window %s of %s on %s: %v", policy[2], policy[0], policy[1], err)
+			continue
+		}
+		if win.Expired(now) {
+			ac.expireWindow(policy[0], policy[1], policy[2])
+			expired++
+		}
+	}
+	return expired
+}
+
+// Checks for expired windows every interval, so that permissions are removed even if the source stops scraping
+func (ac *AccessController) StartWindowSweeper(interval time.Duration) {
+	go func() {
+		for range time.NewTicker(interval).C {
+			ac.ExpireWindows()
+		}
+	}()
+}
+
+func (ac *AccessController) DeleteTimingPermission(source, mapping, typ string) {
+	ac.mutex.Lock()
+	defer ac.mutex.Unlock()
+	ac.deleteTimingPermission(source, mapping, typ)
+}
+
+func (ac *AccessController) deleteTimingPermission(source, mapping, typ string) {
+	if typ == "frequency" {
+		ac.Limiter.Reset(source, mapping)
+	}
+	for _, perm := range ac.permissionsForObject(source, mapping) {
 		if strings.HasPrefix(perm, typ+":") {
 			ac.enforcer.DeletePermissionForUser(source, mapping, perm)
-			ac.enforcer.SavePolicy()
+			ac.savePolicy()
 			break
 		}
 	}
@@ -302,6 +723,12 @@ func (ac *AccessController) DeleteTimingPermission(source, mapping, typ string)
 
 // Returns a list of all sources that have some permission
 func (ac *AccessController) GetAllSources() []string {
+	ac.mutex.RLock()
+	defer ac.mutex.RUnlock()
+	return ac.allSources()
+}
+
+func (ac *AccessController) allSources() []string {
 	sources := []string{}
 	for _, subj := range ac.enforcer.GetAllSubjects() {
 		if !strings.HasSuffix(subj, "_role") {
@@ -0,0 +1,157 @@
+package common
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/netsec-ethz/2SMS/common/types"
+	"github.com/pkg/errors"
+)
+
+// AuditLog appends audit records to a file as JSON lines. When the file grows beyond maxSize it is rotated to
+// file.1, the previous file.1 to file.2 and so on, keeping at most maxBackups old files.
+type AuditLog struct {
+	file       string
+	maxSize    int64
+	maxBackups int
+	out        *os.File
+	size       int64
+	mutex      sync.Mutex
+}
+
+// Opens the audit log in file, appending to the records already there
+func NewAuditLog(file string, maxSize int64, maxBackups int) (*AuditLog, error) {
+	if maxSize <= 0 {
+		return nil, errors.Errorf("maximum size must be positive, got %d", maxSize)
+	}
+	if maxBackups < 0 {
+		return nil, errors.Errorf("number of backups can't be negative, got %d", maxBackups)
+	}
+	al := &AuditLog{file: file, maxSize: maxSize, maxBackups: maxBackups}
+	if err := al.open(); err != nil {
+		return nil, err
+	}
+	return al, nil
+}
+
+func (al *AuditLog) open() error {
+	out, err := os.OpenFile(al.file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return errors.Wrap(err, "opening audit log")
+	}
+	info, err := out.Stat()
+	if err != nil {
+		out.Close()
+		return errors.Wrap(err, "opening audit log")
+	}
+	al.out, al.size = out, info.Size()
+	return nil
+}
+
+func (al *AuditLog) backup(n int) string {
+	return al.file + "." + strconv.Itoa(n)
+}
+
+// Moves the current file to the first backup, shifting the older ones, and starts a new file. Must be called with
+// the mutex held.
+func (al *AuditLog) rotate() error {
+	if err := al.out.Close(); err != nil {
+		log.Println("Failed closing audit log:", err)
+	}
+	if al.maxBackups == 0 {
+		if err := os.Remove(al.file); err != nil && !os.IsNotExist(err) {
+			return errors.Wrap(err, "rotating audit log")
+		}
+		return al.open()
+	}
+	os.Remove(al.backup(al.maxBackups))
+	for n := al.maxBackups - 1; n >= 1; n-- {
+		if err := os.Rename(al.backup(n), al.backup(n+1)); err != nil && !os.IsNotExist(err) {
+			return errors.Wrap(err, "rotating audit log")
+		}
+	}
+	if err := os.Rename(al.file, al.backup(1)); err != nil {
+		return errors.Wrap(err, "rotating audit log")
+	}
+	return al.open()
+}
+
+// Appends record to the log, rotating it first if it would grow beyond the maximum size
+func (al *AuditLog) Write(record *types.AuditRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	al.mutex.Lock()
+	defer al.mutex.Unlock()
+	if al.out == nil {
+		// A previous rotation failed, try again
+		if err = al.open(); err != nil {
+			return err
+		}
+	}
+	if al.size > 0 && al.size+int64(len(line)) > al.maxSize {
+		if err = al.rotate(); err != nil {
+			al.out = nil
+			return err
+		}
+	}
+	n, err := al.out.Write(line)
+	al.size += int64(n)
+	return err
+}
+
+// Returns the last limit records, oldest first, in the current file and the backups that match filter. All records
+// are returned if limit isn't positive.
+func (al *AuditLog) Query(filter *types.AuditFilter, limit int) ([]types.AuditRecord, error) {
+	// Open all files at once, so that rotations happening while reading don't skip or repeat records. The current
+	// file is only read up to its size at this point.
+	al.mutex.Lock()
+	files := []io.Reader{}
+	for n := al.maxBackups; n >= 1; n-- {
+		backup, err := os.Open(al.backup(n))
+		if err != nil {
+			continue
+		}
+		defer backup.Close()
+		files = append(files, backup)
+	}
+	current, err := os.Open(al.file)
+	if err == nil {
+		defer current.Close()
+		files = append(files, io.LimitReader(current, al.size))
+	}
+	al.mutex.Unlock()
+
+	records := []types.AuditRecord{}
+	for _, file := range files {
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			var record types.AuditRecord
+			if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+				log.Println("Skipping malformed audit record:", err)
+				continue
+			}
+			if !filter.Matches(&record) {
+				continue
+			}
+			records = append(records, record)
+			if limit > 0 && len(records) > 2*limit {
+				records = append(records[:0], records[len(records)-limit:]...)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, errors.Wrap(err, "reading audit log")
+		}
+	}
+	if limit > 0 && len(records) > limit {
+		records = records[len(records)-limit:]
+	}
+	return records, nil
+}
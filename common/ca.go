@@ -7,6 +7,7 @@ import (
 	"crypto/x509/pkix"
 	"math/big"
 	"net"
+	"sync"
 	"time"
 )
 
@@ -27,6 +28,7 @@ type CA struct {
 	CertFile    string
 	privKey     *ecdsa.PrivateKey
 	cert        *x509.Certificate
+	mutex       sync.Mutex // Serializes the issuing of certificates, so that serials are unique
 }
 
 // Generate a self-signed certificate for `priv` key
@@ -39,7 +41,7 @@ func (ca *CA) genCACert(duration *Duration, name *pkix.Name) (cert []byte, err e
 		NotAfter:              time.Now().AddDate(duration.Years, duration.Months, duration.Days),
 		IsCA:                  true,
 		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
-		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
 		BasicConstraintsValid: true,
 	}
 	pub := &ca.privKey.PublicKey
@@ -52,7 +54,12 @@ func (ca *CA) genCACert(duration *Duration, name *pkix.Name) (cert []byte, err e
 
 // Create a certificate for the given csr
 func (ca *CA) GenCertFromCSR(csr *x509.CertificateRequest, duration *Duration) (cert []byte, err error) {
-	// TODO: verify csr
+	// The content of the csr is checked by the requester's CSRPolicy, its signature is checked here in any case
+	if err := csr.CheckSignature(); err != nil {
+		return nil, err
+	}
+	ca.mutex.Lock()
+	defer ca.mutex.Unlock()
 	cert_a := &x509.Certificate{
 		SerialNumber: ca.Serial,
 		Subject:      csr.Subject,
@@ -64,6 +71,7 @@ func (ca *CA) GenCertFromCSR(csr *x509.CertificateRequest, duration *Duration) (
 		KeyUsage:    x509.KeyUsageDigitalSignature,
 		DNSNames:    csr.DNSNames,
 		IPAddresses: csr.IPAddresses,
+		URIs:        csr.URIs, // The IA, checked by the CSRPolicy
 	}
 	// Sign the certificate
 	cert, err = x509.CreateCertificate(rand.Reader, cert_a, ca.cert, csr.PublicKey, ca.privKey)
@@ -77,6 +85,8 @@ func (ca *CA) GenCertFromCSR(csr *x509.CertificateRequest, duration *Duration) (
 
 // TODO: add also IPAddresses argument
 func (ca *CA) GenCert(name pkix.Name, keys *ecdsa.PrivateKey, duration *Duration, DNSNames []string, IPAddresses []net.IP) (cert []byte, err error) {
+	ca.mutex.Lock()
+	defer ca.mutex.Unlock()
 	cert_a := &x509.Certificate{
 		SerialNumber: ca.Serial,
 		Subject:      name,
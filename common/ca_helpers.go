@@ -16,10 +16,38 @@ import (
 	"log"
 	"math/big"
 	"net"
+	"net/url"
 	"os"
 	"strconv"
 )
 
+// Scheme of the URI SAN that binds the IA of a component into its certificate, e.g. scion:17-ffaa:1:c5
+const IAURIScheme = "scion"
+
+// Returns the URI SAN carrying ia
+func IAURI(ia addr.IA) *url.URL {
+	return &url.URL{Scheme: IAURIScheme, Opaque: ia.String()}
+}
+
+// Returns the IA bound in the URI SANs of a certificate or CSR. It is an error if there is none, more than one or if
+// it isn't valid.
+func IAFromURIs(uris []*url.URL) (addr.IA, error) {
+	found := []*url.URL{}
+	for _, uri := range uris {
+		if uri.Scheme == IAURIScheme {
+			found = append(found, uri)
+		}
+	}
+	if len(found) != 1 {
+		return addr.IA{}, errors.Errorf("exactly one %s URI with the IA is required, got %d", IAURIScheme, len(found))
+	}
+	ia, err := addr.IAFromString(found[0].Opaque)
+	if err != nil {
+		return addr.IA{}, errors.Wrapf(err, "invalid IA %q", found[0].Opaque)
+	}
+	return ia, nil
+}
+
 // TODO: check type and handle errors
 func WriteToPEMFile(fileName, typ string, bytes []byte) error {
 	out, err := os.Create(fileName)
@@ -68,14 +96,15 @@ func ReadECPrivKeyFromPEMFile(fileName string) (*ecdsa.PrivateKey, error) {
 	return nil, errors.New("Unsupported type: " + pemBlock.Type)
 }
 
-// Create a csr for the given key
-func GenCertSignRequest(name pkix.Name, keys *ecdsa.PrivateKey, DNSNames []string, IPAddresses []net.IP) (csr []byte, err error) {
+// Create a csr for the given key. The IA of the component goes in URIs, see IAURI.
+func GenCertSignRequest(name pkix.Name, keys *ecdsa.PrivateKey, DNSNames []string, IPAddresses []net.IP, URIs []*url.URL) (csr []byte, err error) {
 	// step: generate a csr template
 	var csrTemplate = x509.CertificateRequest{
 		Subject:            name,
 		SignatureAlgorithm: x509.ECDSAWithSHA512,
 		DNSNames:           DNSNames,
 		IPAddresses:        IPAddresses,
+		URIs:               URIs,
 	}
 	// step: generate the csr request
 	csrCertificate, err := x509.CreateCertificateRequest(rand.Reader, &csrTemplate, keys)
@@ -0,0 +1,409 @@
+package common
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/netsec-ethz/2SMS/common/types"
+	"github.com/pkg/errors"
+)
+
+// Capability tokens are base64url encoded chains of signed capabilities. The root is signed by a trusted issuer (an
+// Endpoint or the Manager's CA), each further link by the holder key of the previous one and must be at most as
+// permissive as it.
+type signedCapability struct {
+	Payload   []byte            `json:"payload"` // Json encoded types.Capability
+	Signature []byte            `json:"signature"`
+	Parent    *signedCapability `json:"parent,omitempty"`
+}
+
+type ecdsaSignature struct {
+	R, S *big.Int
+}
+
+func signCapability(capability types.Capability, parent *signedCapability, key *ecdsa.PrivateKey) (string, error) {
+	payload, err := json.Marshal(capability)
+	if err != nil {
+		return "", err
+	}
+	digest := sha256.Sum256(payload)
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+	if err != nil {
+		return "", err
+	}
+	signature, err := asn1.Marshal(ecdsaSignature{r, s})
+	if err != nil {
+		return "", err
+	}
+	token, err := json.Marshal(signedCapability{Payload: payload, Signature: signature, Parent: parent})
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(token), nil
+}
+
+func verifySignature(signed *signedCapability, key *ecdsa.PublicKey) bool {
+	var sig ecdsaSignature
+	if _, err := asn1.Unmarshal(signed.Signature, &sig); err != nil || sig.R == nil || sig.S == nil {
+		return false
+	}
+	digest := sha256.Sum256(signed.Payload)
+	return ecdsa.Verify(key, digest[:], sig.R, sig.S)
+}
+
+func decodeCapabilityToken(token string) (*signedCapability, error) {
+	bts, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, errors.Wrap(err, "decoding capability token")
+	}
+	signed := &signedCapability{}
+	if err = json.Unmarshal(bts, signed); err != nil {
+		return nil, errors.Wrap(err, "decoding capability token")
+	}
+	return signed, nil
+}
+
+// Returns a new random capability ID
+func NewCapabilityID() (string, error) {
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(random), nil
+}
+
+// DER encoding of a public key, to be used as holder key of a capability
+func EncodeHolderKey(key *ecdsa.PublicKey) ([]byte, error) {
+	return x509.MarshalPKIXPublicKey(key)
+}
+
+// Signs the capability with key, which must be the one of a trusted issuer, and returns the token
+func MintCapability(capability types.Capability, key *ecdsa.PrivateKey) (string, error) {
+	if err := validateCapability(&capability); err != nil {
+		return "", err
+	}
+	return signCapability(capability, nil, key)
+}
+
+// Signs the capability with the CA's key, so that it is accepted by all Endpoints trusting the CA
+func (ca *CA) MintCapability(capability types.Capability) (string, error) {
+	return MintCapability(capability, ca.privKey)
+}
+
+// Derives a narrower capability from token. holderKey must be the private key of the holder key in token's last
+// capability and capability must be at most as permissive as it.
+func DeriveCapability(token string, capability types.Capability, holderKey *ecdsa.PrivateKey) (string, error) {
+	parent, err := decodeCapabilityToken(token)
+	if err != nil {
+		return "", err
+	}
+	var parentCap types.Capability
+	if err = json.Unmarshal(parent.Payload, &parentCap); err != nil {
+		return "", errors.Wrap(err, "decoding capability")
+	}
+	if err = validateCapability(&capability); err != nil {
+		return "", err
+	}
+	if err = checkAttenuation(&parentCap, &capability); err != nil {
+		return "", err
+	}
+	return signCapability(capability, parent, holderKey)
+}
+
+func validateCapability(capability *types.Capability) error {
+	if capability.ID == "" {
+		return errors.New("capability has no id")
+	}
+	if capability.Endpoint == "" {
+		return errors.New("capability has no endpoint")
+	}
+	if len(capability.Mappings) == 0 {
+		return errors.New("capability grants no mapping")
+	}
+	if capability.Expires.IsZero() {
+		return errors.New("capability has no expiration")
+	}
+	if capability.Subject != "" && IsSourcePattern(capability.Subject) {
+		if err := ValidateSourcePattern(capability.Subject); err != nil {
+			return err
+		}
+	}
+	if capability.Frequency != "" {
+		if d, err := time.ParseDuration(capability.Frequency); err != nil || d <= 0 {
+			return errors.Errorf("invalid frequency %q", capability.Frequency)
+		}
+	}
+	return nil
+}
+
+// Checks that child grants at most what parent grants
+func checkAttenuation(parent, child *types.Capability) error {
+	if child.ID == parent.ID {
+		return errors.New("derived capability must have its own id")
+	}
+	if child.Endpoint != parent.Endpoint {
+		return errors.New("derived capability must be for the same endpoint")
+	}
+	if parent.Subject != "" && child.Subject != parent.Subject &&
+		(IsSourcePattern(child.Subject) || !SourceMatches(parent.Subject, child.Subject)) {
+		return errors.Errorf("subject %q is not covered by %q", child.Subject, parent.Subject)
+	}
+	for mapping, filters := range child.Mappings {
+		parentFilters, ok := parent.Mappings[mapping]
+		if !ok {
+			return errors.Errorf("mapping %s is not granted", mapping)
+		}
+		if len(parentFilters) == 0 {
+			continue
+		}
+		if len(filters) == 0 {
+			return errors.Errorf("all metrics of %s requested but only some are granted", mapping)
+		}
+		for _, filter := range filters {
+			if !metricMatches(filter, parentFilters) {
+				return errors.Errorf("metric filter %q on %s is not granted", filter, mapping)
+			}
+		}
+	}
+	if parent.Frequency != "" {
+		parentPeriod, _ := time.ParseDuration(parent.Frequency)
+		period, _ := time.ParseDuration(child.Frequency)
+		if period < parentPeriod {
+			return errors.Errorf("frequency must be at least %s", parent.Frequency)
+		}
+	}
+	if child.NotBefore.Before(parent.NotBefore) {
+		return errors.New("derived capability can't be valid before its parent")
+	}
+	if child.Expires.After(parent.Expires) {
+		return errors.New("derived capability can't expire after its parent")
+	}
+	return nil
+}
+
+// Whether name is matched by one of the filters, or filters is empty. A filter matching a derived filter covers it.
+func metricMatches(name string, filters []string) bool {
+	if len(filters) == 0 {
+		return true
+	}
+	for _, f := range filters {
+		if f == name || (strings.HasSuffix(f, "*") && strings.HasPrefix(name, f[:len(f)-1])) {
+			return true
+		}
+	}
+	return false
+}
+
+// CapabilityVerifier checks capability tokens against a set of trusted issuer keys and a list of revoked capability
+// IDs, persisted in a file
+type CapabilityVerifier struct {
+	endpoint string
+	issuers  []*ecdsa.PublicKey
+	file     string
+	revoked  map[string]time.Time // Capability ID -> expiration
+	mutex    sync.RWMutex
+}
+
+// Creates a verifier for capabilities of the endpoint with the given IP, signed by one of the issuers
+func NewCapabilityVerifier(endpoint, revocationFile string, issuers ...*ecdsa.PublicKey) (*CapabilityVerifier, error) {
+	cv := &CapabilityVerifier{endpoint: endpoint, issuers: issuers, file: revocationFile, revoked: make(map[string]time.Time)}
+	if revocationFile != "" && FileExists(revocationFile) {
+		bts, err := ioutil.ReadFile(revocationFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "reading revoked capabilities")
+		}
+		if err = json.Unmarshal(bts, &cv.revoked); err != nil {
+			return nil, errors.Wrap(err, "decoding revoked capabilities")
+		}
+	}
+	return cv, nil
+}
+
+// Verifies the token and returns its chain of capabilities, root first
+func (cv *CapabilityVerifier) Verify(token string, now time.Time) ([]types.Capability, error) {
+	signed, err := decodeCapabilityToken(token)
+	if err != nil {
+		return nil, err
+	}
+	// Collect the links, root first
+	links := []*signedCapability{}
+	for s := signed; s != nil; s = s.Parent {
+		links = append([]*signedCapability{s}, links...)
+		if len(links) > 16 {
+			return nil, errors.New("capability chain too long")
+		}
+	}
+	chain := make([]types.Capability, len(links))
+	for i, link := range links {
+		if err = json.Unmarshal(link.Payload, &chain[i]); err != nil {
+			return nil, errors.Wrap(err, "decoding capability")
+		}
+		if err = validateCapability(&chain[i]); err != nil {
+			return nil, err
+		}
+		if i == 0 {
+			if !cv.signedByIssuer(link) {
+				return nil, errors.New("capability not signed by a trusted issuer")
+			}
+			continue
+		}
+		if err = checkAttenuation(&chain[i-1], &chain[i]); err != nil {
+			return nil, err
+		}
+		holderKey, err := x509.ParsePKIXPublicKey(chain[i-1].HolderKey)
+		if err != nil {
+			return nil, errors.Errorf("capability %s has no valid holder key", chain[i-1].ID)
+		}
+		ecKey, ok := holderKey.(*ecdsa.PublicKey)
+		if !ok || !verifySignature(link, ecKey) {
+			return nil, errors.Errorf("capability %s not signed by the holder of %s", chain[i].ID, chain[i-1].ID)
+		}
+	}
+	cv.mutex.RLock()
+	defer cv.mutex.RUnlock()
+	for _, capability := range chain {
+		if capability.Endpoint != cv.endpoint {
+			return nil, errors.Errorf("capability is for endpoint %s", capability.Endpoint)
+		}
+		if _, revoked := cv.revoked[capability.ID]; revoked {
+			return nil, errors.Errorf("capability %s is revoked", capability.ID)
+		}
+		if now.Before(capability.NotBefore) {
+			return nil, errors.Errorf("capability %s is not valid before %s", capability.ID, capability.NotBefore.Format(time.RFC3339))
+		}
+		if !now.Before(capability.Expires) {
+			return nil, errors.Errorf("capability %s has expired", capability.ID)
+		}
+	}
+	return chain, nil
+}
+
+func (cv *CapabilityVerifier) signedByIssuer(signed *signedCapability) bool {
+	for _, issuer := range cv.issuers {
+		if verifySignature(signed, issuer) {
+			return true
+		}
+	}
+	return false
+}
+
+// Revokes the capability with the given ID, and thus all capabilities derived from it, until it expires
+func (cv *CapabilityVerifier) Revoke(id string, expires time.Time) error {
+	cv.mutex.Lock()
+	defer cv.mutex.Unlock()
+	revoked := make(map[string]time.Time)
+	now := time.Now()
+	for rid, rexpires := range cv.revoked {
+		if rexpires.IsZero() || now.Before(rexpires) {
+			revoked[rid] = rexpires
+		}
+	}
+	revoked[id] = expires
+	if cv.file != "" {
+		bts, err := json.Marshal(revoked)
+		if err != nil {
+			return err
+		}
+		if err = WriteFileAtomic(cv.file, bts, 0600); err != nil {
+			return errors.Wrap(err, "writing revoked capabilities")
+		}
+	}
+	cv.revoked = revoked
+	return nil
+}
+
+// Returns the revoked capability IDs that haven't expired yet
+func (cv *CapabilityVerifier) Revoked() []types.CapabilityRevocation {
+	cv.mutex.RLock()
+	defer cv.mutex.RUnlock()
+	revocations := []types.CapabilityRevocation{}
+	now := time.Now()
+	for id, expires := range cv.revoked {
+		if expires.IsZero() || now.Before(expires) {
+			revocations = append(revocations, types.CapabilityRevocation{ID: id, Expires: expires})
+		}
+	}
+	return revocations
+}
+
+// Checks whether the chain of capabilities, as returned by CapabilityVerifier.Verify, lets source scrape the mapping at
+// path now. The frequency of every capability in the chain is enforced. The returned error, if any, is an
+// *AuthorizationError.
+func (ac *AccessController) AuthorizedByCapability(chain []types.Capability, source, path string) error {
+	if !ac.isActive() {
+		return nil
+	}
+	for _, capability := range chain {
+		if capability.Subject != "" && capability.Subject != source && !SourceMatches(capability.Subject, source) {
+			return &AuthorizationError{Reason: ScrapeNotAuthorized, Message: "Capability " + capability.ID + " can't be used by " + source}
+		}
+		if _, ok := capability.Mappings[path]; !ok {
+			return &AuthorizationError{Reason: ScrapeNotAuthorized, Message: "Capability " + capability.ID + " doesn't grant " + path}
+		}
+	}
+	// Only take tokens if all buckets have one, so that a refused scrape doesn't count
+	var wait time.Duration
+	for _, capability := range chain {
+		if period := capabilityPeriod(&capability); period > 0 {
+			if w := ac.Limiter.Peek("capability:"+capability.ID, path, period); w > wait {
+				wait = w
+			}
+		}
+	}
+	if wait == 0 {
+		for _, capability := range chain {
+			if period := capabilityPeriod(&capability); period > 0 {
+				if ok, w := ac.Limiter.Take("capability:"+capability.ID, path, period); !ok && w > wait {
+					wait = w
+				}
+			}
+		}
+	}
+	if wait > 0 {
+		retryAt := time.Now().Add(wait)
+		return &AuthorizationError{
+			Reason:     ScrapeTooFrequent,
+			Message:    "Next scrape with the capability on " + path + " authorized in " + wait.String(),
+			RetryAfter: wait,
+			RetryAt:    &retryAt,
+		}
+	}
+	return nil
+}
+
+func capabilityPeriod(capability *types.Capability) time.Duration {
+	if capability.Frequency == "" {
+		return 0
+	}
+	period, _ := time.ParseDuration(capability.Frequency)
+	return period
+}
+
+// Returns only the metric families matched by the filters of every capability in the chain on the mapping at path
+func (ac *AccessController) FilterMetricsByCapability(chain []types.Capability, path string, metrics []*MetricFamily) []*MetricFamily {
+	if !ac.isActive() {
+		return metrics
+	}
+	filteredMetrics := []*MetricFamily{}
+	for _, fam := range metrics {
+		allowed := true
+		for _, capability := range chain {
+			allowed = allowed && metricMatches(*fam.Name, capability.Mappings[path])
+		}
+		if allowed {
+			filteredMetrics = append(filteredMetrics, fam)
+		}
+	}
+	return filteredMetrics
+}
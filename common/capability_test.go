@@ -0,0 +1,254 @@
+package common
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/netsec-ethz/2SMS/common/types"
+)
+
+var capabilityTime = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func newTestKey(t *testing.T) *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// Capability granting filtered metrics of /br-1 and all metrics of /node to the hosts of an AS
+func testCapability(id string) types.Capability {
+	return types.Capability{
+		ID:        id,
+		Endpoint:  "10.0.0.5",
+		Subject:   "17-ffaa:1:c5:*",
+		Mappings:  map[string][]string{"/br-1": {"br_*", "go_goroutines"}, "/node": {}},
+		Frequency: "1m",
+		NotBefore: capabilityTime,
+		Expires:   capabilityTime.Add(24 * time.Hour),
+	}
+}
+
+func TestCheckAttenuation(t *testing.T) {
+	tests := []struct {
+		name   string
+		derive func(c *types.Capability)
+		ok     bool
+	}{
+		{"same permissions", func(c *types.Capability) {}, true},
+		{"same id", func(c *types.Capability) { c.ID = "parent" }, false},
+		{"other endpoint", func(c *types.Capability) { c.Endpoint = "10.0.0.6" }, false},
+		// Subject
+		{"host of the subject pattern", func(c *types.Capability) { c.Subject = "17-ffaa:1:c5:10.0.0.1" }, true},
+		{"host outside the subject pattern", func(c *types.Capability) { c.Subject = "17-ffaa:1:c6:10.0.0.1" }, false},
+		{"anyone", func(c *types.Capability) { c.Subject = "" }, false},
+		{"wider pattern", func(c *types.Capability) { c.Subject = "17-*:*" }, false},
+		{"other pattern", func(c *types.Capability) { c.Subject = "*-ffaa:1:c5:*" }, false},
+		{"invalid subject", func(c *types.Capability) { c.Subject = "17-ffaa:1:c5" }, false},
+		// Mappings and metrics
+		{"fewer mappings", func(c *types.Capability) { delete(c.Mappings, "/node") }, true},
+		{"other mapping", func(c *types.Capability) { c.Mappings["/br-2"] = nil }, false},
+		{"fewer metrics", func(c *types.Capability) { c.Mappings["/br-1"] = []string{"go_goroutines"} }, true},
+		{"metric matching a filter", func(c *types.Capability) { c.Mappings["/br-1"] = []string{"br_input_pkts_total"} }, true},
+		{"narrower filter", func(c *types.Capability) { c.Mappings["/br-1"] = []string{"br_input_*"} }, true},
+		{"filtered metrics of a whole mapping", func(c *types.Capability) { c.Mappings["/node"] = []string{"node_*"} }, true},
+		{"all metrics of a filtered mapping", func(c *types.Capability) { c.Mappings["/br-1"] = nil }, false},
+		{"other metric", func(c *types.Capability) { c.Mappings["/br-1"] = []string{"go_threads"} }, false},
+		{"wildcard", func(c *types.Capability) { c.Mappings["/br-1"] = []string{"*"} }, false},
+		{"wider filter", func(c *types.Capability) { c.Mappings["/br-1"] = []string{"b*"} }, false},
+		{"filter on a metric name", func(c *types.Capability) { c.Mappings["/br-1"] = []string{"go_goroutines*"} }, false},
+		{"prefix of a filter", func(c *types.Capability) { c.Mappings["/br-1"] = []string{"br"} }, false},
+		// Frequency and validity
+		{"lower frequency", func(c *types.Capability) { c.Frequency = "5m" }, true},
+		{"higher frequency", func(c *types.Capability) { c.Frequency = "30s" }, false},
+		{"no frequency", func(c *types.Capability) { c.Frequency = "" }, false},
+		{"later start", func(c *types.Capability) { c.NotBefore = c.NotBefore.Add(time.Hour) }, true},
+		{"earlier start", func(c *types.Capability) { c.NotBefore = c.NotBefore.Add(-time.Hour) }, false},
+		{"no start", func(c *types.Capability) { c.NotBefore = time.Time{} }, false},
+		{"earlier expiration", func(c *types.Capability) { c.Expires = c.Expires.Add(-time.Hour) }, true},
+		{"later expiration", func(c *types.Capability) { c.Expires = c.Expires.Add(time.Hour) }, false},
+	}
+	for _, test := range tests {
+		parent := testCapability("parent")
+		child := testCapability("child")
+		test.derive(&child)
+		err := checkAttenuation(&parent, &child)
+		if test.ok && err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		}
+		if !test.ok && err == nil {
+			t.Errorf("%s: expected an error", test.name)
+		}
+	}
+}
+
+func TestCheckAttenuationWithoutRestrictions(t *testing.T) {
+	parent := testCapability("parent")
+	parent.Subject, parent.Frequency, parent.NotBefore = "", "", time.Time{}
+	parent.Mappings["/br-1"] = nil
+	child := testCapability("child")
+	child.Subject, child.Frequency, child.Mappings["/br-1"] = "17-*:*", "10s", []string{"*"}
+	if err := checkAttenuation(&parent, &child); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+// Replaces the payload of the link at depth (0 being the token's last capability) without signing it again
+func tamperToken(t *testing.T, token string, depth int, tamper func(c *types.Capability)) string {
+	signed, err := decodeCapabilityToken(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	link := signed
+	for i := 0; i < depth; i++ {
+		link = link.Parent
+	}
+	var capability types.Capability
+	if err = json.Unmarshal(link.Payload, &capability); err != nil {
+		t.Fatal(err)
+	}
+	tamper(&capability)
+	if link.Payload, err = json.Marshal(capability); err != nil {
+		t.Fatal(err)
+	}
+	bts, err := json.Marshal(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(bts)
+}
+
+func TestVerifyCapability(t *testing.T) {
+	issuer, holder, attacker := newTestKey(t), newTestKey(t), newTestKey(t)
+	holderKey, err := EncodeHolderKey(&holder.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	attackerKey, err := EncodeHolderKey(&attacker.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mint := func(c types.Capability, key *ecdsa.PrivateKey) string {
+		token, err := MintCapability(c, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	derive := func(token string, c types.Capability, key *ecdsa.PrivateKey) string {
+		derived, err := DeriveCapability(token, c, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return derived
+	}
+	// Signs a link without the checks of DeriveCapability
+	forge := func(token string, c types.Capability, key *ecdsa.PrivateKey) string {
+		parent, err := decodeCapabilityToken(token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		forged, err := signCapability(c, parent, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return forged
+	}
+	root := testCapability("root")
+	root.HolderKey = holderKey
+	rootToken := mint(root, issuer)
+	child := testCapability("child")
+	child.Subject = "17-ffaa:1:c5:10.0.0.1"
+	child.Mappings = map[string][]string{"/br-1": {"br_input_*"}}
+	child.HolderKey = attackerKey
+	childToken := derive(rootToken, child, holder)
+	wider := testCapability("wider")
+	wider.Mappings["/br-2"] = nil
+	noHolder := testCapability("noholder")
+	noHolderToken := mint(noHolder, issuer)
+	revoked := testCapability("revoked")
+	revoked.HolderKey = holderKey
+	revokedToken := mint(revoked, issuer)
+	long := rootToken
+	for i := 0; i < 16; i++ {
+		link := testCapability("link" + strconv.Itoa(i))
+		link.HolderKey = holderKey
+		long = derive(long, link, holder)
+	}
+
+	verifier, err := NewCapabilityVerifier("10.0.0.5", "", &issuer.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = verifier.Revoke("revoked", revoked.Expires); err != nil {
+		t.Fatal(err)
+	}
+	now := capabilityTime.Add(time.Hour)
+	tests := []struct {
+		name   string
+		token  string
+		now    time.Time
+		length int // Of the returned chain, 0 if the token must be refused
+	}{
+		{"root", rootToken, now, 1},
+		{"derived", childToken, now, 2},
+		{"derived twice wider", forge(childToken, testCapability("grandchild"), attacker), now, 0},
+		{"derived twice narrower", derive(childToken, func() types.Capability {
+			c := child
+			c.ID = "grandchild"
+			c.Frequency = "10m"
+			c.HolderKey = nil
+			return c
+		}(), attacker), now, 3},
+		{"not before", rootToken, capabilityTime.Add(-time.Second), 0},
+		{"expired", rootToken, root.Expires, 0},
+		{"other endpoint", mint(func() types.Capability {
+			c := testCapability("other")
+			c.Endpoint = "10.0.0.6"
+			return c
+		}(), issuer), now, 0},
+		{"untrusted issuer", mint(root, attacker), now, 0},
+		{"revoked", revokedToken, now, 0},
+		{"derived from revoked", derive(revokedToken, testCapability("fromrevoked"), holder), now, 0},
+		{"too long", long, now, 0},
+		{"garbage", "not a token", now, 0},
+		{"invalid root", mint(testCapability("x"), issuer)[1:], now, 0},
+		// Attempts to get more than granted
+		{"wider link", forge(rootToken, wider, holder), now, 0},
+		{"link signed by another key", forge(rootToken, testCapability("stolen"), attacker), now, 0},
+		{"link signed by the issuer", forge(rootToken, testCapability("issued"), issuer), now, 0},
+		{"derived without holder key", forge(noHolderToken, testCapability("orphan"), holder), now, 0},
+		{"tampered root", tamperToken(t, rootToken, 0, func(c *types.Capability) { c.Expires = c.Expires.Add(time.Hour) }), now, 0},
+		{"tampered parent", tamperToken(t, childToken, 1, func(c *types.Capability) { c.Mappings["/br-2"] = nil }), now, 0},
+		{"tampered link", tamperToken(t, childToken, 0, func(c *types.Capability) { c.Mappings["/br-1"] = nil }), now, 0},
+		{"tampered holder key", tamperToken(t, childToken, 1, func(c *types.Capability) { c.HolderKey = attackerKey }), now, 0},
+		{"invalid link", forge(rootToken, func() types.Capability {
+			c := testCapability("invalid")
+			c.Expires = time.Time{}
+			return c
+		}(), holder), now, 0},
+	}
+	for _, test := range tests {
+		chain, err := verifier.Verify(test.token, test.now)
+		if test.length == 0 {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %v", test.name, chain)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		if len(chain) != test.length {
+			t.Errorf("%s: expected a chain of %d capabilities, got %d", test.name, test.length, len(chain))
+		}
+	}
+}
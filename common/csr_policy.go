@@ -0,0 +1,80 @@
+package common
+
+import (
+	"crypto/ecdsa"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Reasons for which a CSR is refused
+const (
+	CSRMalformed      = "malformed"
+	CSRBadSignature   = "bad_signature"
+	CSRInvalidOU      = "invalid_ou"
+	CSRInvalidIP      = "invalid_ip"
+	CSRIPMismatch     = "ip_mismatch"
+	CSRInvalidIA      = "invalid_ia"
+	CSRUnsupportedKey = "unsupported_key"
+)
+
+// CSRPolicyError tells why a CSR was refused. It is returned to the requester in json format.
+type CSRPolicyError struct {
+	Code    string `json:"error"`
+	Message string `json:"message"`
+}
+
+func (e *CSRPolicyError) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+func csrError(code, format string, args ...interface{}) *CSRPolicyError {
+	return &CSRPolicyError{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// CSRPolicy defines which CSRs may be signed by the CA
+type CSRPolicy struct {
+	AllowedOUs      []string // Organizational units of the components that may request a certificate
+	AllowedCurves   []string // Names of the elliptic curves allowed for the (ECDSA) key, e.g. P-256
+	RequireRemoteIP bool     // Whether the IP in the CSR must be the one the request comes from
+}
+
+// Checks csr against the policy. remoteIP is the address the request comes from. The returned error, if any, is a
+// *CSRPolicyError.
+func (p *CSRPolicy) Check(csr *x509.CertificateRequest, remoteIP string) error {
+	if err := csr.CheckSignature(); err != nil {
+		return csrError(CSRBadSignature, "invalid self-signature: %v", err)
+	}
+	if len(csr.Subject.OrganizationalUnit) != 1 || !contains(p.AllowedOUs, csr.Subject.OrganizationalUnit[0]) {
+		return csrError(CSRInvalidOU, "organizational unit must be exactly one of %s, got %v",
+			strings.Join(p.AllowedOUs, ", "), csr.Subject.OrganizationalUnit)
+	}
+	if len(csr.IPAddresses) != 1 {
+		return csrError(CSRInvalidIP, "exactly one IP address is required, got %d", len(csr.IPAddresses))
+	}
+	if p.RequireRemoteIP && !csr.IPAddresses[0].Equal(net.ParseIP(remoteIP)) {
+		return csrError(CSRIPMismatch, "IP address %s doesn't match the requesting address %s", csr.IPAddresses[0], remoteIP)
+	}
+	// The IA identifies the component together with the IP, e.g. as a scrape source
+	if _, err := IAFromURIs(csr.URIs); err != nil {
+		return csrError(CSRInvalidIA, "%v", err)
+	}
+	pub, ok := csr.PublicKey.(*ecdsa.PublicKey)
+	if !ok {
+		return csrError(CSRUnsupportedKey, "only ECDSA keys are supported, got %v", csr.PublicKeyAlgorithm)
+	}
+	if curve := pub.Curve.Params().Name; !contains(p.AllowedCurves, curve) {
+		return csrError(CSRUnsupportedKey, "curve %s is not one of %s", curve, strings.Join(p.AllowedCurves, ", "))
+	}
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,119 @@
+package common
+
+import (
+	"strings"
+	"time"
+
+	"github.com/netsec-ethz/2SMS/common/types"
+)
+
+// Returns the chains of subjects through which source gets perm on mapping: the source itself or a pattern matching
+// it, followed by the roles leading to the subject holding the permission
+func (ac *AccessController) permissionChains(source, mapping, perm string) []types.Grant {
+	grants := []types.Grant{}
+	var visit func(chain []string)
+	visit = func(chain []string) {
+		subject := chain[len(chain)-1]
+		for _, p := range ac.enforcer.GetPermissionsForUser(subject) {
+			if p[1] == mapping && p[2] == perm {
+				grants = append(grants, types.Grant{Chain: append([]string{}, chain...)})
+				break
+			}
+		}
+		roles := ac.enforcer.GetRolesForUser(subject)
+		if len(chain) == 1 {
+			roles = ac.internalRolesOf(subject)
+		}
+		if IsSourcePattern(subject) {
+			// Pattern role bindings are grouping policies as well
+			roles = []string{}
+			for _, grouping := range ac.enforcer.GetGroupingPolicy() {
+				if len(grouping) > 1 && grouping[0] == subject {
+					roles = append(roles, grouping[1])
+				}
+			}
+		}
+		for _, role := range roles {
+			if !contains(chain, role) {
+				visit(append(chain[:len(chain):len(chain)], role))
+			}
+		}
+	}
+	visit([]string{source})
+	for _, pattern := range ac.matchingPatterns(source) {
+		visit([]string{source, pattern})
+	}
+	return grants
+}
+
+// Explains the decision on a scrape of mapping by source, without affecting it: unlike Authorized it doesn't take a
+// token nor remove an expired window. If metric is not empty, the permission to read that metric family is explained
+// as well.
+func (ac *AccessController) Explain(source, mapping, metric string) *types.Explanation {
+	ac.mutex.RLock()
+	defer ac.mutex.RUnlock()
+	exp := &types.Explanation{
+		Source:   source,
+		Mapping:  mapping,
+		Active:   ac.active,
+		Decision: "allow",
+		Patterns: ac.matchingPatterns(source),
+		Grants:   ac.permissionChains(source, mapping, ScrapePermission),
+	}
+	deny := func(reason, message string) {
+		if exp.Decision == "allow" {
+			exp.Decision, exp.Reason, exp.Message = "deny", reason, message
+		}
+	}
+	if !ac.enforcer.Enforce(source, mapping, ScrapePermission) {
+		deny(ScrapeNotAuthorized, source+" not authorized to scrape "+mapping)
+	}
+	// Timing constraints, looked up like in Authorized
+	now := time.Now()
+	var frequency time.Duration
+	for _, subject := range append([]string{source}, exp.Patterns...) {
+		for _, perm := range ac.permissionsForObject(subject, mapping) {
+			if strings.HasPrefix(perm, "window:") && exp.Window == "" {
+				exp.Window = strings.SplitAfterN(perm, ":", 2)[1]
+				win, err := ParseWindow(exp.Window)
+				if err != nil {
+					deny(ScrapeNotAuthorized, "Invalid time window: "+err.Error())
+					continue
+				}
+				open, close, ok := win.Interval(now)
+				if !ok {
+					deny(ScrapeWindowExpired, "Time window for "+source+" on "+mapping+" has expired")
+					continue
+				}
+				if now.Before(open) {
+					exp.NextOpen = open.Format(time.RFC3339)
+					deny(ScrapeWindowClosed, "Time window for "+source+" on "+mapping+" opens at "+exp.NextOpen)
+				}
+				if !close.IsZero() {
+					exp.NextClose = close.Format(time.RFC3339)
+				}
+			} else if strings.HasPrefix(perm, "frequency:") && exp.Frequency == "" {
+				exp.Frequency = strings.Split(perm, ":")[1]
+				var err error
+				if frequency, err = time.ParseDuration(exp.Frequency); err != nil {
+					deny(ScrapeNotAuthorized, "Invalid frequency: "+err.Error())
+				}
+			}
+		}
+	}
+	if wait := ac.Limiter.Peek(source, mapping, frequency); wait > 0 {
+		exp.RetryAfter = wait.String()
+		deny(ScrapeTooFrequent, "Next scrape for "+source+" on "+mapping+" authorized in "+wait.String())
+	}
+	if !ac.active {
+		exp.Decision, exp.Reason, exp.Message = "allow", "", "Access control is disabled"
+	}
+	if metric != "" {
+		exp.Metric = &types.Grants{
+			Name:    metric,
+			Allowed: !ac.active || ac.enforcer.Enforce(source, mapping, metric),
+			Grants:  ac.permissionChains(source, mapping, metric),
+		}
+	}
+	return exp
+}
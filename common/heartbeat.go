@@ -0,0 +1,43 @@
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/netsec-ethz/2SMS/common/types"
+)
+
+// Version of the 2SMS components, reported to the Manager with every heartbeat. Can be set at build time with
+// -ldflags "-X github.com/netsec-ethz/2SMS/common.Version=..."
+var Version = "dev"
+
+// Sends hb to url every interval until the process terminates. Failures are only logged, the Manager notices them as
+// missing heartbeats.
+func StartHeartbeat(client *http.Client, url string, hb types.Heartbeat, interval time.Duration) {
+	hb.Version = Version
+	data, err := json.Marshal(hb)
+	if err != nil {
+		log.Printf("Heartbeat: failed marshalling heartbeat, not sending any: %v", err)
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			resp, err := client.Post(url, "application/json", bytes.NewReader(data))
+			if err != nil {
+				log.Printf("Heartbeat: failed sending heartbeat to %s: %v", url, err)
+				continue
+			}
+			if resp.StatusCode != http.StatusNoContent {
+				message, _ := ioutil.ReadAll(resp.Body)
+				log.Printf("Heartbeat: rejected by %s. Status code: %d, Message: %s", url, resp.StatusCode, message)
+			}
+			resp.Body.Close()
+		}
+	}()
+}
@@ -7,21 +7,91 @@ import (
 	"log"
 	"net/http"
 	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Key pair shared by all servers and clients using the same certificate file, so that it can be replaced while they
+// are running (e.g. after a renewal)
+type keyPair struct {
+	cert  *tls.Certificate
+	mutex sync.RWMutex
+}
+
+var (
+	keyPairs      = make(map[string]*keyPair)
+	keyPairsMutex sync.Mutex
 )
 
-// TODO: handle errors (e.g. empty pool)
+// Returns the key pair for certFile, loading it from disk the first time
+func loadKeyPair(certFile, keyFile string) (*keyPair, error) {
+	keyPairsMutex.Lock()
+	defer keyPairsMutex.Unlock()
+	if kp, ok := keyPairs[certFile]; ok {
+		return kp, nil
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	kp := &keyPair{cert: &cert}
+	keyPairs[certFile] = kp
+	return kp, nil
+}
+
+func (kp *keyPair) get() *tls.Certificate {
+	kp.mutex.RLock()
+	defer kp.mutex.RUnlock()
+	return kp.cert
+}
+
+func (kp *keyPair) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return kp.get(), nil
+}
+
+func (kp *keyPair) getClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return kp.get(), nil
+}
+
+// Replaces the key pair used by all servers and clients created for certFile. New connections use the new
+// certificate, established ones are not affected.
+func SetKeyPair(certFile string, cert tls.Certificate) {
+	keyPairsMutex.Lock()
+	kp, ok := keyPairs[certFile]
+	if !ok {
+		kp = &keyPair{}
+		keyPairs[certFile] = kp
+	}
+	keyPairsMutex.Unlock()
+	kp.mutex.Lock()
+	defer kp.mutex.Unlock()
+	kp.cert = &cert
+}
+
+// Reloads the key pair for certFile from disk
+func ReloadKeyPair(certFile, keyFile string) error {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	SetKeyPair(certFile, cert)
+	return nil
+}
+
+// TODO: handle empty pool
 func NewCertPoolFromDir(dirPath string) (*x509.CertPool, error) {
 	newCertPool := x509.NewCertPool()
 	files, err := ioutil.ReadDir(dirPath)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 	for _, file := range files {
 		// Check extension to match .crt
 		if strings.Contains(file.Name(), ".crt") {
 			cert, err := ioutil.ReadFile(dirPath + "/" + file.Name())
 			if err != nil {
-				log.Fatal(err)
+				return nil, err
 			}
 			newCertPool.AppendCertsFromPEM(cert)
 		}
@@ -29,46 +99,58 @@ func NewCertPoolFromDir(dirPath string) (*x509.CertPool, error) {
 	return newCertPool, nil
 }
 
+// Like NewHttpsClient, but exits if the client can't be created
 func CreateHttpsClient(caCertDir, clientCert, clientPrivKey string) *http.Client {
+	client, err := NewHttpsClient(caCertDir, clientCert, clientPrivKey)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return client
+}
+
+// Creates a client authenticating with the shared key pair of clientCert, loaded from disk the first time
+func NewHttpsClient(caCertDir, clientCert, clientPrivKey string) (*http.Client, error) {
 	// Load server certificates
 	serverCertPool, err := NewCertPoolFromDir(caCertDir)
 	if err != nil {
-		log.Fatalf("Could not build cert pool: %v", err)
+		return nil, errors.Wrap(err, "building cert pool")
 	}
 	// Load client cert and key
-	cert, err := tls.LoadX509KeyPair(clientCert, clientPrivKey)
+	kp, err := loadKeyPair(clientCert, clientPrivKey)
 	if err != nil {
-		log.Fatalf("Error loading pub/priv pair from %s:%v", clientCert, err)
+		return nil, errors.Wrapf(err, "loading pub/priv pair from %s", clientCert)
 	}
 	// Create HTTPS client
 	client := &http.Client{
 		Transport: &http.Transport{
 			TLSClientConfig: &tls.Config{
-				RootCAs:      serverCertPool,
-				Certificates: []tls.Certificate{cert},
+				RootCAs:               serverCertPool,
+				GetClientCertificate:  kp.getClientCertificate,
+				VerifyPeerCertificate: verifyNotRevoked,
 			},
 		},
 	}
-	return client
+	return client, nil
 }
 
 func CreateHttpsServer(clientCACertsDir, serverCert, serverPrivKey, listenInterface, listenPort string, handler http.Handler, clientAuth tls.ClientAuthType) *http.Server {
 	// Load client certificates
 	clientCAs, err := NewCertPoolFromDir(clientCACertsDir)
 	if err != nil {
-		log.Println("Unable to create client certificate pool: ", err)
-		return nil
+		log.Fatal("Unable to create client certificate pool: ", err)
 	}
 	// Load server cert and key
-	cert, err := tls.LoadX509KeyPair(serverCert, serverPrivKey)
+	kp, err := loadKeyPair(serverCert, serverPrivKey)
 	if err != nil {
 		log.Fatal(err)
 	}
-	// Require scraper certificate verification
+	// Require scraper certificate verification, rejecting revoked certificates. The certificate is looked up on every
+	// handshake, so the server must be started with ListenAndServeTLS("", "").
 	cfg := &tls.Config{
-		ClientAuth:   clientAuth,
-		ClientCAs:    clientCAs,
-		Certificates: []tls.Certificate{cert},
+		ClientAuth:            clientAuth,
+		ClientCAs:             clientCAs,
+		GetCertificate:        kp.getCertificate,
+		VerifyPeerCertificate: verifyNotRevoked,
 	}
 	// Run HTTPS server
 	srv := &http.Server{
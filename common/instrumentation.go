@@ -0,0 +1,207 @@
+package common
+
+import (
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Default buckets, in seconds, of the histograms of request durations
+var DurationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Metrics about the component itself, exposed by SelfMetricsHandler
+var SelfMetrics = &MetricsRegistry{}
+
+var startTime = time.Now()
+
+// Registry of the counters and histograms a component keeps about itself
+type MetricsRegistry struct {
+	mutex    sync.Mutex
+	families []selfMetric
+}
+
+type selfMetric interface {
+	gather() *MetricFamily
+}
+
+func (r *MetricsRegistry) register(metric selfMetric) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.families = append(r.families, metric)
+}
+
+// Returns the current values of all registered metrics, plus the uptime of the process
+func (r *MetricsRegistry) Gather() []*MetricFamily {
+	r.mutex.Lock()
+	families := append([]selfMetric{}, r.families...)
+	r.mutex.Unlock()
+	metrics := []*MetricFamily{}
+	for _, family := range families {
+		metrics = append(metrics, family.gather())
+	}
+	name, help := "twosms_uptime_seconds", "Time since the process started."
+	uptime := time.Since(startTime).Seconds()
+	metrics = append(metrics, &MetricFamily{
+		Name:   &name,
+		Help:   &help,
+		Type:   MetricType_GAUGE.Enum(),
+		Metric: []*Metric{{Gauge: &Gauge{Value: &uptime}}},
+	})
+	return metrics
+}
+
+// Separates the label values in the keys of the series of a metric
+const labelSeparator = "\xff"
+
+type metricVec struct {
+	name       string
+	help       string
+	labelNames []string
+}
+
+func (v *metricVec) key(labelValues []string) string {
+	if len(labelValues) != len(v.labelNames) {
+		log.Printf("Metric %s expects labels %v, got values %v", v.name, v.labelNames, labelValues)
+	}
+	return strings.Join(labelValues, labelSeparator)
+}
+
+func (v *metricVec) labels(key string) []*LabelPair {
+	if len(v.labelNames) == 0 {
+		return nil
+	}
+	values := strings.Split(key, labelSeparator)
+	pairs := []*LabelPair{}
+	for i, name := range v.labelNames {
+		name, value := name, ""
+		if i < len(values) {
+			value = values[i]
+		}
+		pairs = append(pairs, &LabelPair{Name: &name, Value: &value})
+	}
+	return pairs
+}
+
+// Counter with labels
+type CounterVec struct {
+	metricVec
+	mutex  sync.Mutex
+	values map[string]float64
+}
+
+// Creates a counter with the given label names and registers it in SelfMetrics
+func NewCounterVec(name, help string, labelNames ...string) *CounterVec {
+	c := &CounterVec{metricVec: metricVec{name, help, labelNames}, values: make(map[string]float64)}
+	SelfMetrics.register(c)
+	return c
+}
+
+// Increments the counter with the given label values
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *CounterVec) Add(v float64, labelValues ...string) {
+	key := c.key(labelValues)
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.values[key] += v
+}
+
+func (c *CounterVec) gather() *MetricFamily {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	family := &MetricFamily{Name: &c.name, Help: &c.help, Type: MetricType_COUNTER.Enum()}
+	keys := []string{}
+	for key := range c.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value := c.values[key]
+		family.Metric = append(family.Metric, &Metric{Label: c.labels(key), Counter: &Counter{Value: &value}})
+	}
+	return family
+}
+
+// Histogram with labels
+type HistogramVec struct {
+	metricVec
+	buckets []float64
+	mutex   sync.Mutex
+	values  map[string]*histogramValue
+}
+
+type histogramValue struct {
+	counts []uint64 // Per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+// Creates a histogram with the given (sorted) bucket upper bounds and label names and registers it in SelfMetrics
+func NewHistogramVec(name, help string, buckets []float64, labelNames ...string) *HistogramVec {
+	h := &HistogramVec{metricVec: metricVec{name, help, labelNames}, buckets: buckets, values: make(map[string]*histogramValue)}
+	SelfMetrics.register(h)
+	return h
+}
+
+// Adds an observation to the histogram with the given label values
+func (h *HistogramVec) Observe(v float64, labelValues ...string) {
+	key := h.key(labelValues)
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	value, ok := h.values[key]
+	if !ok {
+		value = &histogramValue{counts: make([]uint64, len(h.buckets))}
+		h.values[key] = value
+	}
+	for i, bound := range h.buckets {
+		if v <= bound {
+			value.counts[i]++
+			break
+		}
+	}
+	value.count++
+	value.sum += v
+}
+
+// Observes the time elapsed since start, in seconds
+func (h *HistogramVec) ObserveSince(start time.Time, labelValues ...string) {
+	h.Observe(time.Since(start).Seconds(), labelValues...)
+}
+
+func (h *HistogramVec) gather() *MetricFamily {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	family := &MetricFamily{Name: &h.name, Help: &h.help, Type: MetricType_HISTOGRAM.Enum()}
+	keys := []string{}
+	for key := range h.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value := h.values[key]
+		// Copied, the values keep changing after gathering
+		count, sum := value.count, value.sum
+		histogram := &Histogram{SampleCount: &count, SampleSum: &sum}
+		cumulative := uint64(0)
+		for i := range h.buckets {
+			cumulative += value.counts[i]
+			bucketCount, bound := cumulative, h.buckets[i]
+			histogram.Bucket = append(histogram.Bucket, &Bucket{CumulativeCount: &bucketCount, UpperBound: &bound})
+		}
+		family.Metric = append(family.Metric, &Metric{Label: h.labels(key), Histogram: histogram})
+	}
+	return family
+}
+
+// Serves the metrics in SelfMetrics in the Prometheus text format
+func SelfMetricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", TextFormatContentType)
+	if _, err := WriteTextFormat(w, SelfMetrics.Gather()); err != nil {
+		log.Println("Failed writing own metrics:", err)
+	}
+}
@@ -1,6 +1,10 @@
 package common
 
-import "os"
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
 
 // Works also for directories
 func FileExists(fileName string) bool {
@@ -9,3 +13,38 @@ func FileExists(fileName string) bool {
 	}
 	return true
 }
+
+// Writes data to a temporary file in the same directory and renames it to fileName, so that readers see either the
+// old or the new content but never a partially written file
+func WriteFileAtomic(fileName string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(fileName)
+	tmp, err := ioutil.TempFile(dir, "."+filepath.Base(fileName)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // No-op once renamed
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	err = os.Chmod(tmp.Name(), perm)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp.Name(), fileName)
+	if err != nil {
+		return err
+	}
+	// Persist the rename
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
@@ -78,7 +78,9 @@ func Bootstrap(rootCertFile, bootstrapDataFile string) error {
 	return err
 }
 
-func RequestAndObtainCert(caCertsDir, managerAddress, managerPort, certFile, csrFile string, typ, ip string) {
+// Requests a certificate for the csr until the Manager issues it. If set, the enrollment token is sent along, so that
+// the request is signed without manual approval.
+func RequestAndObtainCert(caCertsDir, managerAddress, managerPort, certFile, csrFile string, typ, ip, token string) {
 	// If not present request certificate from manager and try until provided
 	caCertPool, err := NewCertPoolFromDir(caCertsDir)
 	if err != nil {
@@ -106,15 +108,33 @@ func RequestAndObtainCert(caCertsDir, managerAddress, managerPort, certFile, csr
 	for !FileExists(certFile) {
 		url := "https://" + managerAddress + ":" + managerPort + "/certificate/request"
 		log.Printf("Requesting certificate (POST to %s)", url)
-		resp, err := client.Post(url, "application/base64", bytes.NewBuffer(data))
+		req, err := http.NewRequest("POST", url, bytes.NewBuffer(data))
+		if err != nil {
+			log.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/base64")
+		if token != "" {
+			req.Header.Set(types.EnrollmentTokenHeader, token)
+		}
+		resp, err := client.Do(req)
 		if err != nil {
 			log.Fatal(err)
 		}
 		if resp.StatusCode == http.StatusBadRequest {
-			log.Fatal("Error while requesting certificate:", 400)
+			message, _ := ioutil.ReadAll(resp.Body)
+			log.Fatal("Error while requesting certificate: ", string(message))
+		} else if resp.StatusCode == http.StatusForbidden {
+			message, _ := ioutil.ReadAll(resp.Body)
+			log.Fatal("Certificate request refused: ", string(message))
 		} else if resp.StatusCode == http.StatusUnauthorized {
 			log.Println("Not authorized to obtain a certificate")
 			time.Sleep(30 * time.Second)
+		} else if resp.StatusCode == http.StatusAccepted {
+			log.Println("Certificate request is waiting for approval by the manager's administrator")
+			time.Sleep(30 * time.Second)
+		} else if resp.StatusCode != http.StatusOK {
+			log.Println("Error while requesting certificate:", resp.StatusCode)
+			time.Sleep(30 * time.Second)
 		} else {
 			log.Println("Certificate received")
 			data, err := ioutil.ReadAll(resp.Body)
@@ -129,5 +149,6 @@ func RequestAndObtainCert(caCertsDir, managerAddress, managerPort, certFile, csr
 
 			ioutil.WriteFile(certFile, crt[:dec], 0644)
 		}
+		resp.Body.Close()
 	}
 }
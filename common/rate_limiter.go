@@ -0,0 +1,159 @@
+package common
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Token bucket of a source on a mapping. A token is added every period, up to the limiter's burst.
+type tokenBucket struct {
+	Tokens float64       `json:"tokens"`
+	Last   time.Time     `json:"last"`
+	Period time.Duration `json:"period"`
+}
+
+// Refills the bucket up to now
+func (b *tokenBucket) refill(now time.Time, period time.Duration, burst int) {
+	if period != b.Period {
+		// The frequency changed: start over with a full bucket
+		b.Tokens, b.Period = float64(burst), period
+	} else if elapsed := now.Sub(b.Last); elapsed > 0 {
+		b.Tokens = math.Min(float64(burst), b.Tokens+float64(elapsed)/float64(period))
+	}
+	b.Last = now
+}
+
+// RateLimiter limits how often each source scrapes each mapping with a token bucket per (source, mapping). Burst
+// scrapes can be done in a row; afterwards one is allowed per period. A scrape arriving up to Tolerance too early is
+// still allowed, the time is taken from the next period so that jitter doesn't accumulate.
+type RateLimiter struct {
+	file      string
+	burst     int
+	tolerance time.Duration
+	buckets   map[string]*tokenBucket
+	dirty     bool
+	mutex     sync.Mutex
+}
+
+// Creates a rate limiter whose state is persisted in file (if not empty) and loads the state stored there
+func NewRateLimiter(file string, burst int, tolerance time.Duration) (*RateLimiter, error) {
+	if burst < 1 {
+		return nil, errors.Errorf("burst must be at least 1, got %d", burst)
+	}
+	rl := &RateLimiter{file: file, burst: burst, tolerance: tolerance, buckets: make(map[string]*tokenBucket)}
+	if file != "" && FileExists(file) {
+		bts, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, errors.Wrap(err, "reading rate limiter state")
+		}
+		err = json.Unmarshal(bts, &rl.buckets)
+		if err != nil {
+			return nil, errors.Wrap(err, "decoding rate limiter state")
+		}
+	}
+	return rl, nil
+}
+
+func bucketKey(source, mapping string) string {
+	return source + " " + mapping
+}
+
+// Takes a token for a scrape of mapping by source, who is allowed one scrape per period. If there is none, returns
+// false and the time after which the scrape will be allowed.
+func (rl *RateLimiter) Take(source, mapping string, period time.Duration) (bool, time.Duration) {
+	if period <= 0 {
+		return true, 0
+	}
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+	now := time.Now()
+	key := bucketKey(source, mapping)
+	bucket, ok := rl.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{Tokens: float64(rl.burst), Last: now, Period: period}
+		rl.buckets[key] = bucket
+	}
+	bucket.refill(now, period, rl.burst)
+	rl.dirty = true
+	// Within the tolerance the token is borrowed from the next period
+	tolerance := float64(rl.tolerance) / float64(period)
+	if bucket.Tokens+tolerance >= 1 {
+		bucket.Tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - tolerance - bucket.Tokens) * float64(period))
+}
+
+// Returns how long source has to wait before a scrape of mapping is allowed, without taking a token
+func (rl *RateLimiter) Peek(source, mapping string, period time.Duration) time.Duration {
+	if period <= 0 {
+		return 0
+	}
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+	bucket, ok := rl.buckets[bucketKey(source, mapping)]
+	if !ok {
+		return 0
+	}
+	b := *bucket
+	b.refill(time.Now(), period, rl.burst)
+	tolerance := float64(rl.tolerance) / float64(period)
+	if b.Tokens+tolerance >= 1 {
+		return 0
+	}
+	return time.Duration((1 - tolerance - b.Tokens) * float64(period))
+}
+
+// Forgets the bucket of source on mapping, e.g. because its frequency permission was removed
+func (rl *RateLimiter) Reset(source, mapping string) {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+	delete(rl.buckets, bucketKey(source, mapping))
+	rl.dirty = true
+}
+
+// Writes the state to the file, dropping the buckets that are full again
+func (rl *RateLimiter) Save() error {
+	if rl.file == "" {
+		return nil
+	}
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+	if !rl.dirty {
+		return nil
+	}
+	now := time.Now()
+	for key, bucket := range rl.buckets {
+		bucket.refill(now, bucket.Period, rl.burst)
+		if bucket.Tokens >= float64(rl.burst) {
+			delete(rl.buckets, key)
+		}
+	}
+	bts, err := json.Marshal(rl.buckets)
+	if err != nil {
+		return err
+	}
+	err = WriteFileAtomic(rl.file, bts, 0600)
+	if err != nil {
+		return errors.Wrap(err, "writing rate limiter state")
+	}
+	rl.dirty = false
+	return nil
+}
+
+// Saves the state every interval, so that it survives restarts
+func (rl *RateLimiter) StartPersisting(interval time.Duration) {
+	go func() {
+		for range time.NewTicker(interval).C {
+			if err := rl.Save(); err != nil {
+				log.Println("RateLimiter: failed saving state:", err)
+			}
+		}
+	}()
+}
@@ -0,0 +1,159 @@
+package common
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterTake(t *testing.T) {
+	type step struct {
+		period  time.Duration
+		elapsed time.Duration // Moves the last refill of the bucket back before taking
+		allowed bool
+		wait    time.Duration // Expected wait if refused, within a second
+	}
+	tests := []struct {
+		name      string
+		burst     int
+		tolerance time.Duration
+		steps     []step
+	}{
+		{"no frequency", 1, 0, []step{
+			{period: 0, allowed: true},
+			{period: 0, allowed: true},
+		}},
+		{"one per period", 1, 0, []step{
+			{period: time.Hour, allowed: true},
+			{period: time.Hour, allowed: false, wait: time.Hour},
+			{period: time.Hour, elapsed: 30 * time.Minute, allowed: false, wait: 30 * time.Minute},
+			{period: time.Hour, elapsed: 30 * time.Minute, allowed: true},
+			{period: time.Hour, allowed: false, wait: time.Hour},
+		}},
+		{"burst", 3, 0, []step{
+			{period: time.Hour, allowed: true},
+			{period: time.Hour, allowed: true},
+			{period: time.Hour, allowed: true},
+			{period: time.Hour, allowed: false, wait: time.Hour},
+			// The bucket doesn't fill beyond the burst
+			{period: time.Hour, elapsed: 10 * time.Hour, allowed: true},
+			{period: time.Hour, allowed: true},
+			{period: time.Hour, allowed: true},
+			{period: time.Hour, allowed: false, wait: time.Hour},
+		}},
+		{"tolerance", 1, 10 * time.Minute, []step{
+			{period: time.Hour, allowed: true},
+			{period: time.Hour, allowed: false, wait: 50 * time.Minute},
+			// Early by 5 minutes, which are taken from the next period
+			{period: time.Hour, elapsed: 55 * time.Minute, allowed: true},
+			{period: time.Hour, elapsed: 50 * time.Minute, allowed: false, wait: 5 * time.Minute},
+			{period: time.Hour, elapsed: 10 * time.Minute, allowed: true},
+		}},
+		{"frequency changed", 1, 0, []step{
+			{period: time.Hour, allowed: true},
+			{period: time.Hour, allowed: false, wait: time.Hour},
+			{period: time.Minute, allowed: true},
+			{period: time.Minute, allowed: false, wait: time.Minute},
+		}},
+	}
+	for _, test := range tests {
+		rl, err := NewRateLimiter("", test.burst, test.tolerance)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, s := range test.steps {
+			if bucket, ok := rl.buckets[bucketKey("source", "/mapping")]; ok {
+				bucket.Last = bucket.Last.Add(-s.elapsed)
+			}
+			peek := rl.Peek("source", "/mapping", s.period)
+			allowed, wait := rl.Take("source", "/mapping", s.period)
+			if allowed != s.allowed {
+				t.Errorf("%s, step %d: expected allowed %v, got %v", test.name, i, s.allowed, allowed)
+				continue
+			}
+			if !allowed && (wait > s.wait || wait < s.wait-time.Second) {
+				t.Errorf("%s, step %d: expected to wait %s, got %s", test.name, i, s.wait, wait)
+			}
+			if !allowed && (peek > s.wait || peek < s.wait-time.Second) {
+				t.Errorf("%s, step %d: expected peek %s, got %s", test.name, i, s.wait, peek)
+			}
+			if allowed && peek != 0 {
+				t.Errorf("%s, step %d: expected peek 0, got %s", test.name, i, peek)
+			}
+		}
+	}
+}
+
+func TestRateLimiterKeys(t *testing.T) {
+	rl, err := NewRateLimiter("", 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if allowed, _ := rl.Take("17-ffaa:1:c5:10.0.0.1", "/br-1", time.Hour); !allowed {
+		t.Fatal("first scrape refused")
+	}
+	// Other sources and mappings have their own buckets
+	if allowed, _ := rl.Take("17-ffaa:1:c5:10.0.0.2", "/br-1", time.Hour); !allowed {
+		t.Error("scrape of another source refused")
+	}
+	if allowed, _ := rl.Take("17-ffaa:1:c5:10.0.0.1", "/br-2", time.Hour); !allowed {
+		t.Error("scrape of another mapping refused")
+	}
+	if allowed, _ := rl.Take("17-ffaa:1:c5:10.0.0.1", "/br-1", time.Hour); allowed {
+		t.Error("second scrape allowed")
+	}
+	rl.Reset("17-ffaa:1:c5:10.0.0.1", "/br-1")
+	if allowed, _ := rl.Take("17-ffaa:1:c5:10.0.0.1", "/br-1", time.Hour); !allowed {
+		t.Error("scrape refused after reset")
+	}
+}
+
+func TestRateLimiterPersistence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ratelimiter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "rate_limiter.json")
+
+	rl, err := NewRateLimiter(file, 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rl.Take("exhausted", "/br-1", time.Hour)
+	rl.Take("full", "/br-1", time.Millisecond)
+	time.Sleep(2 * time.Millisecond)
+	if err = rl.Save(); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := NewRateLimiter(file, 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := loaded.buckets[bucketKey("full", "/br-1")]; ok {
+		t.Error("full bucket was saved")
+	}
+	if allowed, _ := loaded.Take("exhausted", "/br-1", time.Hour); allowed {
+		t.Error("scrape allowed after restart")
+	}
+}
+
+func TestNewRateLimiterErrors(t *testing.T) {
+	if _, err := NewRateLimiter("", 0, 0); err == nil {
+		t.Error("expected an error for a burst of 0")
+	}
+	dir, err := ioutil.TempDir("", "ratelimiter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "rate_limiter.json")
+	if err = ioutil.WriteFile(file, []byte("not json"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = NewRateLimiter(file, 1, 0); err == nil {
+		t.Error("expected an error for a corrupted state file")
+	}
+}
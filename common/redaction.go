@@ -0,0 +1,419 @@
+package common
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/netsec-ethz/2SMS/common/types"
+	"github.com/pkg/errors"
+)
+
+// Redaction rule with its matchers compiled
+type redactionRule struct {
+	types.RedactionRule
+	matchers map[string]*regexp.Regexp
+}
+
+func compileRedactionRule(rule types.RedactionRule) (*redactionRule, error) {
+	switch rule.Action {
+	case types.RedactDropLabel, types.RedactHashLabel:
+		if rule.Label == "" {
+			return nil, errors.Errorf("action %s needs a label", rule.Action)
+		}
+	case types.RedactBucket:
+		if len(rule.Buckets) == 0 {
+			return nil, errors.New("action bucket needs buckets")
+		}
+		sort.Float64s(rule.Buckets)
+	case types.RedactDropSeries:
+	default:
+		return nil, errors.Errorf("unknown action %q", rule.Action)
+	}
+	compiled := &redactionRule{RedactionRule: rule, matchers: make(map[string]*regexp.Regexp)}
+	for label, expr := range rule.Matchers {
+		// Anchored like Prometheus label matchers
+		re, err := regexp.Compile("^(?:" + expr + ")$")
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid matcher for label %s", label)
+		}
+		compiled.matchers[label] = re
+	}
+	return compiled, nil
+}
+
+func (rule *redactionRule) appliesTo(mapping string, family *MetricFamily) bool {
+	return (rule.Mapping == "" || rule.Mapping == mapping) &&
+		(rule.Metric == "" || metricMatches(family.GetName(), []string{rule.Metric}))
+}
+
+func (rule *redactionRule) matches(metric *Metric) bool {
+	for label, re := range rule.matchers {
+		value := ""
+		for _, pair := range metric.Label {
+			if pair.GetName() == label {
+				value = pair.GetValue()
+			}
+		}
+		if !re.MatchString(value) {
+			return false
+		}
+	}
+	return true
+}
+
+// Redactor holds the redaction rules of the roles, persisted in a file, and the key used to hash label values
+type Redactor struct {
+	file  string
+	key   []byte
+	rules map[string][]*redactionRule // By role name
+	mutex sync.RWMutex
+}
+
+// Creates a redactor whose rules are persisted in file and which hashes label values with the key in keyFile. If
+// empty, the rules are kept in memory and a random key is used. A missing key file is created.
+func NewRedactor(file, keyFile string) (*Redactor, error) {
+	r := &Redactor{file: file, rules: make(map[string][]*redactionRule)}
+	if keyFile != "" && FileExists(keyFile) {
+		key, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "reading redaction key")
+		}
+		r.key = key
+	} else {
+		r.key = make([]byte, 32)
+		if _, err := rand.Read(r.key); err != nil {
+			return nil, err
+		}
+		if keyFile != "" {
+			if err := WriteFileAtomic(keyFile, r.key, 0600); err != nil {
+				return nil, errors.Wrap(err, "writing redaction key")
+			}
+		}
+	}
+	if file != "" && FileExists(file) {
+		bts, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, errors.Wrap(err, "reading redaction rules")
+		}
+		rules := make(map[string][]types.RedactionRule)
+		if err = json.Unmarshal(bts, &rules); err != nil {
+			return nil, errors.Wrap(err, "decoding redaction rules")
+		}
+		for role, roleRules := range rules {
+			for _, rule := range roleRules {
+				compiled, err := compileRedactionRule(rule)
+				if err != nil {
+					return nil, errors.Wrapf(err, "redaction rule of role %s", role)
+				}
+				r.rules[role] = append(r.rules[role], compiled)
+			}
+		}
+	}
+	return r, nil
+}
+
+// Returns the redaction rules of role
+func (r *Redactor) GetRules(role string) []types.RedactionRule {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	rules := []types.RedactionRule{}
+	for _, rule := range r.rules[role] {
+		rules = append(rules, rule.RedactionRule)
+	}
+	return rules
+}
+
+// Replaces the redaction rules of role, an empty list removes them
+func (r *Redactor) SetRules(role string, rules []types.RedactionRule) error {
+	compiled := []*redactionRule{}
+	for _, rule := range rules {
+		c, err := compileRedactionRule(rule)
+		if err != nil {
+			return err
+		}
+		compiled = append(compiled, c)
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	all := make(map[string][]*redactionRule)
+	for k, v := range r.rules {
+		all[k] = v
+	}
+	if len(compiled) == 0 {
+		delete(all, role)
+	} else {
+		all[role] = compiled
+	}
+	if r.file != "" {
+		plain := make(map[string][]types.RedactionRule)
+		for k, v := range all {
+			for _, rule := range v {
+				plain[k] = append(plain[k], rule.RedactionRule)
+			}
+		}
+		bts, err := json.Marshal(plain)
+		if err != nil {
+			return err
+		}
+		if err = WriteFileAtomic(r.file, bts, 0600); err != nil {
+			return errors.Wrap(err, "writing redaction rules")
+		}
+	}
+	r.rules = all
+	return nil
+}
+
+// Returns the metrics of mapping with the rules of all roles applied, once per role even if it is listed several times.
+// The given metrics are not modified.
+func (r *Redactor) Redact(roles []string, mapping string, metrics []*MetricFamily) []*MetricFamily {
+	r.mutex.RLock()
+	rules := []*redactionRule{}
+	seen := make(map[string]bool)
+	for _, role := range roles {
+		if !seen[role] {
+			seen[role] = true
+			rules = append(rules, r.rules[role]...)
+		}
+	}
+	r.mutex.RUnlock()
+	if len(rules) == 0 {
+		return metrics
+	}
+	redacted := make([]*MetricFamily, 0, len(metrics))
+	for _, family := range metrics {
+		familyRules := []*redactionRule{}
+		for _, rule := range rules {
+			if rule.appliesTo(mapping, family) {
+				familyRules = append(familyRules, rule)
+			}
+		}
+		if len(familyRules) == 0 {
+			redacted = append(redacted, family)
+			continue
+		}
+		newFamily := *family
+		newFamily.Metric = []*Metric{}
+		index := make(map[string]*Metric) // Series by labels, to merge the ones that became identical
+	series:
+		for _, metric := range family.Metric {
+			m := copyMetric(metric)
+			for _, rule := range familyRules {
+				if !rule.matches(m) {
+					continue
+				}
+				if rule.Action == types.RedactDropSeries {
+					continue series
+				}
+				r.apply(rule, m)
+			}
+			key := labelsKey(m.Label)
+			if existing, ok := index[key]; ok {
+				mergeMetric(existing, m)
+				continue
+			}
+			index[key] = m
+			newFamily.Metric = append(newFamily.Metric, m)
+		}
+		if len(newFamily.Metric) > 0 {
+			redacted = append(redacted, &newFamily)
+		}
+	}
+	return redacted
+}
+
+func (r *Redactor) apply(rule *redactionRule, m *Metric) {
+	switch rule.Action {
+	case types.RedactDropLabel:
+		labels := []*LabelPair{}
+		for _, pair := range m.Label {
+			if pair.GetName() != rule.Label {
+				labels = append(labels, pair)
+			}
+		}
+		m.Label = labels
+	case types.RedactHashLabel:
+		r.mapLabel(m, rule.Label, func(value string) string {
+			mac := hmac.New(sha256.New, r.key)
+			mac.Write([]byte(value))
+			return hex.EncodeToString(mac.Sum(nil))[:16]
+		})
+	case types.RedactBucket:
+		if rule.Label != "" {
+			r.mapLabel(m, rule.Label, func(value string) string {
+				v, err := strconv.ParseFloat(value, 64)
+				if err != nil {
+					return "redacted"
+				}
+				return strconv.FormatFloat(bucket(v, rule.Buckets), 'g', -1, 64)
+			})
+			return
+		}
+		bucketValue := func(v *float64) *float64 {
+			if v == nil {
+				return nil
+			}
+			b := bucket(*v, rule.Buckets)
+			return &b
+		}
+		if m.Gauge != nil {
+			g := *m.Gauge
+			g.Value = bucketValue(g.Value)
+			m.Gauge = &g
+		}
+		if m.Counter != nil {
+			c := *m.Counter
+			c.Value = bucketValue(c.Value)
+			m.Counter = &c
+		}
+		if m.Untyped != nil {
+			u := *m.Untyped
+			u.Value = bucketValue(u.Value)
+			m.Untyped = &u
+		}
+	}
+}
+
+func (r *Redactor) mapLabel(m *Metric, label string, f func(string) string) {
+	for i, pair := range m.Label {
+		if pair.GetName() == label {
+			value := f(pair.GetValue())
+			m.Label[i] = &LabelPair{Name: pair.Name, Value: &value}
+		}
+	}
+}
+
+// Rounds v down to the largest bucket boundary not above it, values below the first boundary are rounded up to it
+func bucket(v float64, buckets []float64) float64 {
+	b := buckets[0]
+	for _, boundary := range buckets {
+		if boundary <= v {
+			b = boundary
+		}
+	}
+	return b
+}
+
+// Copies the metric so that its labels and values can be changed without modifying the original
+func copyMetric(metric *Metric) *Metric {
+	m := *metric
+	m.Label = append([]*LabelPair{}, metric.Label...)
+	return &m
+}
+
+func labelsKey(labels []*LabelPair) string {
+	pairs := make([]string, len(labels))
+	for i, pair := range labels {
+		pairs[i] = pair.GetName() + "=" + pair.GetValue()
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "\xff")
+}
+
+// Adds the values of m to existing, whose labels became identical after redaction. Quantiles can't be merged and are
+// dropped.
+func mergeMetric(existing, m *Metric) {
+	add := func(a, b *float64) *float64 {
+		sum := a
+		if a != nil && b != nil {
+			s := *a + *b
+			sum = &s
+		}
+		return sum
+	}
+	addCount := func(a, b *uint64) *uint64 {
+		sum := a
+		if a != nil && b != nil {
+			s := *a + *b
+			sum = &s
+		}
+		return sum
+	}
+	if existing.Gauge != nil && m.Gauge != nil {
+		existing.Gauge = &Gauge{Value: add(existing.Gauge.Value, m.Gauge.Value)}
+	}
+	if existing.Counter != nil && m.Counter != nil {
+		existing.Counter = &Counter{Value: add(existing.Counter.Value, m.Counter.Value)}
+	}
+	if existing.Untyped != nil && m.Untyped != nil {
+		existing.Untyped = &Untyped{Value: add(existing.Untyped.Value, m.Untyped.Value)}
+	}
+	if existing.Summary != nil && m.Summary != nil {
+		existing.Summary = &Summary{
+			SampleCount: addCount(existing.Summary.SampleCount, m.Summary.SampleCount),
+			SampleSum:   add(existing.Summary.SampleSum, m.Summary.SampleSum),
+		}
+	}
+	if existing.Histogram != nil && m.Histogram != nil {
+		h := &Histogram{
+			SampleCount: addCount(existing.Histogram.SampleCount, m.Histogram.SampleCount),
+			SampleSum:   add(existing.Histogram.SampleSum, m.Histogram.SampleSum),
+		}
+		if len(existing.Histogram.Bucket) == len(m.Histogram.Bucket) {
+			for i, b := range existing.Histogram.Bucket {
+				other := m.Histogram.Bucket[i]
+				if b.GetUpperBound() != other.GetUpperBound() {
+					h.Bucket = nil
+					break
+				}
+				h.Bucket = append(h.Bucket, &Bucket{UpperBound: b.UpperBound, CumulativeCount: addCount(b.CumulativeCount, other.CumulativeCount)})
+			}
+		}
+		existing.Histogram = h
+	}
+}
+
+// Returns the names of the roles of source, including the ones bound to source patterns matching it
+func (ac *AccessController) sourceRoles(source string) []string {
+	roles := ac.rolesOf(source)
+	for _, pattern := range ac.matchingPatterns(source) {
+		for _, role := range ac.enforcer.GetRolesForUser(pattern) {
+			roles = append(roles, strings.TrimSuffix(role, "_role"))
+		}
+	}
+	return roles
+}
+
+// Applies the redaction rules of all roles of source to the metrics of the mapping at path
+func (ac *AccessController) RedactMetrics(source, path string, metrics []*MetricFamily) []*MetricFamily {
+	ac.mutex.RLock()
+	if !ac.active || ac.Redactor == nil {
+		ac.mutex.RUnlock()
+		return metrics
+	}
+	roles := ac.sourceRoles(source)
+	ac.mutex.RUnlock()
+	return ac.Redactor.Redact(roles, path, metrics)
+}
+
+// Applies the redaction rules of all roles of source and of the subjects of the capabilities in chain to the metrics
+// of the mapping at path: a capability grants access to the metrics, not to more of their values than these roles see.
+func (ac *AccessController) RedactMetricsByCapability(chain []types.Capability, source, path string, metrics []*MetricFamily) []*MetricFamily {
+	ac.mutex.RLock()
+	if !ac.active || ac.Redactor == nil {
+		ac.mutex.RUnlock()
+		return metrics
+	}
+	roles := ac.sourceRoles(source)
+	for _, capability := range chain {
+		switch {
+		case capability.Subject == "" || capability.Subject == source:
+		case IsSourcePattern(capability.Subject):
+			for _, role := range ac.enforcer.GetRolesForUser(capability.Subject) {
+				roles = append(roles, strings.TrimSuffix(role, "_role"))
+			}
+		default:
+			roles = append(roles, ac.sourceRoles(capability.Subject)...)
+		}
+	}
+	ac.mutex.RUnlock()
+	return ac.Redactor.Redact(roles, path, metrics)
+}
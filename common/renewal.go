@@ -0,0 +1,120 @@
+package common
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/scionproto/scion/go/lib/addr"
+)
+
+// Starts a background check, every interval, of the certificate in certFile. When it expires within renewBefore a new
+// key and CSR are generated and a new certificate is requested at renewURL, authenticating with the current one. The
+// new certificate is used by all servers and clients created with CreateHttpsServer and CreateHttpsClient without
+// restart. SCION servers and clients load the certificate files only when created: components using them pass a
+// non-nil onRenewal to reload them, which is called after each renewal. ia is requested for certificates without IA.
+func StartCertRenewal(caCertsDir, certFile, keyFile, csrFile, renewURL string, ia addr.IA, renewBefore, interval time.Duration, onRenewal func()) {
+	go func() {
+		for {
+			renewed, err := RenewCertIfNeeded(caCertsDir, certFile, keyFile, csrFile, renewURL, ia, renewBefore)
+			if err != nil {
+				log.Printf("CertRenewal: failed renewing %s: %v", certFile, err)
+			} else if renewed && onRenewal != nil {
+				onRenewal()
+			}
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// Renews the certificate in certFile if it expires within renewBefore and returns whether it did
+func RenewCertIfNeeded(caCertsDir, certFile, keyFile, csrFile, renewURL string, ia addr.IA, renewBefore time.Duration) (bool, error) {
+	cert, err := ReadCertFromPEMFile(certFile)
+	if err != nil || cert == nil {
+		return false, errors.Errorf("reading certificate: %v", err)
+	}
+	if time.Until(cert.NotAfter) > renewBefore {
+		return false, nil
+	}
+	log.Printf("CertRenewal: certificate %s expires at %s, renewing it", certFile, cert.NotAfter)
+	return true, RenewCert(caCertsDir, certFile, keyFile, csrFile, renewURL, ia, cert)
+}
+
+// Requests a new certificate with the same subject, IPs and IA as cert for a freshly generated key, then stores both and swaps
+// them in the running servers and clients. Certificates issued before the IA was bound into them get ia.
+func RenewCert(caCertsDir, certFile, keyFile, csrFile, renewURL string, ia addr.IA, cert *x509.Certificate) error {
+	privKey, err := GenECDSAKey("P256")
+	if err != nil {
+		return errors.Wrap(err, "generating key")
+	}
+	keyBytes, err := x509.MarshalECPrivateKey(privKey)
+	if err != nil {
+		return errors.Wrap(err, "encoding key")
+	}
+	uris := cert.URIs
+	if len(uris) == 0 {
+		uris = []*url.URL{IAURI(ia)}
+	}
+	csrBytes, err := GenCertSignRequest(cert.Subject, privKey, cert.DNSNames, cert.IPAddresses, uris)
+	if err != nil {
+		return errors.Wrap(err, "generating csr")
+	}
+	csrPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csrBytes})
+	// Authenticate with the current certificate, the one in use by the running servers and clients
+	client, err := NewHttpsClient(caCertsDir, certFile, keyFile)
+	if err != nil {
+		return errors.Wrap(err, "creating client")
+	}
+	data := make([]byte, base64.StdEncoding.EncodedLen(len(csrPEM)))
+	base64.StdEncoding.Encode(data, csrPEM)
+	resp, err := client.Post(renewURL, "application/base64", bytes.NewBuffer(data))
+	if err != nil {
+		return errors.Wrap(err, "sending renewal request")
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return errors.Wrap(err, "reading response")
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("renewal rejected with status code %d: %s", resp.StatusCode, body)
+	}
+	certPEM := make([]byte, base64.StdEncoding.DecodedLen(len(body)))
+	dec, err := base64.StdEncoding.Decode(certPEM, body)
+	if err != nil {
+		return errors.Wrap(err, "decoding certificate")
+	}
+	certPEM = certPEM[:dec]
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "ECDSA PRIVATE KEY", Bytes: keyBytes})
+	newCert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return errors.Wrap(err, "checking new key pair")
+	}
+	// The key is written first: if writing the certificate fails, the new one can still be downloaded from the Manager
+	err = WriteFileAtomic(keyFile, keyPEM, 0600)
+	if err != nil {
+		return errors.Wrap(err, "writing key")
+	}
+	err = WriteFileAtomic(certFile, certPEM, 0644)
+	if err != nil {
+		return errors.Wrap(err, "writing certificate")
+	}
+	if csrFile != "" {
+		err = WriteFileAtomic(csrFile, csrPEM, 0644)
+		if err != nil {
+			log.Printf("CertRenewal: failed writing csr %s: %v", csrFile, err)
+		}
+	}
+	SetKeyPair(certFile, newCert)
+	log.Printf("CertRenewal: renewed certificate %s", certFile)
+	return nil
+}
@@ -0,0 +1,195 @@
+package common
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Content type of the CRL served by the Manager
+const CRLContentType = "application/pkix-crl"
+
+// Generate a certificate revocation list for the given certificates, valid for `validity`
+func (ca *CA) GenCRL(revoked []pkix.RevokedCertificate, validity time.Duration) (crl []byte, err error) {
+	now := time.Now()
+	return ca.cert.CreateCRL(rand.Reader, ca.privKey, revoked, now, now.Add(validity))
+}
+
+// RevocationChecker holds the serials of the certificates revoked by the CA, taken from the last valid CRL
+type RevocationChecker struct {
+	caCerts    []*x509.Certificate
+	revoked    map[string]bool
+	nextUpdate time.Time
+	mutex      sync.RWMutex
+}
+
+// The checker used by all servers and clients created with CreateHttpsServer and CreateHttpsClient. If nil,
+// revocation is not checked.
+var revocationChecker *RevocationChecker
+var revocationMutex sync.RWMutex
+
+// Creates a checker that accepts CRLs signed by one of the certificates in caCertDir
+func NewRevocationChecker(caCertDir string) (*RevocationChecker, error) {
+	files, err := ioutil.ReadDir(caCertDir)
+	if err != nil {
+		return nil, err
+	}
+	rc := &RevocationChecker{revoked: make(map[string]bool)}
+	for _, file := range files {
+		if !strings.Contains(file.Name(), ".crt") {
+			continue
+		}
+		cert, err := ReadCertFromPEMFile(filepath.Join(caCertDir, file.Name()))
+		if err != nil || cert == nil {
+			log.Printf("RevocationChecker: skipping %s: %v", file.Name(), err)
+			continue
+		}
+		rc.caCerts = append(rc.caCerts, cert)
+	}
+	if len(rc.caCerts) == 0 {
+		return nil, errors.New("no CA certificate found in " + caCertDir)
+	}
+	return rc, nil
+}
+
+// Replaces the revoked serials with the ones in crl (DER or PEM encoded) after verifying its signature
+func (rc *RevocationChecker) Update(crl []byte) error {
+	if block, _ := pem.Decode(crl); block != nil {
+		crl = block.Bytes
+	}
+	list, err := x509.ParseDERCRL(crl)
+	if err != nil {
+		return errors.Wrap(err, "parsing CRL")
+	}
+	verified := false
+	for _, caCert := range rc.caCerts {
+		if caCert.CheckCRLSignature(list) == nil {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return errors.New("CRL is not signed by a trusted CA")
+	}
+	revoked := make(map[string]bool)
+	for _, entry := range list.TBSCertList.RevokedCertificates {
+		revoked[entry.SerialNumber.String()] = true
+	}
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+	rc.revoked = revoked
+	rc.nextUpdate = list.TBSCertList.NextUpdate
+	return nil
+}
+
+func (rc *RevocationChecker) IsRevoked(serial *big.Int) bool {
+	rc.mutex.RLock()
+	defer rc.mutex.RUnlock()
+	return rc.revoked[serial.String()]
+}
+
+// Downloads the CRL from url and updates the revoked serials
+func (rc *RevocationChecker) Fetch(client *http.Client, url string) error {
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	crl, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	return rc.Update(crl)
+}
+
+// Fetches the CRL from url every interval. If a fetch fails, the last valid CRL is kept.
+func (rc *RevocationChecker) Poll(client *http.Client, url string, interval time.Duration) {
+	go func() {
+		for range time.NewTicker(interval).C {
+			err := rc.Fetch(client, url)
+			if err != nil {
+				log.Printf("RevocationChecker: failed fetching CRL from %s: %v", url, err)
+			}
+			rc.mutex.RLock()
+			nextUpdate := rc.nextUpdate
+			rc.mutex.RUnlock()
+			if !nextUpdate.IsZero() && time.Now().After(nextUpdate) {
+				log.Printf("RevocationChecker: CRL expired at %s, still using it until a new one is fetched", nextUpdate)
+			}
+		}
+	}()
+}
+
+// Rejects peer certificates that are revoked. Meant to be used as tls.Config.VerifyPeerCertificate.
+func (rc *RevocationChecker) VerifyPeerCertificate(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	for _, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return err
+		}
+		if rc.IsRevoked(cert.SerialNumber) {
+			return fmt.Errorf("certificate %s (%v) is revoked", cert.SerialNumber, cert.Subject.OrganizationalUnit)
+		}
+	}
+	return nil
+}
+
+// Makes all servers and clients created with CreateHttpsServer and CreateHttpsClient reject revoked peers
+func EnableRevocationCheck(rc *RevocationChecker) {
+	revocationMutex.Lock()
+	defer revocationMutex.Unlock()
+	revocationChecker = rc
+}
+
+// Creates a checker for the CAs in caCertDir, enables it and keeps it up to date with the CRL at crlURL
+func StartRevocationCheck(caCertDir, crlURL string, interval time.Duration) error {
+	rc, err := NewRevocationChecker(caCertDir)
+	if err != nil {
+		return err
+	}
+	caCertPool, err := NewCertPoolFromDir(caCertDir)
+	if err != nil {
+		return err
+	}
+	// The CRL is served without client verification, so no client certificate is needed
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				RootCAs: caCertPool,
+			},
+		},
+	}
+	err = rc.Fetch(client, crlURL)
+	if err != nil {
+		log.Printf("RevocationChecker: initial CRL fetch from %s failed: %v", crlURL, err)
+	}
+	EnableRevocationCheck(rc)
+	rc.Poll(client, crlURL, interval)
+	return nil
+}
+
+func verifyNotRevoked(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	revocationMutex.RLock()
+	rc := revocationChecker
+	revocationMutex.RUnlock()
+	if rc == nil {
+		return nil
+	}
+	return rc.VerifyPeerCertificate(rawCerts, verifiedChains)
+}
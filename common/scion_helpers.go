@@ -1,14 +1,21 @@
 package common
 
 import (
+	"encoding/json"
+	"io/ioutil"
 	"log"
+	"path/filepath"
+	"strconv"
+	"strings"
 
 	"github.com/scionproto/scion/go/lib/snet"
 	"os"
 
 	"fmt"
 	"github.com/netsec-ethz/2SMS/common/types"
+	"github.com/pkg/errors"
 	"github.com/scionproto/scion/go/lib/addr"
+	"github.com/scionproto/scion/go/lib/topology"
 )
 
 func LoadConfig(ia addr.IA) (*types.State, error) {
@@ -26,39 +33,94 @@ func InitNetwork(local snet.Addr, sciond, dispatcher *string) {
 	log.Println("SCION network successfully initialized")
 }
 
-//func GetNeighboringASes(localIA addr.IA) []*addr.IA {
-//	c, err := LoadConfig(localIA)
-//	if err != nil {
-//		return []*addr.IA{}
-//	}
-//	neighMap := make(map[addr.IA]bool)
-//	for _, info := range c.Topo.BR {
-//		for _, id := range info.IFIDs {
-//			neighMap[c.Topo.IFInfoMap[id].ISD_AS] = true
-//		}
-//	}
-//	neighList := make([]*addr.IA, len(neighMap))
-//	i := 0
-//	for ia := range neighMap {
-//		neighList[i] = &ia
-//	}
-//	return neighList
-//}
+// Directory of the AS in the SCION gen folder, containing a directory for each service instance
+func ASServicesDir(genFolder string, ia addr.IA) string {
+	return filepath.Join(genFolder, "ISD"+fmt.Sprint(ia.I), "AS"+ia.A.FileFmt())
+}
+
+// Directory of the AS in the SCION gen folder, containing its topology.json and certs directory
+func ASGenDir(genFolder string, ia addr.IA) string {
+	return filepath.Join(ASServicesDir(genFolder, ia), "endhost")
+}
+
+// Returns the ASes connected to the local one by some interface of its border routers, as listed in topology.json
+func GetNeighboringASes(genFolder string, localIA addr.IA) ([]*addr.IA, error) {
+	topo, err := topology.LoadFromFile(filepath.Join(ASGenDir(genFolder, localIA), "topology.json"))
+	if err != nil {
+		return nil, errors.Wrap(err, "loading topology")
+	}
+	neighMap := make(map[addr.IA]bool)
+	for _, info := range topo.BR {
+		for _, id := range info.IFIDs {
+			neighMap[topo.IFInfoMap[id].ISD_AS] = true
+		}
+	}
+	neighList := []*addr.IA{}
+	for ia := range neighMap {
+		ia := ia
+		neighList = append(neighList, &ia)
+	}
+	return neighList, nil
+}
+
+// Returns the core ASes of the local ISD, as listed in the newest TRC in the certs directory of the AS
+func GetCoreASes(genFolder string, localIA addr.IA) ([]*addr.IA, error) {
+	trcFile, err := newestTRCFile(genFolder, localIA)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(trcFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading TRC")
+	}
+	// Only the core ASes are needed from the TRC
+	var trc struct {
+		CoreASes map[string]json.RawMessage
+	}
+	err = json.Unmarshal(data, &trc)
+	if err != nil {
+		return nil, errors.Wrap(err, "decoding TRC "+trcFile)
+	}
+	coreIAs := []*addr.IA{}
+	for coreIA := range trc.CoreASes {
+		ia, err := addr.IAFromString(coreIA)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid core AS in TRC "+trcFile)
+		}
+		coreIAs = append(coreIAs, &ia)
+	}
+	return coreIAs, nil
+}
 
-//func GetCoreASes(localIA addr.IA) []*addr.IA {
-//	c, err := LoadConfig(localIA)
-//	if err != nil {
-//		return []*addr.IA{}
-//	}
-//	maxTRC := c.Store.GetNewestTRC(localIA.I)
-//	coreIAs := make([]*addr.IA, len(maxTRC.CoreASes))
-//	i := 0
-//	for coreIA := range maxTRC.CoreASes {
-//		coreIAs[i] = &coreIA
-//		i++
-//	}
-//	return coreIAs
-//}
+// Returns the TRC file (ISD<isd>-V<version>.trc) of the local ISD with the highest version
+func newestTRCFile(genFolder string, localIA addr.IA) (string, error) {
+	certsDir := filepath.Join(ASGenDir(genFolder, localIA), "certs")
+	files, err := filepath.Glob(filepath.Join(certsDir, "ISD"+fmt.Sprint(localIA.I)+"-V*.trc"))
+	if err != nil {
+		return "", err
+	}
+	newest, newestVersion := "", -1
+	for _, file := range files {
+		name := strings.TrimSuffix(filepath.Base(file), ".trc")
+		version, err := strconv.Atoi(name[strings.LastIndex(name, "-V")+2:])
+		if err == nil && version > newestVersion {
+			newest, newestVersion = file, version
+		}
+	}
+	if newest == "" {
+		return "", errors.Errorf("no TRC for ISD %d in %s", localIA.I, certsDir)
+	}
+	return newest, nil
+}
+
+// Returns the topology and newest TRC files from which the core and neighboring ASes are read
+func ASFiles(genFolder string, localIA addr.IA) []string {
+	files := []string{filepath.Join(ASGenDir(genFolder, localIA), "topology.json")}
+	if trcFile, err := newestTRCFile(genFolder, localIA); err == nil {
+		files = append(files, trcFile)
+	}
+	return files
+}
 
 func DRKeyAuthenticate(*snet.Addr) error {
 	// TODO: Authenticate source with DRKeys
@@ -0,0 +1,128 @@
+package common
+
+import (
+	"io/ioutil"
+	"log"
+	"net"
+	"path/filepath"
+	"regexp"
+
+	"github.com/BurntSushi/toml"
+	"github.com/netsec-ethz/2SMS/common/types"
+	"github.com/pkg/errors"
+)
+
+var (
+	// Directories of SCION service instances, e.g. br17-ffaa_1_c5-1, capturing the kind of service and the instance
+	serviceDirRegexp = regexp.MustCompile(`^(br|bs|cs|ps)[0-9]+-.*-([0-9]+)$`)
+	// Mapping paths of discovered services, e.g. /br-1 or /sciond
+	serviceMappingRegexp = regexp.MustCompile(`^/((br|bs|cs|ps)-[0-9]+|sciond)$`)
+	// Address passed to a service with the -prom argument in its supervisord.conf
+	promArgRegexp = regexp.MustCompile(`-prom\b[^:]*:([0-9]+)`)
+)
+
+// Configuration file of a SCION service instance, from which the port of its metrics is read
+type serviceConfig struct {
+	path    string // Mapping path
+	service string
+	file    string
+	toml    bool // TOML service configuration, supervisord.conf otherwise
+}
+
+// Whether path is the mapping of a service found by DiscoverMappings
+func IsServiceMapping(path string) bool {
+	return serviceMappingRegexp.MatchString(path)
+}
+
+func serviceConfigs(servicesDir string) ([]serviceConfig, error) {
+	entries, err := ioutil.ReadDir(servicesDir)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading services directory")
+	}
+	configs := []serviceConfig{}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		dir := filepath.Join(servicesDir, entry.Name())
+		if entry.Name() == "endhost" {
+			configs = append(configs, serviceConfig{"/sciond", "sciond", filepath.Join(dir, "sciond.toml"), true})
+			continue
+		}
+		match := serviceDirRegexp.FindStringSubmatch(entry.Name())
+		if match == nil {
+			continue
+		}
+		path := "/" + match[1] + "-" + match[2]
+		switch match[1] {
+		case "cs", "ps":
+			configs = append(configs, serviceConfig{path, match[1], filepath.Join(dir, match[1]+"config.toml"), true})
+		case "br", "bs":
+			configs = append(configs, serviceConfig{path, match[1], filepath.Join(dir, "supervisord.conf"), false})
+		}
+	}
+	return configs, nil
+}
+
+// Returns the port where the service described by config exposes its metrics, or "" if it doesn't
+func (config serviceConfig) prometheusPort() (string, error) {
+	if !config.toml {
+		data, err := ioutil.ReadFile(config.file)
+		if err != nil {
+			return "", err
+		}
+		if match := promArgRegexp.FindSubmatch(data); match != nil {
+			return string(match[1]), nil
+		}
+		return "", nil
+	}
+	var tomlConfig struct {
+		Metrics struct {
+			Prometheus string
+		}
+	}
+	if _, err := toml.DecodeFile(config.file, &tomlConfig); err != nil {
+		return "", err
+	}
+	if tomlConfig.Metrics.Prometheus == "" {
+		return "", nil
+	}
+	_, port, err := net.SplitHostPort(tomlConfig.Metrics.Prometheus)
+	return port, err
+}
+
+// Returns the mappings of the SCION services (border routers, beacon, certificate and path servers and sciond) in
+// servicesDir that expose Prometheus metrics. The port is read from the -prom argument in the supervisord.conf of
+// border routers and beacon servers and from the Prometheus key in the TOML configuration of the other services.
+func DiscoverMappings(servicesDir string) ([]types.Mapping, error) {
+	configs, err := serviceConfigs(servicesDir)
+	if err != nil {
+		return nil, err
+	}
+	mappings := []types.Mapping{}
+	for _, config := range configs {
+		if !FileExists(config.file) {
+			continue
+		}
+		port, err := config.prometheusPort()
+		if err != nil {
+			log.Printf("Discovery: failed reading the metrics port of %s from %s: %v", config.path, config.file, err)
+			continue
+		}
+		if port != "" {
+			mappings = append(mappings, types.Mapping{Path: config.path, Port: port, Service: config.service})
+		}
+	}
+	return mappings, nil
+}
+
+// Returns the services directory and the configuration files read by DiscoverMappings, whose modification times tell
+// whether the services changed
+func ServiceConfigFiles(servicesDir string) []string {
+	files := []string{servicesDir}
+	configs, _ := serviceConfigs(servicesDir)
+	for _, config := range configs {
+		files = append(files, config.file)
+	}
+	return files
+}
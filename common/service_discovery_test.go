@@ -0,0 +1,93 @@
+package common
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/netsec-ethz/2SMS/common/types"
+)
+
+const servicesTestDir = "../deployment/create_endpoint_mappings_test"
+
+func TestDiscoverMappings(t *testing.T) {
+	data, err := ioutil.ReadFile(filepath.Join(servicesTestDir, "mappings.json.expected"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var expected []types.Mapping
+	if err = json.Unmarshal(data, &expected); err != nil {
+		t.Fatal(err)
+	}
+	// The node exporter isn't a SCION service, it's added by the deployment script
+	want := map[string]string{}
+	for _, mapping := range expected {
+		if mapping.Path != "/node" {
+			want[mapping.Path] = mapping.Port
+		}
+	}
+
+	mappings, err := DiscoverMappings(servicesTestDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]string{}
+	for _, mapping := range mappings {
+		if _, ok := got[mapping.Path]; ok {
+			t.Errorf("%s discovered twice", mapping.Path)
+		}
+		got[mapping.Path] = mapping.Port
+		if !IsServiceMapping(mapping.Path) {
+			t.Errorf("%s is not recognized as a service mapping", mapping.Path)
+		}
+	}
+	for path, port := range want {
+		if got[path] != port {
+			t.Errorf("%s: expected port %q, got %q", path, port, got[path])
+		}
+	}
+	for path, port := range got {
+		if _, ok := want[path]; !ok {
+			t.Errorf("unexpected mapping %s on port %s", path, port)
+		}
+	}
+}
+
+func TestServiceConfigFiles(t *testing.T) {
+	files := ServiceConfigFiles(servicesTestDir)
+	if len(files) == 0 || files[0] != servicesTestDir {
+		t.Fatalf("expected the services directory first, got %v", files)
+	}
+	// Every service directory is watched, also the ones whose configuration doesn't expose metrics
+	var got []string
+	for _, file := range files[1:] {
+		rel, err := filepath.Rel(servicesTestDir, file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, filepath.ToSlash(rel))
+	}
+	sort.Strings(got)
+	want := []string{
+		"br17-ffaa_1_c5-1/supervisord.conf",
+		"br17-ffaa_1_c5-2/supervisord.conf",
+		"br17-ffaa_1_c5-33/supervisord.conf",
+		"bs17-ffaa_1_c5-1/supervisord.conf",
+		"bs17-ffaa_1_c5-2/supervisord.conf",
+		"cs17-ffaa_1_c5-1/csconfig.toml",
+		"cs17-ffaa_1_c5-44/csconfig.toml",
+		"endhost/sciond.toml",
+		"ps17-ffaa_1_c5-1/psconfig.toml",
+		"ps17-ffaa_1_c5-2/psconfig.toml",
+	}
+	if len(got) != len(want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("expected %s, got %s", want[i], got[i])
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package common
+
+import (
+	"net"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/scionproto/scion/go/lib/addr"
+)
+
+// A source pattern matches sources (IA:IP) by ISD, AS and IP. Each part can be a wildcard, the IP can also be a
+// CIDR, e.g. "17-*:*" (every host in ISD 17), "17-ffaa:1:c5:*" (every host in the AS), "17-ffaa:1:c5:10.0.0.0/24" or
+// "17-ffaa:1:c5:fd00::/64". Patterns in the policy are compiled by the AccessController when it changes.
+type sourcePattern struct {
+	text string
+	isd  string
+	as   string
+	ip   string
+	net  *net.IPNet
+}
+
+// Whether the subject is a source pattern rather than a single source
+func IsSourcePattern(subject string) bool {
+	return strings.Contains(subject, "*") || strings.Contains(subject, "/")
+}
+
+func isDecimal(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// Whether ip is an IP, a CIDR or a wildcard
+func validSourceIP(ip string) bool {
+	if ip == "*" {
+		return true
+	}
+	if strings.Contains(ip, "/") {
+		_, _, err := net.ParseCIDR(ip)
+		return err == nil
+	}
+	return net.ParseIP(ip) != nil
+}
+
+// Splits a source or pattern in its ISD, AS and IP parts. The AS is either of the form a:b:c or decimal, the IP
+// (which may be IPv6 and contain colons as well) is the rest. A decimal AS is only tried if the source isn't valid
+// with an AS of the form a:b:c.
+func splitSource(source string) (isd, as, ip string, err error) {
+	dash := strings.Index(source, "-")
+	if dash < 1 {
+		return "", "", "", errors.Errorf("%q is not of the form ISD-AS:IP", source)
+	}
+	isd, rest := source[:dash], source[dash+1:]
+	parts := strings.SplitN(rest, ":", 4)
+	for _, asParts := range []int{3, 1} {
+		if len(parts) <= asParts || (asParts == 1 && parts[0] != "*" && !isDecimal(parts[0])) ||
+			(asParts == 3 && parts[0] == "*") {
+			continue
+		}
+		as = strings.Join(parts[:asParts], ":")
+		ip = rest[len(as)+1:]
+		// Wildcards are replaced by valid values to check the other part of the IA
+		checkISD, checkAS := isd, as
+		if checkISD == "*" {
+			checkISD = "1"
+		}
+		if checkAS == "*" {
+			checkAS = "0"
+		}
+		if _, err := addr.IAFromString(checkISD + "-" + checkAS); err == nil && validSourceIP(ip) {
+			return isd, as, ip, nil
+		}
+	}
+	return "", "", "", errors.Errorf("%q is not of the form ISD-AS:IP", source)
+}
+
+func parseSourcePattern(pattern string) (*sourcePattern, error) {
+	isd, as, ip, err := splitSource(pattern)
+	if err != nil {
+		return nil, err
+	}
+	p := &sourcePattern{text: pattern, isd: isd, as: as, ip: ip}
+	if strings.Contains(ip, "/") {
+		_, p.net, err = net.ParseCIDR(ip)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid CIDR in pattern")
+		}
+	}
+	return p, nil
+}
+
+func (p *sourcePattern) matches(source string) bool {
+	isd, as, ip, err := splitSource(source)
+	if err != nil {
+		return false
+	}
+	if (p.isd != "*" && p.isd != isd) || (p.as != "*" && p.as != as) {
+		return false
+	}
+	if p.net != nil {
+		parsed := net.ParseIP(ip)
+		return parsed != nil && p.net.Contains(parsed)
+	}
+	if p.ip == "*" {
+		return true
+	}
+	// Compared as IPs, so that different notations of the same IPv6 address match
+	parsed := net.ParseIP(ip)
+	return parsed != nil && parsed.Equal(net.ParseIP(p.ip))
+}
+
+// Checks that pattern is a valid source pattern
+func ValidateSourcePattern(pattern string) error {
+	if !IsSourcePattern(pattern) {
+		return errors.Errorf("%q contains no wildcard nor CIDR", pattern)
+	}
+	_, err := parseSourcePattern(pattern)
+	return err
+}
+
+// Whether source matches pattern. A subject that isn't a valid pattern matches nothing.
+func SourceMatches(pattern, source string) bool {
+	if !IsSourcePattern(pattern) {
+		return false
+	}
+	p, err := parseSourcePattern(pattern)
+	if err != nil {
+		return false
+	}
+	return p.matches(source)
+}
@@ -0,0 +1,75 @@
+package common
+
+import "testing"
+
+func TestSplitSource(t *testing.T) {
+	tests := []struct {
+		source    string
+		isd, as   string
+		ip        string
+		expectErr bool
+	}{
+		{source: "17-ffaa:1:c5:10.0.0.1", isd: "17", as: "ffaa:1:c5", ip: "10.0.0.1"},
+		{source: "1-64512:10.0.0.1", isd: "1", as: "64512", ip: "10.0.0.1"},
+		{source: "17-ffaa:1:c5:fd00::1", isd: "17", as: "ffaa:1:c5", ip: "fd00::1"},
+		{source: "17-ffaa:1:c5:::1", isd: "17", as: "ffaa:1:c5", ip: "::1"},
+		{source: "1-64512:fd00::1", isd: "1", as: "64512", ip: "fd00::1"},
+		{source: "17-ffaa:1:c5:fd00::/64", isd: "17", as: "ffaa:1:c5", ip: "fd00::/64"},
+		{source: "17-*:*", isd: "17", as: "*", ip: "*"},
+		{source: "*-ffaa:1:c5:*", isd: "*", as: "ffaa:1:c5", ip: "*"},
+		{source: "17-*:fd00::1", isd: "17", as: "*", ip: "fd00::1"},
+		{source: "17-ffaa:1:c5", expectErr: true},
+		{source: "ffaa:1:c5:10.0.0.1", expectErr: true},
+		{source: "17-ffaa:1:c5:not-an-ip", expectErr: true},
+		{source: "x-ffaa:1:c5:10.0.0.1", expectErr: true},
+		{source: "17-ffaa:1:10.0.0.1", expectErr: true},
+	}
+	for _, test := range tests {
+		isd, as, ip, err := splitSource(test.source)
+		if test.expectErr {
+			if err == nil {
+				t.Errorf("%q: expected an error, got %q %q %q", test.source, isd, as, ip)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", test.source, err)
+			continue
+		}
+		if isd != test.isd || as != test.as || ip != test.ip {
+			t.Errorf("%q: expected %q %q %q, got %q %q %q", test.source, test.isd, test.as, test.ip, isd, as, ip)
+		}
+	}
+}
+
+func TestSourceMatches(t *testing.T) {
+	tests := []struct {
+		pattern string
+		source  string
+		matches bool
+	}{
+		{"17-*:*", "17-ffaa:1:c5:10.0.0.1", true},
+		{"17-*:*", "18-ffaa:1:c5:10.0.0.1", false},
+		{"*-ffaa:1:c5:*", "18-ffaa:1:c5:fd00::1", true},
+		{"*-ffaa:1:c5:*", "18-ffaa:1:c6:fd00::1", false},
+		{"17-ffaa:1:c5:10.0.0.0/24", "17-ffaa:1:c5:10.0.0.42", true},
+		{"17-ffaa:1:c5:10.0.0.0/24", "17-ffaa:1:c5:10.0.1.42", false},
+		{"17-ffaa:1:c5:10.0.0.0/24", "17-ffaa:1:c6:10.0.0.42", false},
+		{"17-ffaa:1:c5:fd00::/64", "17-ffaa:1:c5:fd00::42", true},
+		{"17-ffaa:1:c5:fd00::/64", "17-ffaa:1:c5:fd01::42", false},
+		{"17-*:fd00:0::1", "17-ffaa:1:c5:fd00::1", true}, // Same address in another notation
+		{"1-64512:*", "1-64512:10.0.0.1", true},
+		{"1-64512:*", "1-64513:10.0.0.1", false},
+		// Not patterns, or invalid ones, match nothing
+		{"17-ffaa:1:c5:10.0.0.1", "17-ffaa:1:c5:10.0.0.1", false},
+		{"17-ffaa:1:c5:10.0.0.0/33", "17-ffaa:1:c5:10.0.0.1", false},
+		{"17-*", "17-ffaa:1:c5:10.0.0.1", false},
+		// Invalid sources match nothing either
+		{"17-*:*", "17-ffaa:1:c5", false},
+	}
+	for _, test := range tests {
+		if matches := SourceMatches(test.pattern, test.source); matches != test.matches {
+			t.Errorf("SourceMatches(%q, %q): expected %v, got %v", test.pattern, test.source, test.matches, matches)
+		}
+	}
+}
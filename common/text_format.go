@@ -0,0 +1,158 @@
+package common
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Content type of the Prometheus text exposition format produced by WriteTextFormat
+const TextFormatContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// Writes the given metric families to w using the Prometheus text exposition format (version 0.0.4).
+// Based on: prometheus/common/expfmt.MetricFamilyToText
+func WriteTextFormat(w io.Writer, metrics []*MetricFamily) (int, error) {
+	cw := &countingWriter{w: bufio.NewWriter(w)}
+	for _, fam := range metrics {
+		if err := writeFamilyText(cw, fam); err != nil {
+			return cw.n, err
+		}
+	}
+	return cw.n, cw.w.Flush()
+}
+
+type countingWriter struct {
+	w *bufio.Writer
+	n int
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += n
+	return n, err
+}
+
+func writeFamilyText(w io.Writer, fam *MetricFamily) error {
+	name := fam.GetName()
+	if name == "" {
+		return fmt.Errorf("metric family has no name: %s", fam)
+	}
+	if fam.Help != nil {
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n", name, escapeString(*fam.Help, false)); err != nil {
+			return err
+		}
+	}
+	if _, err := fmt.Fprintf(w, "# TYPE %s %s\n", name, strings.ToLower(fam.GetType().String())); err != nil {
+		return err
+	}
+	for _, m := range fam.Metric {
+		var err error
+		switch fam.GetType() {
+		case MetricType_COUNTER:
+			err = writeSample(w, name, "", m, "", 0, m.GetCounter().GetValue())
+		case MetricType_GAUGE:
+			err = writeSample(w, name, "", m, "", 0, m.GetGauge().GetValue())
+		case MetricType_UNTYPED:
+			err = writeSample(w, name, "", m, "", 0, m.GetUntyped().GetValue())
+		case MetricType_SUMMARY:
+			for _, q := range m.GetSummary().GetQuantile() {
+				if err = writeSample(w, name, "", m, "quantile", q.GetQuantile(), q.GetValue()); err != nil {
+					return err
+				}
+			}
+			if err = writeSample(w, name, "_sum", m, "", 0, m.GetSummary().GetSampleSum()); err != nil {
+				return err
+			}
+			err = writeSample(w, name, "_count", m, "", 0, float64(m.GetSummary().GetSampleCount()))
+		case MetricType_HISTOGRAM:
+			infSeen := false
+			for _, b := range m.GetHistogram().GetBucket() {
+				if err = writeSample(w, name, "_bucket", m, "le", b.GetUpperBound(), float64(b.GetCumulativeCount())); err != nil {
+					return err
+				}
+				if math.IsInf(b.GetUpperBound(), +1) {
+					infSeen = true
+				}
+			}
+			if !infSeen {
+				if err = writeSample(w, name, "_bucket", m, "le", math.Inf(+1), float64(m.GetHistogram().GetSampleCount())); err != nil {
+					return err
+				}
+			}
+			if err = writeSample(w, name, "_sum", m, "", 0, m.GetHistogram().GetSampleSum()); err != nil {
+				return err
+			}
+			err = writeSample(w, name, "_count", m, "", 0, float64(m.GetHistogram().GetSampleCount()))
+		default:
+			err = fmt.Errorf("unexpected type in metric %s: %s", name, fam.GetType())
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Writes a single sample line. If additionalLabel is not empty, it is appended to the metric's labels with
+// additionalValue formatted as a float.
+func writeSample(w io.Writer, name, suffix string, m *Metric, additionalLabel string, additionalValue float64, value float64) error {
+	var sb bytes.Buffer
+	sb.WriteString(name)
+	sb.WriteString(suffix)
+	labels := m.GetLabel()
+	if len(labels) > 0 || additionalLabel != "" {
+		sb.WriteByte('{')
+		sep := ""
+		for _, lp := range labels {
+			sb.WriteString(sep)
+			sb.WriteString(lp.GetName())
+			sb.WriteString(`="`)
+			sb.WriteString(escapeString(lp.GetValue(), true))
+			sb.WriteByte('"')
+			sep = ","
+		}
+		if additionalLabel != "" {
+			sb.WriteString(sep)
+			sb.WriteString(additionalLabel)
+			sb.WriteString(`="`)
+			sb.WriteString(formatFloat(additionalValue))
+			sb.WriteByte('"')
+		}
+		sb.WriteByte('}')
+	}
+	sb.WriteByte(' ')
+	sb.WriteString(formatFloat(value))
+	if m.TimestampMs != nil {
+		sb.WriteByte(' ')
+		sb.WriteString(strconv.FormatInt(*m.TimestampMs, 10))
+	}
+	sb.WriteByte('\n')
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, +1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	case math.IsNaN(f):
+		return "NaN"
+	default:
+		return strconv.FormatFloat(f, 'g', -1, 64)
+	}
+}
+
+// Escapes backslashes and new lines (and double quotes if includeQuotes is set)
+func escapeString(s string, includeQuotes bool) string {
+	r := strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	if includeQuotes {
+		r = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+	}
+	return r.Replace(s)
+}
@@ -0,0 +1,407 @@
+package common
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Parses the Prometheus text exposition format (version 0.0.4) into metric families.
+// Families without samples are dropped, the order of the remaining ones is the order of appearance.
+func ParseTextFormat(r io.Reader) ([]*MetricFamily, error) {
+	return newTextParser(false).parse(r)
+}
+
+// Parses the OpenMetrics text format into metric families. Counter and info families are named after their samples
+// (i.e. with the `_total` and `_info` suffixes) so that they get the same name as in the other exposition formats.
+func ParseOpenMetrics(r io.Reader) ([]*MetricFamily, error) {
+	return newTextParser(true).parse(r)
+}
+
+// State of a family declared through a HELP, TYPE or UNIT line or created by an untyped sample
+type parsedFamily struct {
+	fam     *MetricFamily
+	typ     string             // Type as written in the exposition (e.g. "gaugehistogram")
+	metrics map[string]*Metric // Metrics by label set (without quantile and le labels)
+}
+
+type textParser struct {
+	openMetrics bool
+	families    []*parsedFamily
+	byName      map[string]*parsedFamily // Families by declared name
+	lineNum     int
+}
+
+func newTextParser(openMetrics bool) *textParser {
+	return &textParser{
+		openMetrics: openMetrics,
+		byName:      make(map[string]*parsedFamily),
+	}
+}
+
+func (p *textParser) parse(r io.Reader) ([]*MetricFamily, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for scanner.Scan() {
+		p.lineNum++
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if p.openMetrics && line == "# EOF" {
+			break
+		}
+		var err error
+		if strings.HasPrefix(line, "#") {
+			err = p.parseComment(line)
+		} else if strings.TrimSpace(line) != "" {
+			err = p.parseSample(line)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("text format parsing error in line %d: %v", p.lineNum, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	metrics := []*MetricFamily{}
+	for _, pf := range p.families {
+		if len(pf.fam.Metric) > 0 {
+			metrics = append(metrics, pf.fam)
+		}
+	}
+	return metrics, nil
+}
+
+// Handles HELP, TYPE and UNIT lines, any other comment is ignored
+func (p *textParser) parseComment(line string) error {
+	fields := strings.SplitN(strings.TrimSpace(strings.TrimPrefix(line, "#")), " ", 3)
+	if len(fields) < 2 {
+		return nil
+	}
+	keyword, name := fields[0], fields[1]
+	rest := ""
+	if len(fields) == 3 {
+		rest = fields[2]
+	}
+	switch keyword {
+	case "HELP":
+		pf := p.declare(name)
+		help := unescapeString(rest, p.openMetrics)
+		pf.fam.Help = &help
+	case "TYPE":
+		typ := strings.TrimSpace(rest)
+		metricType, ok := p.metricType(typ)
+		if !ok {
+			return fmt.Errorf("unknown metric type %q for %s", typ, name)
+		}
+		pf := p.declare(name)
+		if len(pf.fam.Metric) > 0 {
+			return fmt.Errorf("TYPE line for %s after its samples", name)
+		}
+		pf.typ = typ
+		pf.fam.Type = &metricType
+		if p.openMetrics {
+			// Name the family like its samples
+			switch typ {
+			case "counter":
+				pf.fam.Name = stringPtr(strings.TrimSuffix(name, "_total") + "_total")
+			case "info":
+				pf.fam.Name = stringPtr(name + "_info")
+			}
+		}
+	case "UNIT":
+		// Units are not part of the MetricFamily model
+	}
+	return nil
+}
+
+func (p *textParser) metricType(typ string) (MetricType, bool) {
+	switch typ {
+	case "counter":
+		return MetricType_COUNTER, true
+	case "gauge":
+		return MetricType_GAUGE, true
+	case "summary":
+		return MetricType_SUMMARY, true
+	case "histogram":
+		return MetricType_HISTOGRAM, true
+	case "untyped":
+		return MetricType_UNTYPED, !p.openMetrics
+	case "unknown", "gaugehistogram", "stateset", "info":
+		if !p.openMetrics {
+			return MetricType_UNTYPED, false
+		}
+		switch typ {
+		case "gaugehistogram":
+			return MetricType_HISTOGRAM, true
+		case "stateset", "info":
+			return MetricType_GAUGE, true
+		}
+		return MetricType_UNTYPED, true
+	}
+	return MetricType_UNTYPED, false
+}
+
+// Returns the family declared with name, creating an untyped one if needed
+func (p *textParser) declare(name string) *parsedFamily {
+	if pf, ok := p.byName[name]; ok {
+		return pf
+	}
+	untyped := MetricType_UNTYPED
+	pf := &parsedFamily{
+		fam:     &MetricFamily{Name: stringPtr(name), Type: &untyped},
+		typ:     "untyped",
+		metrics: make(map[string]*Metric),
+	}
+	if p.openMetrics {
+		pf.typ = "unknown"
+	}
+	p.byName[name] = pf
+	p.families = append(p.families, pf)
+	return pf
+}
+
+// Suffixes that samples may have for each type (as written in the exposition)
+var sampleSuffixes = map[string][]string{
+	"counter":        {"_total", "_created"},
+	"summary":        {"_sum", "_count", "_created"},
+	"histogram":      {"_bucket", "_sum", "_count", "_created"},
+	"gaugehistogram": {"_bucket", "_gsum", "_gcount"},
+	"info":           {"_info"},
+}
+
+// Finds the family a sample belongs to and the suffix of the sample name
+func (p *textParser) familyFor(sampleName string) (*parsedFamily, string) {
+	if pf, ok := p.byName[sampleName]; ok {
+		// In OpenMetrics counters and infos have no samples without suffix
+		if !p.openMetrics || (pf.typ != "counter" && pf.typ != "info") {
+			return pf, ""
+		}
+	}
+	for typ, suffixes := range sampleSuffixes {
+		for _, suffix := range suffixes {
+			if !strings.HasSuffix(sampleName, suffix) {
+				continue
+			}
+			if pf, ok := p.byName[strings.TrimSuffix(sampleName, suffix)]; ok && pf.typ == typ {
+				return pf, suffix
+			}
+		}
+	}
+	return p.declare(sampleName), ""
+}
+
+func (p *textParser) parseSample(line string) error {
+	name, labels, rest, err := splitSample(line)
+	if err != nil {
+		return err
+	}
+	if p.openMetrics {
+		// Drop exemplars
+		if i := strings.Index(rest, " # "); i >= 0 {
+			rest = rest[:i]
+		}
+	}
+	fields := strings.Fields(rest)
+	if len(fields) == 0 || len(fields) > 2 {
+		return fmt.Errorf("expected value and optional timestamp for %s, got %q", name, rest)
+	}
+	value, err := parseFloat(fields[0])
+	if err != nil {
+		return fmt.Errorf("invalid value for %s: %v", name, err)
+	}
+	var timestampMs *int64
+	if len(fields) == 2 {
+		var ts int64
+		if p.openMetrics {
+			seconds, err := strconv.ParseFloat(fields[1], 64)
+			if err != nil {
+				return fmt.Errorf("invalid timestamp for %s: %v", name, err)
+			}
+			ts = int64(seconds * 1000)
+		} else {
+			ts, err = strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				return fmt.Errorf("invalid timestamp for %s: %v", name, err)
+			}
+		}
+		timestampMs = &ts
+	}
+
+	pf, suffix := p.familyFor(name)
+	if suffix == "_created" {
+		return nil
+	}
+	// Quantile and le labels identify the sample inside a metric, not the metric
+	var special *LabelPair
+	metricLabels := []*LabelPair{}
+	for _, lp := range labels {
+		if (pf.fam.GetType() == MetricType_SUMMARY && lp.GetName() == "quantile" && suffix == "") ||
+			(pf.fam.GetType() == MetricType_HISTOGRAM && lp.GetName() == "le" && suffix == "_bucket") {
+			special = lp
+			continue
+		}
+		metricLabels = append(metricLabels, lp)
+	}
+	m := pf.metric(metricLabels)
+	if timestampMs != nil {
+		m.TimestampMs = timestampMs
+	}
+
+	switch pf.fam.GetType() {
+	case MetricType_COUNTER:
+		m.Counter = &Counter{Value: &value}
+	case MetricType_GAUGE:
+		m.Gauge = &Gauge{Value: &value}
+	case MetricType_UNTYPED:
+		m.Untyped = &Untyped{Value: &value}
+	case MetricType_SUMMARY:
+		if m.Summary == nil {
+			m.Summary = &Summary{}
+		}
+		switch suffix {
+		case "":
+			if special == nil {
+				return fmt.Errorf("summary sample %s without quantile label", name)
+			}
+			q, err := parseFloat(special.GetValue())
+			if err != nil {
+				return fmt.Errorf("invalid quantile for %s: %v", name, err)
+			}
+			m.Summary.Quantile = append(m.Summary.Quantile, &Quantile{Quantile: &q, Value: &value})
+		case "_sum":
+			m.Summary.SampleSum = &value
+		case "_count":
+			count := uint64(value)
+			m.Summary.SampleCount = &count
+		}
+	case MetricType_HISTOGRAM:
+		if m.Histogram == nil {
+			m.Histogram = &Histogram{}
+		}
+		switch suffix {
+		case "_bucket":
+			if special == nil {
+				return fmt.Errorf("histogram bucket %s without le label", name)
+			}
+			upperBound, err := parseFloat(special.GetValue())
+			if err != nil {
+				return fmt.Errorf("invalid le for %s: %v", name, err)
+			}
+			count := uint64(value)
+			m.Histogram.Bucket = append(m.Histogram.Bucket, &Bucket{UpperBound: &upperBound, CumulativeCount: &count})
+		case "_sum", "_gsum":
+			m.Histogram.SampleSum = &value
+		case "_count", "_gcount":
+			count := uint64(value)
+			m.Histogram.SampleCount = &count
+		}
+	}
+	return nil
+}
+
+// Returns the metric of the family with the given labels, creating it if needed
+func (pf *parsedFamily) metric(labels []*LabelPair) *Metric {
+	sorted := make([]string, len(labels))
+	for i, lp := range labels {
+		sorted[i] = lp.GetName() + "=" + strconv.Quote(lp.GetValue())
+	}
+	sort.Strings(sorted)
+	key := strings.Join(sorted, ",")
+	if m, ok := pf.metrics[key]; ok {
+		return m
+	}
+	m := &Metric{Label: labels}
+	pf.metrics[key] = m
+	pf.fam.Metric = append(pf.fam.Metric, m)
+	return m
+}
+
+// Splits a sample line into metric name, labels and the remaining part (value, timestamp, ...)
+func splitSample(line string) (string, []*LabelPair, string, error) {
+	line = strings.TrimLeft(line, " \t")
+	end := strings.IndexAny(line, "{ \t")
+	if end < 0 {
+		return "", nil, "", fmt.Errorf("no value in sample %q", line)
+	}
+	name := line[:end]
+	if name == "" {
+		return "", nil, "", fmt.Errorf("no metric name in sample %q", line)
+	}
+	labels := []*LabelPair{}
+	rest := line[end:]
+	if rest[0] != '{' {
+		return name, labels, rest, nil
+	}
+	i := 1
+	for {
+		for i < len(rest) && (rest[i] == ' ' || rest[i] == '\t' || rest[i] == ',') {
+			i++
+		}
+		if i >= len(rest) {
+			return "", nil, "", fmt.Errorf("unterminated label set for %s", name)
+		}
+		if rest[i] == '}' {
+			return name, labels, rest[i+1:], nil
+		}
+		// Label name
+		eq := strings.IndexByte(rest[i:], '=')
+		if eq < 0 {
+			return "", nil, "", fmt.Errorf("invalid label set for %s", name)
+		}
+		labelName := strings.TrimSpace(rest[i : i+eq])
+		i += eq + 1
+		for i < len(rest) && (rest[i] == ' ' || rest[i] == '\t') {
+			i++
+		}
+		if i >= len(rest) || rest[i] != '"' {
+			return "", nil, "", fmt.Errorf("expected quoted value for label %s of %s", labelName, name)
+		}
+		i++
+		// Label value, up to the first non escaped double quote
+		var value []byte
+		for ; i < len(rest) && rest[i] != '"'; i++ {
+			if rest[i] == '\\' && i+1 < len(rest) {
+				i++
+				switch rest[i] {
+				case 'n':
+					value = append(value, '\n')
+				default:
+					value = append(value, rest[i])
+				}
+				continue
+			}
+			value = append(value, rest[i])
+		}
+		if i >= len(rest) {
+			return "", nil, "", fmt.Errorf("unterminated value for label %s of %s", labelName, name)
+		}
+		i++
+		labels = append(labels, &LabelPair{Name: stringPtr(labelName), Value: stringPtr(string(value))})
+	}
+}
+
+func parseFloat(s string) (float64, error) {
+	switch s {
+	case "+Inf", "Inf":
+		return math.Inf(+1), nil
+	case "-Inf":
+		return math.Inf(-1), nil
+	}
+	return strconv.ParseFloat(s, 64)
+}
+
+// Reverts escapeString. OpenMetrics also escapes double quotes in HELP.
+func unescapeString(s string, includeQuotes bool) string {
+	r := strings.NewReplacer(`\\`, `\`, `\n`, "\n")
+	if includeQuotes {
+		r = strings.NewReplacer(`\\`, `\`, `\n`, "\n", `\"`, `"`)
+	}
+	return r.Replace(s)
+}
+
+func stringPtr(s string) *string {
+	return &s
+}
@@ -0,0 +1,192 @@
+package common
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestParseTextFormatEscaping(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		help  string
+		label string // Value of the label l of the only sample
+	}{
+		{"plain", "# HELP m Some help\nm{l=\"value\"} 1\n", "Some help", "value"},
+		{"backslash", "# HELP m a\\\\b\nm{l=\"a\\\\b\"} 1\n", `a\b`, `a\b`},
+		{"new line", "# HELP m a\\nb\nm{l=\"a\\nb\"} 1\n", "a\nb", "a\nb"},
+		// Double quotes are only escaped in label values in this format
+		{"double quote", "# HELP m a\\\"b\nm{l=\"a\\\"b\"} 1\n", `a\"b`, `a"b`},
+		{"escaped backslash before n", "# HELP m a\\\\nb\nm{l=\"a\\\\nb\"} 1\n", `a\nb`, `a\nb`},
+		{"separators in value", "# HELP m h\nm{l=\"x}y, z=\\\"w\\\" # 2\"} 1\n", "h", `x}y, z="w" # 2`},
+		{"empty value", "# HELP m h\nm{l=\"\"} 1\n", "h", ""},
+	}
+	for _, test := range tests {
+		families, err := ParseTextFormat(strings.NewReader(test.input))
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		if len(families) != 1 || len(families[0].Metric) != 1 {
+			t.Errorf("%s: expected one family with one metric, got %v", test.name, families)
+			continue
+		}
+		if help := families[0].GetHelp(); help != test.help {
+			t.Errorf("%s: expected help %q, got %q", test.name, test.help, help)
+		}
+		labels := families[0].Metric[0].Label
+		if len(labels) != 1 || labels[0].GetName() != "l" || labels[0].GetValue() != test.label {
+			t.Errorf("%s: expected label l=%q, got %v", test.name, test.label, labels)
+		}
+	}
+}
+
+func TestParseOpenMetricsEscaping(t *testing.T) {
+	input := "# HELP m a\\\"b\\\\c\n# TYPE m gauge\nm{l=\"a\\\"b\"} 1\n# EOF\n"
+	families, err := ParseOpenMetrics(strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(families) != 1 || len(families[0].Metric) != 1 {
+		t.Fatalf("expected one family with one metric, got %v", families)
+	}
+	if help := families[0].GetHelp(); help != `a"b\c` {
+		t.Errorf("expected help %q, got %q", `a"b\c`, help)
+	}
+	if value := families[0].Metric[0].Label[0].GetValue(); value != `a"b` {
+		t.Errorf("expected label value %q, got %q", `a"b`, value)
+	}
+}
+
+func TestParseTextFormatRoundTrip(t *testing.T) {
+	input := "# HELP m Help with \\\\ and \\n\n# TYPE m gauge\nm{l=\"a\\\"b\\\\c\\nd\"} 1.5\n"
+	families, err := ParseTextFormat(strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out strings.Builder
+	if _, err = WriteTextFormat(&out, families); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != input {
+		t.Errorf("expected %q, got %q", input, out.String())
+	}
+}
+
+func TestParseOpenMetricsExemplars(t *testing.T) {
+	tests := []struct {
+		name      string
+		input     string
+		family    string
+		value     float64
+		timestamp int64 // Milliseconds, 0 if none
+	}{
+		{
+			name:   "counter",
+			input:  "# TYPE c counter\nc_total 3 # {trace_id=\"abc\"} 1\n# EOF\n",
+			family: "c_total",
+			value:  3,
+		},
+		{
+			name:      "counter with timestamps",
+			input:     "# TYPE c counter\nc_total 3 1520879607.5 # {trace_id=\"abc\"} 1 1520879607.25\n# EOF\n",
+			family:    "c_total",
+			value:     3,
+			timestamp: 1520879607500,
+		},
+		{
+			name:   "labels",
+			input:  "# TYPE c counter\nc_total{path=\"/a # b\"} 7 # {trace_id=\"x # y\"} 1\n# EOF\n",
+			family: "c_total",
+			value:  7,
+		},
+		{
+			name:   "gauge",
+			input:  "# TYPE g gauge\ng -2.5 # {} 1\n# EOF\n",
+			family: "g",
+			value:  -2.5,
+		},
+	}
+	for _, test := range tests {
+		families, err := ParseOpenMetrics(strings.NewReader(test.input))
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		if len(families) != 1 || families[0].GetName() != test.family || len(families[0].Metric) != 1 {
+			t.Errorf("%s: expected one family %s with one metric, got %v", test.name, test.family, families)
+			continue
+		}
+		m := families[0].Metric[0]
+		value := m.GetGauge().GetValue() + m.GetCounter().GetValue()
+		if value != test.value {
+			t.Errorf("%s: expected value %v, got %v", test.name, test.value, value)
+		}
+		if m.GetTimestampMs() != test.timestamp {
+			t.Errorf("%s: expected timestamp %d, got %d", test.name, test.timestamp, m.GetTimestampMs())
+		}
+	}
+}
+
+func TestParseOpenMetricsHistogramExemplars(t *testing.T) {
+	input := `# TYPE h histogram
+h_bucket{le="0.1"} 1 # {trace_id="a"} 0.05
+h_bucket{le="1"} 3 # {trace_id="b"} 0.5 1520879607.5
+h_bucket{le="+Inf"} 4
+h_sum 2.5
+h_count 4
+# EOF
+`
+	families, err := ParseOpenMetrics(strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(families) != 1 || len(families[0].Metric) != 1 {
+		t.Fatalf("expected one family with one metric, got %v", families)
+	}
+	histogram := families[0].Metric[0].GetHistogram()
+	if histogram.GetSampleCount() != 4 || histogram.GetSampleSum() != 2.5 {
+		t.Errorf("expected count 4 and sum 2.5, got %d and %v", histogram.GetSampleCount(), histogram.GetSampleSum())
+	}
+	bounds := []float64{0.1, 1, math.Inf(+1)}
+	counts := []uint64{1, 3, 4}
+	if len(histogram.Bucket) != len(bounds) {
+		t.Fatalf("expected %d buckets, got %d", len(bounds), len(histogram.Bucket))
+	}
+	for i, bucket := range histogram.Bucket {
+		if bucket.GetUpperBound() != bounds[i] || bucket.GetCumulativeCount() != counts[i] {
+			t.Errorf("bucket %d: expected le=%v %d, got le=%v %d", i, bounds[i], counts[i], bucket.GetUpperBound(),
+				bucket.GetCumulativeCount())
+		}
+	}
+}
+
+func TestParseTextFormatErrors(t *testing.T) {
+	tests := []struct {
+		name        string
+		input       string
+		openMetrics bool
+	}{
+		{"exemplar in text format", "m 1 # {trace_id=\"abc\"} 1\n", false},
+		{"unterminated label set", "m{l=\"a\" 1\n", false},
+		{"unterminated label value", "m{l=\"a} 1\n", false},
+		{"unquoted label value", "m{l=a} 1\n", false},
+		{"invalid value", "m abc\n", false},
+		{"no value", "m\n", false},
+		{"unknown type", "# TYPE m foo\nm 1\n", false},
+		{"openmetrics type in text format", "# TYPE m info\nm 1\n", false},
+		{"type after samples", "m 1\n# TYPE m gauge\n", false},
+		{"summary without quantile", "# TYPE s summary\ns 1\n", false},
+		{"invalid exemplar position", "# TYPE c counter\nc_total 3 1 2 # {} 1\n# EOF\n", true},
+	}
+	for _, test := range tests {
+		parse := ParseTextFormat
+		if test.openMetrics {
+			parse = ParseOpenMetrics
+		}
+		if families, err := parse(strings.NewReader(test.input)); err == nil {
+			t.Errorf("%s: expected an error, got %v", test.name, families)
+		}
+	}
+}
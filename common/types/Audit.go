@@ -0,0 +1,49 @@
+package types
+
+import "time"
+
+// Decisions recorded in the audit log of the Endpoint
+const (
+	AuditAllowed = "allowed"
+	AuditRefused = "refused"
+	AuditFailed  = "failed" // Allowed, but the metrics couldn't be fetched from the upstream or sent to the source
+)
+
+// AuditRecord describes a scrape attempt handled by the Endpoint
+type AuditRecord struct {
+	Time       time.Time `json:"time"`
+	Source     string    `json:"source"`               // IA:IP, empty if it couldn't be identified
+	RemoteAddr string    `json:"remote_addr"`          // Address the request came from
+	Transport  string    `json:"transport"`            // HTTPS or SCION HTTPS
+	Mapping    string    `json:"mapping"`              // Requested path
+	Decision   string    `json:"decision"`             // allowed, refused or failed
+	Reason     string    `json:"reason,omitempty"`     // Why the scrape was refused or failed
+	Capability string    `json:"capability,omitempty"` // ID of the capability token presented, if any
+	Families   int       `json:"families"`             // Metric families returned after filtering
+	Total      int       `json:"total"`                // Metric families fetched from the upstream
+	Bytes      int       `json:"bytes"`                // Size of the response body
+}
+
+// AuditFilter selects audit records. Empty fields match any record.
+type AuditFilter struct {
+	Source  string
+	Mapping string
+	From    time.Time // Inclusive
+	To      time.Time // Exclusive
+}
+
+func (f *AuditFilter) Matches(record *AuditRecord) bool {
+	if f.Source != "" && record.Source != f.Source {
+		return false
+	}
+	if f.Mapping != "" && record.Mapping != f.Mapping {
+		return false
+	}
+	if !f.From.IsZero() && record.Time.Before(f.From) {
+		return false
+	}
+	if !f.To.IsZero() && !record.Time.Before(f.To) {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,33 @@
+package types
+
+import "time"
+
+// Header in which scrapers present their capability token
+const CapabilityHeader = "X-Capability-Token"
+
+// Capability grants its subject the right to scrape mappings of an Endpoint without any entry in the Endpoint's
+// policy. It is signed by the Endpoint or the Manager's CA, or derived from another capability by its holder.
+type Capability struct {
+	ID       string              `json:"id"`
+	Endpoint string              `json:"endpoint"`          // IP of the Endpoint it is valid on
+	Subject  string              `json:"subject,omitempty"` // Source (IA:IP) or source pattern allowed to use it, anyone if empty
+	Mappings map[string][]string `json:"mappings"`          // Metric name filters by mapping, "*" at the end matches any suffix, an empty list all metrics
+	// Minimum time between scrapes of each mapping, shared by all capabilities derived from this one
+	Frequency string    `json:"frequency,omitempty"`
+	NotBefore time.Time `json:"not_before,omitempty"`
+	Expires   time.Time `json:"expires"`
+	HolderKey []byte    `json:"holder_key,omitempty"` // DER encoded public key allowed to derive narrower capabilities
+}
+
+// CapabilityRevocation revokes the capability with the given ID and all capabilities derived from it. Expires is
+// the expiration of the capability, after which the revocation can be forgotten.
+type CapabilityRevocation struct {
+	ID      string    `json:"id"`
+	Expires time.Time `json:"expires"`
+}
+
+// CapabilityResponse is returned when a capability is minted
+type CapabilityResponse struct {
+	Capability Capability `json:"capability"`
+	Token      string     `json:"token"`
+}
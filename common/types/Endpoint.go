@@ -6,6 +6,8 @@ type Endpoint struct {
 	ScrapePort string   `json:"scrape_port"`
 	ManagePort string   `json:"manage_port"`
 	Paths      []string `json:"paths"`
+	// Labels added to the scrape targets of the paths, by path
+	Labels map[string]map[string]string `json:"labels,omitempty"`
 }
 
 func (end *Endpoint) Equal(end_b *Endpoint) bool {
@@ -0,0 +1,41 @@
+package types
+
+import "time"
+
+// Header in which components send their enrollment token with a certificate request
+const EnrollmentTokenHeader = "X-Enrollment-Token"
+
+// EnrollmentToken allows a single certificate request for the given component type and IP (and IA, if set) to be
+// signed without manual approval
+type EnrollmentToken struct {
+	Token   string    `json:"token"`
+	Type    string    `json:"type"`
+	IP      string    `json:"ip"`
+	IA      string    `json:"ia,omitempty"`
+	Expires time.Time `json:"expires"`
+}
+
+// EnrollmentTokenRequest is sent to the Manager to create a new enrollment token. TTL is a duration string
+// (e.g. "24h"), if empty the Manager's default is used.
+type EnrollmentTokenRequest struct {
+	Type string `json:"type"`
+	IP   string `json:"ip"`
+	IA   string `json:"ia"`
+	TTL  string `json:"ttl"`
+}
+
+// PendingCertRequest is a certificate request waiting for the approval of the administrator
+type PendingCertRequest struct {
+	Type       string    `json:"type"`
+	IP         string    `json:"ip"`
+	IA         string    `json:"ia"`
+	DNSNames   []string  `json:"dns_names"`
+	RemoteAddr string    `json:"remote_addr"`
+	Received   time.Time `json:"received"`
+}
+
+// CertRequestDecision identifies the pending certificate request to approve or reject
+type CertRequestDecision struct {
+	Type string `json:"type"`
+	IP   string `json:"ip"`
+}
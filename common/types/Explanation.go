@@ -0,0 +1,33 @@
+package types
+
+// Explanation of the decision on a scrape of a mapping by a source, as evaluated by the Endpoint's access controller
+type Explanation struct {
+	Source     string   `json:"source"`
+	Mapping    string   `json:"mapping"`
+	Active     bool     `json:"access_control_active"`
+	Decision   string   `json:"decision"`         // "allow" or "deny"
+	Reason     string   `json:"reason,omitempty"` // Why the scrape is denied, e.g. not_authorized
+	Message    string   `json:"message,omitempty"`
+	Patterns   []string `json:"patterns"` // Patterns in the policy matching the source
+	Grants     []Grant  `json:"grants"`   // How the source gets the scrape permission
+	Window     string   `json:"window,omitempty"`
+	NextOpen   string   `json:"next_open,omitempty"`
+	NextClose  string   `json:"next_close,omitempty"`
+	Frequency  string   `json:"frequency,omitempty"`
+	RetryAfter string   `json:"retry_after,omitempty"` // Until the next scrape allowed by the frequency
+	Metric     *Grants  `json:"metric,omitempty"`      // For the requested metric, if any
+	Metrics    []string `json:"metrics,omitempty"`     // Metric families exposed to the source
+	Error      string   `json:"error,omitempty"`       // Why the metrics couldn't be listed
+}
+
+// Chain of subjects, from the source through matching patterns and roles, to the one holding a permission
+type Grant struct {
+	Chain []string `json:"chain"`
+}
+
+// Decision on a single permission and how it is granted
+type Grants struct {
+	Name    string  `json:"name"`
+	Allowed bool    `json:"allowed"`
+	Grants  []Grant `json:"grants"`
+}
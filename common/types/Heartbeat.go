@@ -0,0 +1,24 @@
+package types
+
+import "time"
+
+// Liveness states of a registered component as seen by the Manager
+const (
+	LivenessHealthy = "healthy" // Heartbeat received recently
+	LivenessStale   = "stale"   // Some heartbeats were missed
+	LivenessDead    = "dead"    // No heartbeat within the grace period, the component is not used anymore
+)
+
+// Heartbeat is periodically sent by every component to the Manager
+type Heartbeat struct {
+	IA         string `json:"ia"`
+	IP         string `json:"ip"`
+	ManagePort string `json:"manage_port"`
+	Version    string `json:"version,omitempty"`
+}
+
+type Liveness struct {
+	Status   string    `json:"status"`
+	LastSeen time.Time `json:"last_seen"`
+	Version  string    `json:"version,omitempty"`
+}
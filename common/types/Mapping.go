@@ -1,12 +1,117 @@
 package types
 
+import (
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Label names set by the manager on every scrape target, which can't be overridden by the labels of a mapping
+var ReservedTargetLabels = []string{"AS", "ISD", "service", "service_type"}
+
+var labelNameRegexp = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// Mapping of a path exposed by the endpoint to an upstream exporter. Only Path and Port are required, the other fields
+// describe how to fetch the metrics and which labels are added to the scrape target.
 type Mapping struct {
-	Path string
-	Port string
+	Path        string
+	Port        string
+	Host        string            `json:",omitempty"` // Upstream host, the endpoint's local target if empty
+	MetricsPath string            `json:",omitempty"` // Path of the metrics at the upstream, /metrics if empty
+	Scheme      string            `json:",omitempty"` // http (default) or https
+	TLS         *MappingTLS       `json:",omitempty"`
+	BasicAuth   *BasicAuth        `json:",omitempty"`
+	Timeout     string            `json:",omitempty"` // Timeout of requests to the upstream, e.g. 5s
+	Service     string            `json:",omitempty"` // Type of service, e.g. br, added as service_type label
+	Labels      map[string]string `json:",omitempty"` // Added to the labels of the scrape target
+}
+
+// TLS settings to connect to an https upstream
+type MappingTLS struct {
+	CAFile             string `json:",omitempty"` // CA certificates to verify the upstream, the system ones if empty
+	CertFile           string `json:",omitempty"` // Client certificate
+	KeyFile            string `json:",omitempty"`
+	ServerName         string `json:",omitempty"`
+	InsecureSkipVerify bool   `json:",omitempty"`
+}
+
+// Basic authentication credentials for the upstream. The password is read from PasswordFile if given.
+type BasicAuth struct {
+	Username     string
+	Password     string `json:",omitempty"`
+	PasswordFile string `json:",omitempty"`
 }
 
-type EndpointMappings map[string]string
+// Mappings by path
+type EndpointMappings map[string]Mapping
 
 func (mp *Mapping) Equal(mp_b *Mapping) bool {
 	return mp.Path == mp_b.Path && mp.Port == mp_b.Port
 }
+
+func (mp *Mapping) Validate() error {
+	if !strings.HasPrefix(mp.Path, "/") || len(mp.Path) < 2 {
+		return fmt.Errorf("invalid path %q", mp.Path)
+	}
+	if mp.Port == "" {
+		return errors.New("missing port")
+	}
+	if mp.Scheme != "" && mp.Scheme != "http" && mp.Scheme != "https" {
+		return fmt.Errorf("invalid scheme %q", mp.Scheme)
+	}
+	if mp.TLS != nil && (mp.TLS.CertFile == "") != (mp.TLS.KeyFile == "") {
+		return errors.New("client certificate and key must be given together")
+	}
+	if mp.BasicAuth != nil && mp.BasicAuth.Username == "" {
+		return errors.New("missing basic auth username")
+	}
+	if mp.Timeout != "" {
+		if _, err := time.ParseDuration(mp.Timeout); err != nil {
+			return fmt.Errorf("invalid timeout: %v", err)
+		}
+	}
+	for name := range mp.Labels {
+		if !labelNameRegexp.MatchString(name) || strings.HasPrefix(name, "__") {
+			return fmt.Errorf("invalid label name %q", name)
+		}
+		for _, reserved := range ReservedTargetLabels {
+			if name == reserved {
+				return fmt.Errorf("label %s is reserved", name)
+			}
+		}
+	}
+	return nil
+}
+
+// Returns the URL of the metrics at the upstream, using defaultHost if the mapping has no host
+func (mp *Mapping) URL(defaultHost string) string {
+	scheme, host, path := "http", defaultHost, "/metrics"
+	if mp.Scheme != "" {
+		scheme = mp.Scheme
+	}
+	if mp.Host != "" {
+		host = mp.Host
+	}
+	if mp.MetricsPath != "" {
+		path = mp.MetricsPath
+		if !strings.HasPrefix(path, "/") {
+			path = "/" + path
+		}
+	}
+	return scheme + "://" + net.JoinHostPort(host, mp.Port) + path
+}
+
+// Returns the labels added to the scrape target of the mapping
+func (mp *Mapping) TargetLabels() map[string]string {
+	labels := make(map[string]string)
+	for name, value := range mp.Labels {
+		labels[name] = value
+	}
+	if mp.Service != "" {
+		labels["service_type"] = mp.Service
+	}
+	return labels
+}
@@ -0,0 +1,7 @@
+package types
+
+// Binding of a role to all sources matching a pattern, e.g. "17-*:*" or "17-ffaa:1:c5:10.0.0.0/24"
+type PatternBinding struct {
+	Pattern string `json:"pattern"`
+	Role    string `json:"role"`
+}
@@ -0,0 +1,49 @@
+package types
+
+import "time"
+
+// States of a permission request
+const (
+	PermissionRequestPending  = "pending"
+	PermissionRequestApproved = "approved"
+	PermissionRequestRejected = "rejected"
+	PermissionRequestRevoked  = "revoked"
+)
+
+// PermissionRequest asks the operator of an AS to let a source from another AS scrape mappings of one of its
+// Endpoints. Permissions lists by mapping the metrics the source wants to read, an empty list means all of them.
+type PermissionRequest struct {
+	ID          string              `json:"id"`
+	Source      string              `json:"source"`   // IA:IP of the scraper
+	Endpoint    string              `json:"endpoint"` // IP of the Endpoint
+	Permissions map[string][]string `json:"permissions"`
+	Frequency   string              `json:"frequency,omitempty"`
+	Window      *Window             `json:"window,omitempty"`
+	Requester   string              `json:"requester,omitempty"` // Contact of the person or organization behind it
+	Reason      string              `json:"reason,omitempty"`
+	RemoteAddr  string              `json:"remote_addr"`
+	Status      string              `json:"status"`
+	Received    time.Time           `json:"received"`
+	Decided     *time.Time          `json:"decided,omitempty"`
+	Comment     string              `json:"comment,omitempty"` // From the operator, with the decision
+	Granted     *GrantedPermissions `json:"granted,omitempty"` // What the approval changed on the Endpoint
+}
+
+// GrantedPermissions records what approving a permission request changed in the policy of the Endpoint, so that
+// revoking it undoes only that. The frequencies and windows the source had before are kept by mapping, empty if it had
+// none.
+type GrantedPermissions struct {
+	Role        string            `json:"role"`
+	OwnerRoles  []string          `json:"owner_roles,omitempty"` // Bound to the source by the approval
+	Frequencies map[string]string `json:"frequencies,omitempty"`
+	Windows     map[string]string `json:"windows,omitempty"`
+}
+
+// PermissionRequestDecision approves, rejects or revokes the permission request with the given ID. On approval the
+// operator can set a different frequency and window than the requested ones.
+type PermissionRequestDecision struct {
+	ID        string  `json:"id"`
+	Frequency string  `json:"frequency,omitempty"`
+	Window    *Window `json:"window,omitempty"`
+	Comment   string  `json:"comment,omitempty"`
+}
@@ -0,0 +1,44 @@
+package types
+
+// Policy distributed by the Manager to the Endpoints. Version is incremented at every change of the Manager's policy,
+// OverrideVersion at every change of the override of a single endpoint.
+type Policy struct {
+	Version         int           `json:"version"`
+	OverrideVersion int           `json:"override_version,omitempty"`
+	Roles           []Role        `json:"roles"`
+	Bindings        []RoleBinding `json:"bindings"`
+	Timing          []TimingRule  `json:"timing"`
+}
+
+// Assignment of a role to a source (IA:IP) or a source pattern
+type RoleBinding struct {
+	Subject string `json:"subject"`
+	Role    string `json:"role"`
+}
+
+// Frequency and/or window permission of a source on a mapping
+type TimingRule struct {
+	Subject   string  `json:"subject"`
+	Mapping   string  `json:"mapping"`
+	Frequency string  `json:"frequency,omitempty"`
+	Window    *Window `json:"window,omitempty"`
+}
+
+// State of the managed policy on an Endpoint
+type PolicyStatus struct {
+	Version         int      `json:"version"`
+	OverrideVersion int      `json:"override_version"`
+	Drift           []string `json:"drift"` // Differences between the applied policy and the Endpoint's current one
+}
+
+// State of the managed policy on an Endpoint as seen by the Manager
+type EndpointPolicyStatus struct {
+	IP               string   `json:"ip"`
+	InSync           bool     `json:"in_sync"`
+	Version          int      `json:"version"`
+	OverrideVersion  int      `json:"override_version"`
+	Expected         int      `json:"expected_version"`
+	ExpectedOverride int      `json:"expected_override_version"`
+	Drift            []string `json:"drift"`
+	Error            string   `json:"error,omitempty"`
+}
@@ -0,0 +1,21 @@
+package types
+
+// Actions of redaction rules
+const (
+	RedactDropLabel  = "drop_label"  // Removes Label from the series
+	RedactHashLabel  = "hash_label"  // Replaces the value of Label by a keyed hash, so that series stay distinguishable
+	RedactBucket     = "bucket"      // Rounds the value of Label, or the sample value if Label is empty, down to Buckets
+	RedactDropSeries = "drop_series" // Removes the series matching Matchers
+)
+
+// RedactionRule transforms the metrics returned to the sources having the role it belongs to. The rule applies to the
+// series of the metric families whose name matches Metric (a trailing "*" matches any suffix, empty matches all) on
+// Mapping (all mappings if empty), and whose labels match all Matchers (label name -> regular expression).
+type RedactionRule struct {
+	Mapping  string            `json:"mapping,omitempty"`
+	Metric   string            `json:"metric,omitempty"`
+	Matchers map[string]string `json:"matchers,omitempty"`
+	Action   string            `json:"action"`
+	Label    string            `json:"label,omitempty"`
+	Buckets  []float64         `json:"buckets,omitempty"`
+}
@@ -0,0 +1,20 @@
+package types
+
+import "time"
+
+// RevokedCert is an entry of the revocation list kept by the Manager
+type RevokedCert struct {
+	Serial    string    `json:"serial"`
+	Type      string    `json:"type,omitempty"`
+	IP        string    `json:"ip,omitempty"`
+	Reason    string    `json:"reason,omitempty"`
+	RevokedAt time.Time `json:"revoked_at"`
+}
+
+// RevocationRequest identifies the certificate to revoke, either by serial number or by component type and IP
+type RevocationRequest struct {
+	Serial string `json:"serial"`
+	Type   string `json:"type"`
+	IP     string `json:"ip"`
+	Reason string `json:"reason"`
+}
@@ -0,0 +1,9 @@
+package types
+
+// Access window of a source on a mapping. Start and End are RFC3339 times, either can be left empty. Schedule limits
+// the window to recurring periods in UTC, e.g. "mon-fri 08:00-18:00" or "sat,sun 00:00-24:00".
+type Window struct {
+	Start    string `json:"start,omitempty"`
+	End      string `json:"end,omitempty"`
+	Schedule string `json:"schedule,omitempty"`
+}
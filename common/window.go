@@ -0,0 +1,238 @@
+package common
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/netsec-ethz/2SMS/common/types"
+	"github.com/pkg/errors"
+)
+
+var weekdays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// Schedule is a recurring daily period on some days of the week, in UTC
+type Schedule struct {
+	Days [7]bool       // Indexed by time.Weekday
+	From time.Duration // Since midnight
+	To   time.Duration // Since midnight, if not after From the period ends on the next day
+}
+
+// Parses a schedule like "mon-fri 08:00-18:00". Days are "*", a day name or number (0 is sunday), a range of them or a
+// list of these separated by commas, like for cron.
+func ParseSchedule(s string) (*Schedule, error) {
+	fields := strings.Fields(s)
+	if len(fields) != 2 {
+		return nil, errors.Errorf("schedule %q must be '<days> <HH:MM>-<HH:MM>'", s)
+	}
+	sched := &Schedule{}
+	for _, part := range strings.Split(strings.Replace(fields[0], "+", ",", -1), ",") {
+		if part == "*" {
+			for i := range sched.Days {
+				sched.Days[i] = true
+			}
+			continue
+		}
+		bounds := strings.SplitN(part, "-", 2)
+		first, err := parseWeekday(bounds[0])
+		if err != nil {
+			return nil, err
+		}
+		last := first
+		if len(bounds) == 2 {
+			last, err = parseWeekday(bounds[1])
+			if err != nil {
+				return nil, err
+			}
+		}
+		for d := first; ; d = (d + 1) % 7 {
+			sched.Days[d] = true
+			if d == last {
+				break
+			}
+		}
+	}
+	if sched.Days == [7]bool{} {
+		return nil, errors.Errorf("schedule %q has no days", s)
+	}
+	times := strings.SplitN(fields[1], "-", 2)
+	if len(times) != 2 {
+		return nil, errors.Errorf("invalid time range %q", fields[1])
+	}
+	var err error
+	if sched.From, err = parseTimeOfDay(times[0]); err != nil {
+		return nil, err
+	}
+	if sched.To, err = parseTimeOfDay(times[1]); err != nil {
+		return nil, err
+	}
+	return sched, nil
+}
+
+func parseWeekday(s string) (int, error) {
+	s = strings.ToLower(s)
+	for i, name := range weekdays {
+		if strings.HasPrefix(s, name) {
+			return i, nil
+		}
+	}
+	i, err := strconv.Atoi(s)
+	if err != nil || i < 0 || i > 7 {
+		return 0, errors.Errorf("invalid day %q", s)
+	}
+	return i % 7, nil
+}
+
+// Parses HH:MM, 24:00 is allowed as end of the day
+func parseTimeOfDay(s string) (time.Duration, error) {
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) != 2 {
+		return 0, errors.Errorf("invalid time %q, expected HH:MM", s)
+	}
+	h, err1 := strconv.Atoi(parts[0])
+	m, err2 := strconv.Atoi(parts[1])
+	if err1 != nil || err2 != nil || h < 0 || m < 0 || m > 59 || h*60+m > 24*60 {
+		return 0, errors.Errorf("invalid time %q, expected HH:MM", s)
+	}
+	return time.Duration(h)*time.Hour + time.Duration(m)*time.Minute, nil
+}
+
+func (s *Schedule) String() string {
+	days := []string{}
+	for i, on := range s.Days {
+		if on {
+			days = append(days, weekdays[i])
+		}
+	}
+	if len(days) == 7 {
+		days = []string{"*"}
+	}
+	// Commas would be split by the csv policy adapter
+	return strings.Join(days, "+") + " " + formatTimeOfDay(s.From) + "-" + formatTimeOfDay(s.To)
+}
+
+func formatTimeOfDay(d time.Duration) string {
+	m := int(d / time.Minute)
+	return strconv.Itoa(m/60/10) + strconv.Itoa(m/60%10) + ":" + strconv.Itoa(m%60/10) + strconv.Itoa(m%10)
+}
+
+// Window during which a source may scrape a mapping. Zero Start and End mean no bound, a nil Schedule that the window
+// is always open between them.
+type Window struct {
+	Start    time.Time
+	End      time.Time
+	Schedule *Schedule
+}
+
+// Builds a window from its API representation
+func NewWindow(w types.Window) (*Window, error) {
+	win := &Window{}
+	var err error
+	if w.Start != "" {
+		if win.Start, err = time.Parse(time.RFC3339, w.Start); err != nil {
+			return nil, errors.Wrap(err, "invalid start")
+		}
+	}
+	if w.End != "" {
+		if win.End, err = time.Parse(time.RFC3339, w.End); err != nil {
+			return nil, errors.Wrap(err, "invalid end")
+		}
+	}
+	if !win.Start.IsZero() && !win.End.IsZero() && !win.End.After(win.Start) {
+		return nil, errors.New("end must be after start")
+	}
+	if w.Schedule != "" {
+		if win.Schedule, err = ParseSchedule(w.Schedule); err != nil {
+			return nil, err
+		}
+	}
+	return win, nil
+}
+
+// Parses the value of a window permission: either "<start>/<end>/<schedule>", with any part possibly empty, or just
+// the end time, as created by older versions
+func ParseWindow(s string) (*Window, error) {
+	parts := strings.SplitN(s, "/", 3)
+	if len(parts) == 1 {
+		return NewWindow(types.Window{End: s})
+	}
+	w := types.Window{Start: parts[0], End: parts[1]}
+	if len(parts) == 3 {
+		w.Schedule = parts[2]
+	}
+	return NewWindow(w)
+}
+
+// Returns the API representation of the window, from which NewWindow builds it again
+func (w *Window) Spec() types.Window {
+	spec := types.Window{Start: formatBound(w.Start), End: formatBound(w.End)}
+	if w.Schedule != nil {
+		spec.Schedule = w.Schedule.String()
+	}
+	return spec
+}
+
+// Value of the window permission
+func (w *Window) String() string {
+	s := formatBound(w.Start) + "/" + formatBound(w.End)
+	if w.Schedule != nil {
+		s += "/" + w.Schedule.String()
+	}
+	return s
+}
+
+func formatBound(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+// Whether the window will never open again after t
+func (w *Window) Expired(t time.Time) bool {
+	_, _, ok := w.Interval(t)
+	return !ok
+}
+
+// Whether the window is open at t
+func (w *Window) IsOpen(t time.Time) bool {
+	open, _, ok := w.Interval(t)
+	return ok && !t.Before(open)
+}
+
+// Returns the period of the window containing t or, if the window is closed at t, the next one. A zero close means the
+// window never closes. ok is false if the window doesn't open anymore after t.
+func (w *Window) Interval(t time.Time) (open, close time.Time, ok bool) {
+	if !w.End.IsZero() && !t.Before(w.End) {
+		return time.Time{}, time.Time{}, false
+	}
+	if w.Schedule == nil {
+		return w.Start, w.End, true
+	}
+	t = t.UTC()
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	if t.Before(w.Start) {
+		start := w.Start.UTC()
+		day = time.Date(start.Year(), start.Month(), start.Day(), 0, 0, 0, 0, time.UTC)
+	}
+	// Start from the previous day, whose period may end after midnight
+	for d := day.AddDate(0, 0, -1); d.Before(day.AddDate(0, 0, 8)); d = d.AddDate(0, 0, 1) {
+		if !w.Schedule.Days[d.Weekday()] {
+			continue
+		}
+		open, close = d.Add(w.Schedule.From), d.Add(w.Schedule.To)
+		if !close.After(open) {
+			close = close.Add(24 * time.Hour)
+		}
+		if open.Before(w.Start) {
+			open = w.Start
+		}
+		if !w.End.IsZero() && close.After(w.End) {
+			close = w.End
+		}
+		if close.After(open) && close.After(t) {
+			return open, close, true
+		}
+	}
+	return time.Time{}, time.Time{}, false
+}
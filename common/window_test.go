@@ -0,0 +1,115 @@
+package common
+
+import (
+	"testing"
+	"time"
+
+	"github.com/netsec-ethz/2SMS/common/types"
+)
+
+// Monday, 1 January 2024
+func at(day, hour, min int) time.Time {
+	return time.Date(2024, 1, day, hour, min, 0, 0, time.UTC)
+}
+
+func TestWindowInterval(t *testing.T) {
+	zero := time.Time{}
+	tests := []struct {
+		name        string
+		window      types.Window
+		t           time.Time
+		open, close time.Time
+		ok          bool
+	}{
+		{"unbounded", types.Window{}, at(1, 10, 0), zero, zero, true},
+		{"before start", types.Window{Start: "2024-01-02T00:00:00Z"}, at(1, 10, 0), at(2, 0, 0), zero, true},
+		{"until end", types.Window{End: "2024-01-02T00:00:00Z"}, at(1, 10, 0), zero, at(2, 0, 0), true},
+		{"at end", types.Window{End: "2024-01-02T00:00:00Z"}, at(2, 0, 0), zero, zero, false},
+		{"after end", types.Window{End: "2024-01-02T00:00:00Z"}, at(3, 0, 0), zero, zero, false},
+		{"in period", types.Window{Schedule: "mon-fri 08:00-18:00"}, at(1, 10, 0), at(1, 8, 0), at(1, 18, 0), true},
+		{"at opening", types.Window{Schedule: "mon-fri 08:00-18:00"}, at(1, 8, 0), at(1, 8, 0), at(1, 18, 0), true},
+		{"at closing", types.Window{Schedule: "mon-fri 08:00-18:00"}, at(1, 18, 0), at(2, 8, 0), at(2, 18, 0), true},
+		{"before period", types.Window{Schedule: "mon-fri 08:00-18:00"}, at(1, 7, 0), at(1, 8, 0), at(1, 18, 0), true},
+		{"evening", types.Window{Schedule: "mon-fri 08:00-18:00"}, at(1, 19, 0), at(2, 8, 0), at(2, 18, 0), true},
+		{"friday evening", types.Window{Schedule: "mon-fri 08:00-18:00"}, at(5, 19, 0), at(8, 8, 0), at(8, 18, 0), true},
+		{"weekend", types.Window{Schedule: "mon-fri 08:00-18:00"}, at(6, 12, 0), at(8, 8, 0), at(8, 18, 0), true},
+		{"wrapping days", types.Window{Schedule: "fri-mon 08:00-18:00"}, at(2, 12, 0), at(5, 8, 0), at(5, 18, 0), true},
+		{"day list", types.Window{Schedule: "tue+thu 08:00-18:00"}, at(2, 19, 0), at(4, 8, 0), at(4, 18, 0), true},
+		{"whole day", types.Window{Schedule: "sat 00:00-24:00"}, at(1, 12, 0), at(6, 0, 0), at(7, 0, 0), true},
+		// Periods ending after midnight belong to the day they start
+		{"overnight after midnight", types.Window{Schedule: "* 22:00-02:00"}, at(2, 1, 0), at(1, 22, 0), at(2, 2, 0), true},
+		{"overnight before", types.Window{Schedule: "* 22:00-02:00"}, at(2, 3, 0), at(2, 22, 0), at(3, 2, 0), true},
+		{"overnight from sunday", types.Window{Schedule: "sun 22:00-02:00"}, at(1, 1, 0), at(0, 22, 0), at(1, 2, 0), true},
+		{"overnight end of week", types.Window{Schedule: "sun 22:00-02:00"}, at(1, 3, 0), at(7, 22, 0), at(8, 2, 0), true},
+		// The bounds cut the periods
+		{"start in period", types.Window{Start: "2024-01-01T12:00:00Z", Schedule: "mon-fri 08:00-18:00"}, at(1, 9, 0),
+			at(1, 12, 0), at(1, 18, 0), true},
+		{"start after period", types.Window{Start: "2024-01-01T19:00:00Z", Schedule: "mon-fri 08:00-18:00"}, at(1, 9, 0),
+			at(2, 8, 0), at(2, 18, 0), true},
+		{"start far ahead", types.Window{Start: "2024-01-06T00:00:00Z", Schedule: "mon-fri 08:00-18:00"}, at(1, 9, 0),
+			at(8, 8, 0), at(8, 18, 0), true},
+		{"end in period", types.Window{End: "2024-01-01T15:00:00Z", Schedule: "mon-fri 08:00-18:00"}, at(1, 10, 0),
+			at(1, 8, 0), at(1, 15, 0), true},
+		{"end before next period", types.Window{End: "2024-01-02T07:00:00Z", Schedule: "mon-fri 08:00-18:00"},
+			at(1, 19, 0), zero, zero, false},
+		{"end within a week", types.Window{End: "2024-01-07T00:00:00Z", Schedule: "sun 08:00-18:00"}, at(1, 10, 0),
+			zero, zero, false},
+		{"other time zone", types.Window{Schedule: "mon-fri 08:00-18:00"},
+			time.Date(2024, 1, 1, 9, 0, 0, 0, time.FixedZone("CET", 3600)), at(1, 8, 0), at(1, 18, 0), true},
+	}
+	for _, test := range tests {
+		w, err := NewWindow(test.window)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		open, close, ok := w.Interval(test.t)
+		if ok != test.ok || !open.Equal(test.open) || !close.Equal(test.close) {
+			t.Errorf("%s: expected %v %v %v, got %v %v %v", test.name, test.open, test.close, test.ok, open, close, ok)
+		}
+		if isOpen := ok && !test.t.Before(open); w.IsOpen(test.t) != isOpen {
+			t.Errorf("%s: expected IsOpen %v", test.name, isOpen)
+		}
+	}
+}
+
+func TestParseWindow(t *testing.T) {
+	tests := []struct {
+		value     string
+		expected  string // String of the parsed window
+		expectErr bool
+	}{
+		{value: "2024-01-01T00:00:00Z/2024-02-01T00:00:00Z/mon-fri 08:00-18:00",
+			expected: "2024-01-01T00:00:00Z/2024-02-01T00:00:00Z/mon+tue+wed+thu+fri 08:00-18:00"},
+		{value: "//* 22:00-02:00", expected: "//* 22:00-02:00"},
+		{value: "/2024-02-01T01:00:00+01:00", expected: "/2024-02-01T00:00:00Z"},
+		// Just the end, as stored by older versions
+		{value: "2024-02-01T00:00:00Z", expected: "/2024-02-01T00:00:00Z"},
+		{value: "2024-02-01T00:00:00Z/2024-01-01T00:00:00Z", expectErr: true},
+		{value: "//mon-fri", expectErr: true},
+		{value: "//xyz 08:00-18:00", expectErr: true},
+		{value: "//mon 08:00-25:00", expectErr: true},
+		{value: "tomorrow", expectErr: true},
+	}
+	for _, test := range tests {
+		w, err := ParseWindow(test.value)
+		if test.expectErr {
+			if err == nil {
+				t.Errorf("%q: expected an error, got %s", test.value, w)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", test.value, err)
+			continue
+		}
+		if w.String() != test.expected {
+			t.Errorf("%q: expected %q, got %q", test.value, test.expected, w.String())
+		}
+		// The API representation builds the same window again
+		again, err := NewWindow(w.Spec())
+		if err != nil || again.String() != w.String() {
+			t.Errorf("%q: Spec doesn't round trip: %v %v", test.value, again, err)
+		}
+	}
+}
@@ -47,11 +47,10 @@ mv -n configuration/* .
 rm -rf configuration
 
 # Check contents
-if [ ! -f ca_certs/bootstrap.json ] || [ ! -f ca_certs/ca.crt ] || [ ! -f ca_certs/ISD*AS*.crt ] || [ ! -f auth/model.conf ] || [ ! -f 2SMSendpoint.service ] || [ ! -f create_endpoint_mappings.sh ]; then
-    echo "Some required configuration file is missing from the unpacked endpoint_configuration archive. Please make sure that you have the following files: ca_certs/boostrap.json, ca_certs/ca.crt, ca_certs/ISD*AS*.crt, auth/model.conf, 2SMSendpoint.service, create_endpoint_mappings.sh"
+if [ ! -f ca_certs/bootstrap.json ] || [ ! -f ca_certs/ca.crt ] || [ ! -f ca_certs/ISD*AS*.crt ] || [ ! -f auth/model.conf ] || [ ! -f 2SMSendpoint.service ]; then
+    echo "Some required configuration file is missing from the unpacked endpoint_configuration archive. Please make sure that you have the following files: ca_certs/boostrap.json, ca_certs/ca.crt, ca_certs/ISD*AS*.crt, auth/model.conf, 2SMSendpoint.service"
     exit 1
 fi
-chmod +x create_endpoint_mappings.sh
 
 # Modify service file with correct SCION address and IP parameters
 sed -i -r "s/_USER_/$USER/g;s/_MANAGER_IP_/$MANAGER_IP/g;s/^(.+)_IA_,\[_IP_\]:9199 (.+)$/\1$IA,[$IP]:9199 \2/g" $SERVICE_FILE_NAME
@@ -76,10 +75,9 @@ else
     echo "SCION correctly installed"
 fi
 
-# Create mappings file
+# The mappings file is recreated by the endpoint with the services discovered in $SC/gen
 echo "Removing previous mappings file"
 rm -f mappings.json
-./create_endpoint_mappings.sh
 
 # Start service
 echo "Stopping $SERVICE_FILE_NAME"
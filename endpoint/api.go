@@ -5,12 +5,17 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/netsec-ethz/2SMS/common"
 	"github.com/netsec-ethz/2SMS/common/types"
 )
 
+// Lists the mappings as path -> port or, with the details query parameter, with all their settings. Passwords are
+// not returned.
 func listMappings(w http.ResponseWriter, r *http.Request) {
 	// Try loading into a temp map
 	mappings, err := LoadMappings()
@@ -19,7 +24,27 @@ func listMappings(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
-	jsonMappings, err := json.Marshal(mappings)
+	var list interface{}
+	if _, ok := r.URL.Query()["details"]; ok {
+		details := []types.Mapping{}
+		for _, mapping := range mappings {
+			if mapping.BasicAuth != nil && mapping.BasicAuth.Password != "" {
+				auth := *mapping.BasicAuth
+				auth.Password = "<secret>"
+				mapping.BasicAuth = &auth
+			}
+			details = append(details, mapping)
+		}
+		sort.Slice(details, func(i, j int) bool { return details[i].Path < details[j].Path })
+		list = details
+	} else {
+		ports := make(map[string]string)
+		for path, mapping := range mappings {
+			ports[path] = mapping.Port
+		}
+		list = ports
+	}
+	jsonMappings, err := json.Marshal(list)
 	if err != nil {
 		log.Println("Error while marshalling json:", err)
 		w.WriteHeader(500)
@@ -36,6 +61,11 @@ func addMapping(w http.ResponseWriter, r *http.Request) {
 		log.Println("Failed parsing request body:", err)
 		return
 	}
+	if err = mapping.Validate(); err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
 	// Add mapping to the forwarding list
 	err = UpdateMappings(*mapping)
 	if err != nil {
@@ -45,7 +75,7 @@ func addMapping(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Add metric permissions for the new target to "owner_role"
-	thisMapping := types.EndpointMappings{mapping.Path: mapping.Port}
+	thisMapping := types.EndpointMappings{mapping.Path: *mapping}
 	SyncPermissions(thisMapping, types.EndpointMappings{})
 	err = SyncManager(thisMapping, types.EndpointMappings{})
 	if err != nil {
@@ -75,6 +105,13 @@ func putMappings(w http.ResponseWriter, r *http.Request) {
 		log.Printf("Failed parsing request body %v: %v\n", string(data), err)
 		return
 	}
+	for _, mapping := range mappings.Add {
+		if err = mapping.Validate(); err != nil {
+			w.WriteHeader(400)
+			w.Write([]byte(err.Error()))
+			return
+		}
+	}
 	removals := mappings.RemoveRegex
 	removed, err := RemoveMappingRegexpBatch(removals)
 	if err != nil {
@@ -115,8 +152,8 @@ func removeMapping(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	// Remove all scrape and temporal permissions associated with the removed mapping
-	SyncPermissions(types.EndpointMappings{}, types.EndpointMappings{mapping.Path: mapping.Port})
-	err = SyncManager(types.EndpointMappings{}, types.EndpointMappings{mapping.Path: mapping.Port})
+	SyncPermissions(types.EndpointMappings{}, types.EndpointMappings{mapping.Path: *mapping})
+	err = SyncManager(types.EndpointMappings{}, types.EndpointMappings{mapping.Path: *mapping})
 	if err != nil {
 		w.WriteHeader(500)
 		log.Printf("Could not sync with manager while removing target. Error is: %v", err)
@@ -155,6 +192,31 @@ func listMetrics(w http.ResponseWriter, r *http.Request) {
 	w.Write(jsonMetricsInfo)
 }
 
+// Explains whether the source may scrape the mapping and why, together with the metric families it would get. The
+// optional metric query parameter explains the permission to read that metric family.
+func explainSource(w http.ResponseWriter, r *http.Request) {
+	source := mux.Vars(r)["source"]
+	mapping := "/" + mux.Vars(r)["mapping"]
+	explanation := accessController.Explain(source, mapping, r.URL.Query().Get("metric"))
+	upstream, err := scrapes.get(mapping, localHTTPClient)
+	if err != nil {
+		explanation.Error = err.Error()
+	} else {
+		explanation.Metrics = []string{}
+		metrics := accessController.RedactMetrics(source, mapping, accessController.FilterMetrics(source, mapping, upstream.metrics))
+		for _, fam := range metrics {
+			explanation.Metrics = append(explanation.Metrics, fam.GetName())
+		}
+	}
+	jsonExplanation, err := json.Marshal(explanation)
+	if err != nil {
+		log.Println("Error while marshalling json:", err)
+		w.WriteHeader(500)
+		return
+	}
+	w.Write(jsonExplanation)
+}
+
 type MetricInfo struct {
 	Name string `json:"name,omitempty"`
 	Type string `json:"type,omitempty"`
@@ -172,6 +234,70 @@ func listSourceRoles(w http.ResponseWriter, r *http.Request) {
 	w.Write(jsonRoles)
 }
 
+// Returns the patterns in the policy matching the source
+func listSourcePatterns(w http.ResponseWriter, r *http.Request) {
+	source := mux.Vars(r)["source"]
+	jsonPatterns, err := json.Marshal(accessController.MatchingPatterns(source))
+	if err != nil {
+		log.Println("Error while marshalling json:", err)
+		w.WriteHeader(500)
+		return
+	}
+	w.Write(jsonPatterns)
+}
+
+// Returns the roles bound to each pattern
+func listPatternRoles(w http.ResponseWriter, r *http.Request) {
+	jsonBindings, err := json.Marshal(accessController.GetPatternRoles())
+	if err != nil {
+		log.Println("Error while marshalling json:", err)
+		w.WriteHeader(500)
+		return
+	}
+	w.Write(jsonBindings)
+}
+
+func readPatternBinding(r *http.Request) (*types.PatternBinding, error) {
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	var binding types.PatternBinding
+	err = json.Unmarshal(data, &binding)
+	if err != nil {
+		return nil, err
+	}
+	return &binding, nil
+}
+
+func addPatternRole(w http.ResponseWriter, r *http.Request) {
+	binding, err := readPatternBinding(r)
+	if err != nil {
+		log.Println("Error reading pattern binding:", err)
+		w.WriteHeader(400)
+		return
+	}
+	err = accessController.AddPatternRole(binding.Pattern, binding.Role)
+	if err != nil {
+		log.Println("Error in adding pattern role:", err)
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	w.WriteHeader(204)
+}
+
+func removePatternRole(w http.ResponseWriter, r *http.Request) {
+	binding, err := readPatternBinding(r)
+	if err != nil {
+		log.Println("Error reading pattern binding:", err)
+		w.WriteHeader(400)
+		return
+	}
+	accessController.RemovePatternRole(binding.Pattern, binding.Role)
+	w.WriteHeader(204)
+}
+
 func addSourceRole(w http.ResponseWriter, r *http.Request) {
 	source := mux.Vars(r)["source"]
 	var role string
@@ -231,7 +357,7 @@ func sourceStatus(w http.ResponseWriter, r *http.Request) {
 	allPerms := accessController.GetSubjectPermissions(source)
 	globalStatus := make(map[string]Status)
 	for obj, perms := range allPerms {
-		status := Status{false, "unlimited", "unlimited"}
+		status := Status{CanScrape: false, Frequency: "unlimited", Until: "unlimited"}
 		for _, perm := range perms {
 			if perm == "scrape" {
 				status.CanScrape = true
@@ -239,7 +365,29 @@ func sourceStatus(w http.ResponseWriter, r *http.Request) {
 				status.Frequency = strings.Split(perm, ":")[1]
 
 			} else if strings.HasPrefix(perm, "window:") {
-				status.Until = strings.SplitAfterN(perm, ":", 2)[1]
+				win, err := common.ParseWindow(strings.SplitAfterN(perm, ":", 2)[1])
+				if err != nil {
+					log.Println("Invalid window:", err)
+					continue
+				}
+				if !win.End.IsZero() {
+					status.Until = win.End.Format(time.RFC3339)
+				} else {
+					status.Until = "unlimited"
+				}
+				if win.Schedule != nil {
+					status.Schedule = win.Schedule.String()
+				}
+				// Report the next opening (if the window is closed now) and closing
+				now := time.Now()
+				if open, close, ok := win.Interval(now); ok {
+					if now.Before(open) {
+						status.NextOpen = open.Format(time.RFC3339)
+					}
+					if !close.IsZero() {
+						status.NextClose = close.Format(time.RFC3339)
+					}
+				}
 			}
 		}
 		globalStatus[obj] = status
@@ -257,6 +405,9 @@ type Status struct {
 	CanScrape bool
 	Frequency string
 	Until     string
+	Schedule  string `json:",omitempty"`
+	NextOpen  string `json:",omitempty"`
+	NextClose string `json:",omitempty"`
 }
 
 func removeAllSourcePermissions(w http.ResponseWriter, r *http.Request) {
@@ -368,6 +519,56 @@ func removeRolePermissions(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(204)
 }
 
+// Returns the redaction rules applied to the metrics returned to the sources having the role.
+func getRoleRedaction(w http.ResponseWriter, r *http.Request) {
+	role := mux.Vars(r)["role"]
+	jsonRules, err := json.Marshal(accessController.Redactor.GetRules(role))
+	if err != nil {
+		log.Println("Error while marshalling json:", err)
+		w.WriteHeader(500)
+		return
+	}
+	w.Write(jsonRules)
+}
+
+// Replaces the redaction rules of the role.
+func setRoleRedaction(w http.ResponseWriter, r *http.Request) {
+	role := mux.Vars(r)["role"]
+	var rules []types.RedactionRule
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Println("Error while reading request body:", err)
+		w.WriteHeader(500)
+		return
+	}
+	err = json.Unmarshal(data, &rules)
+	if err != nil {
+		log.Println("Error while unmarshalling json:", err)
+		w.WriteHeader(400)
+		return
+	}
+	err = accessController.Redactor.SetRules(role, rules)
+	if err != nil {
+		log.Println("Error setting redaction rules:", err)
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	w.WriteHeader(204)
+}
+
+// Removes the redaction rules of the role.
+func removeRoleRedaction(w http.ResponseWriter, r *http.Request) {
+	role := mux.Vars(r)["role"]
+	err := accessController.Redactor.SetRules(role, nil)
+	if err != nil {
+		log.Println("Error removing redaction rules:", err)
+		w.WriteHeader(500)
+		return
+	}
+	w.WriteHeader(204)
+}
+
 func removeSourceFrequency(w http.ResponseWriter, r *http.Request) {
 	source := mux.Vars(r)["source"]
 	mapping := "/" + mux.Vars(r)["mapping"]
@@ -387,7 +588,12 @@ func setSourceFrequency(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		return
 	}
-	accessController.AddTimingPermission(source, mapping, "frequency", duration)
+	err = accessController.AddTimingPermission(source, mapping, "frequency", duration)
+	if err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
 	w.WriteHeader(204)
 }
 
@@ -398,6 +604,8 @@ func removeSourceWindow(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(204)
 }
 
+// Sets the window during which the source may scrape the mapping. The body is either a duration from now or a
+// types.Window with explicit start, end and recurring schedule.
 func setSourceWindow(w http.ResponseWriter, r *http.Request) {
 	source := mux.Vars(r)["source"]
 	mapping := "/" + mux.Vars(r)["mapping"]
@@ -407,10 +615,30 @@ func setSourceWindow(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	err = json.Unmarshal(data, &duration)
+	if err == nil {
+		err = accessController.AddTimingPermission(source, mapping, "window", duration)
+		if err != nil {
+			w.WriteHeader(400)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		w.WriteHeader(204)
+		return
+	}
+	var window types.Window
+	err = json.Unmarshal(data, &window)
+	if err != nil {
+		log.Println("Error unmarshalling json:", err)
+		w.WriteHeader(400)
+		return
+	}
+	win, err := common.NewWindow(window)
 	if err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
 		return
 	}
-	accessController.AddTimingPermission(source, mapping, "window", duration)
+	accessController.AddWindowPermission(source, mapping, win)
 	w.WriteHeader(204)
 }
 
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/netsec-ethz/2SMS/common"
+	"github.com/netsec-ethz/2SMS/common/types"
+)
+
+var (
+	auditFile       string
+	auditMaxSize    int
+	auditMaxBackups int
+	auditLog        *common.AuditLog
+)
+
+// Number of records returned by queries of the audit log without a limit
+const defaultAuditLimit = 1000
+
+// Records a scrape attempt in the audit log, if enabled
+func audit(record types.AuditRecord) {
+	if auditLog == nil {
+		return
+	}
+	record.Time = time.Now()
+	if err := auditLog.Write(&record); err != nil {
+		log.Println("Failed writing audit record:", err)
+	}
+}
+
+// Returns the ID of the capability token the scrape was authorized with, i.e. the last one in the chain
+func capabilityID(chain []types.Capability) string {
+	if len(chain) == 0 {
+		return ""
+	}
+	return chain[len(chain)-1].ID
+}
+
+// Returns the scrape attempts in the audit log, optionally filtered by source, mapping and time range (RFC 3339
+// timestamps). The most recent limit records are returned, oldest first.
+func queryAudit(w http.ResponseWriter, r *http.Request) {
+	if auditLog == nil {
+		log.Println("Audit log query, but the audit log is disabled")
+		w.WriteHeader(404)
+		return
+	}
+	query := r.URL.Query()
+	filter := types.AuditFilter{Source: query.Get("source"), Mapping: query.Get("mapping")}
+	var err error
+	if from := query.Get("from"); from != "" {
+		if filter.From, err = time.Parse(time.RFC3339, from); err != nil {
+			log.Println("Invalid start of the time range:", err)
+			w.WriteHeader(400)
+			return
+		}
+	}
+	if to := query.Get("to"); to != "" {
+		if filter.To, err = time.Parse(time.RFC3339, to); err != nil {
+			log.Println("Invalid end of the time range:", err)
+			w.WriteHeader(400)
+			return
+		}
+	}
+	limit := defaultAuditLimit
+	if l := query.Get("limit"); l != "" {
+		if limit, err = strconv.Atoi(l); err != nil || limit < 1 {
+			log.Println("Invalid limit:", l)
+			w.WriteHeader(400)
+			return
+		}
+	}
+	records, err := auditLog.Query(&filter, limit)
+	if err != nil {
+		log.Println("Error while querying the audit log:", err)
+		w.WriteHeader(500)
+		return
+	}
+	jsonRecords, err := json.Marshal(records)
+	if err != nil {
+		log.Println("Error while marshalling json:", err)
+		w.WriteHeader(500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonRecords)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/netsec-ethz/2SMS/common"
+	"github.com/netsec-ethz/2SMS/common/types"
+	"github.com/pkg/errors"
+)
+
+var (
+	capabilityRevocationFile string
+	capabilityTrustCA        bool
+	capabilities             *common.CapabilityVerifier
+	capabilityKey            *ecdsa.PrivateKey
+)
+
+// Creates the verifier of capability tokens, which trusts the endpoint's own key and, if enabled, the CA's one
+func initCapabilities() error {
+	var err error
+	capabilityKey, err = common.ReadECPrivKeyFromPEMFile(endpointPrivKey)
+	if err != nil || capabilityKey == nil {
+		return errors.Errorf("reading endpoint key: %v", err)
+	}
+	issuers := []*ecdsa.PublicKey{&capabilityKey.PublicKey}
+	if capabilityTrustCA {
+		caCert, err := common.ReadCertFromPEMFile(caCertsDir + "/ca.crt")
+		if err != nil || caCert == nil {
+			return errors.Errorf("reading CA certificate: %v", err)
+		}
+		caKey, ok := caCert.PublicKey.(*ecdsa.PublicKey)
+		if !ok {
+			return errors.New("CA certificate has no ECDSA key")
+		}
+		issuers = append(issuers, caKey)
+	}
+	capabilities, err = common.NewCapabilityVerifier(endpointIP, capabilityRevocationFile, issuers...)
+	return err
+}
+
+// Checks the capability token presented with the request, if any. Returns the verified chain of capabilities, or nil
+// if the request has no token. source must be the one identified by requestSource, i.e. from the SCION address or
+// the client certificate: nothing in the token or the request tells who presents it.
+func requestCapabilities(req *http.Request, source, path string) ([]types.Capability, error) {
+	token := req.Header.Get(types.CapabilityHeader)
+	if token == "" {
+		return nil, nil
+	}
+	if source == "" {
+		return nil, &common.AuthorizationError{Reason: common.ScrapeNotAuthorized, Message: "Capability presented by an unidentified source"}
+	}
+	chain, err := capabilities.Verify(token, time.Now())
+	if err != nil {
+		return nil, &common.AuthorizationError{Reason: common.ScrapeInvalidToken, Message: err.Error()}
+	}
+	return chain, accessController.AuthorizedByCapability(chain, source, path)
+}
+
+// Mints a capability token signed by the endpoint. Missing ID and endpoint are filled in. Only the manager and local
+// requests may mint tokens.
+func mintCapability(w http.ResponseWriter, r *http.Request) {
+	if !fromManagerOrLocal(r) {
+		log.Printf("Rejected capability minting from %s: not the manager", r.RemoteAddr)
+		w.WriteHeader(403)
+		return
+	}
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Println("Error while reading request body:", err)
+		w.WriteHeader(500)
+		return
+	}
+	var capability types.Capability
+	err = json.Unmarshal(data, &capability)
+	if err != nil {
+		log.Println("Error while unmarshalling json:", err)
+		w.WriteHeader(400)
+		return
+	}
+	if capability.ID == "" {
+		if capability.ID, err = common.NewCapabilityID(); err != nil {
+			w.WriteHeader(500)
+			return
+		}
+	}
+	if capability.Endpoint == "" {
+		capability.Endpoint = endpointIP
+	}
+	token, err := common.MintCapability(capability, capabilityKey)
+	if err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	log.Printf("Minted capability %s for %q on %v until %s", capability.ID, capability.Subject, capability.Mappings, capability.Expires.Format(time.RFC3339))
+	jsonResp, err := json.Marshal(types.CapabilityResponse{Capability: capability, Token: token})
+	if err != nil {
+		log.Println("Error while marshalling json:", err)
+		w.WriteHeader(500)
+		return
+	}
+	w.WriteHeader(201)
+	w.Write(jsonResp)
+}
+
+// Revokes a capability and all capabilities derived from it. Only the manager and local requests may revoke tokens.
+func revokeCapability(w http.ResponseWriter, r *http.Request) {
+	if !fromManagerOrLocal(r) {
+		log.Printf("Rejected capability revocation from %s: not the manager", r.RemoteAddr)
+		w.WriteHeader(403)
+		return
+	}
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Println("Error while reading request body:", err)
+		w.WriteHeader(500)
+		return
+	}
+	var revocation types.CapabilityRevocation
+	err = json.Unmarshal(data, &revocation)
+	if err != nil || revocation.ID == "" {
+		log.Println("Error while unmarshalling json:", err)
+		w.WriteHeader(400)
+		return
+	}
+	err = capabilities.Revoke(revocation.ID, revocation.Expires)
+	if err != nil {
+		log.Println("Failed revoking capability:", err)
+		w.WriteHeader(500)
+		return
+	}
+	log.Printf("Revoked capability %s", revocation.ID)
+	w.WriteHeader(204)
+}
+
+// Lists the revoked capabilities that haven't expired yet.
+func listRevokedCapabilities(w http.ResponseWriter, r *http.Request) {
+	jsonRevoked, err := json.Marshal(capabilities.Revoked())
+	if err != nil {
+		log.Println("Error while marshalling json:", err)
+		w.WriteHeader(500)
+		return
+	}
+	w.Write(jsonRevoked)
+}
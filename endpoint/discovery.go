@@ -0,0 +1,104 @@
+package main
+
+import (
+	"log"
+	"os"
+	"time"
+
+	"github.com/netsec-ethz/2SMS/common"
+	"github.com/netsec-ethz/2SMS/common/types"
+)
+
+var discoverServices bool
+
+// Returns the changes that make the service mappings in current match the discovered ones. Mappings that aren't of
+// a SCION service, e.g. /node or the ones added through the API, are left untouched.
+func diffDiscoveredMappings(current types.EndpointMappings, discovered []types.Mapping) ([]types.Mapping, types.EndpointMappings) {
+	add := []types.Mapping{}
+	found := make(map[string]bool)
+	for _, mapping := range discovered {
+		found[mapping.Path] = true
+		existing, ok := current[mapping.Path]
+		if !ok {
+			add = append(add, mapping)
+		} else if existing.Port != mapping.Port || existing.Service == "" {
+			// Keep the settings and labels that were added to the mapping
+			existing.Port, existing.Service = mapping.Port, mapping.Service
+			add = append(add, existing)
+		}
+	}
+	remove := types.EndpointMappings{}
+	for path, mapping := range current {
+		if common.IsServiceMapping(path) && !found[path] {
+			remove[path] = mapping
+		}
+	}
+	return add, remove
+}
+
+// Discovers the SCION services in servicesDir and updates their mappings, their permissions and the registration at
+// the manager
+func updateDiscoveredMappings(servicesDir string) error {
+	discovered, err := common.DiscoverMappings(servicesDir)
+	if err != nil {
+		return err
+	}
+	reloadMappingsMutex.Lock()
+	add, remove := diffDiscoveredMappings(internalMapping, discovered)
+	reloadMappingsMutex.Unlock()
+	added := types.EndpointMappings{}
+	if len(add) > 0 {
+		added, err = UpdateMappingBatch(add)
+		if err != nil {
+			return err
+		}
+	}
+	if len(remove) > 0 {
+		paths := []string{}
+		for path := range remove {
+			paths = append(paths, path)
+		}
+		log.Println("Removing the mappings of services no longer in the gen folder: ", paths)
+		err = RemoveMappingBatch(paths)
+		if err != nil {
+			return err
+		}
+	}
+	if len(added) == 0 && len(remove) == 0 {
+		return nil
+	}
+	SyncPermissions(added, remove)
+	return SyncManager(added, remove)
+}
+
+// Updates the mappings of the services in servicesDir, then checks every interval whether services were added or
+// removed or their configuration changed and updates the mappings again
+func watchServices(servicesDir string, interval time.Duration) error {
+	modTimes := func() string {
+		times := ""
+		for _, file := range common.ServiceConfigFiles(servicesDir) {
+			if info, err := os.Stat(file); err == nil {
+				times += file + info.ModTime().String()
+			}
+		}
+		return times
+	}
+	last := modTimes()
+	if err := updateDiscoveredMappings(servicesDir); err != nil {
+		return err
+	}
+	go func() {
+		for range time.NewTicker(interval).C {
+			current := modTimes()
+			if current == last {
+				continue
+			}
+			if err := updateDiscoveredMappings(servicesDir); err != nil {
+				log.Println("Failed updating the mappings of the discovered services:", err)
+				continue
+			}
+			last = current
+		}
+	}()
+	return nil
+}
@@ -2,14 +2,18 @@ package main
 
 import (
 	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"flag"
-	"io"
+	"fmt"
 	"log"
+	"math"
 	"net/http"
 	"os"
 	"os/exec"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/netsec-ethz/scion-apps/lib/shttp"
 
@@ -24,6 +28,7 @@ import (
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"net"
+	"net/url"
 	"sync"
 
 	"github.com/netsec-ethz/2SMS/common/types"
@@ -64,6 +69,21 @@ var (
 	initRolesFile           string
 	authPolicyFile          string
 	authModelFile           string
+	heartbeatInterval       time.Duration
+	crlRefresh              time.Duration
+	renewBefore             time.Duration
+	renewCheck              time.Duration
+	enrollToken             string
+	rateBurst               int
+	rateTolerance           time.Duration
+	rateStateFile           string
+	rateSaveInterval        time.Duration
+	windowSweepInterval     time.Duration
+	asRefreshInterval       time.Duration
+	redactionRulesFile      string
+	redactionKeyFile        string
+	scrapeCacheTTL          time.Duration
+	scrapes                 *scrapeCache
 )
 
 func initialize_endpoint() {
@@ -85,14 +105,37 @@ func initialize_endpoint() {
 	flag.StringVar(&initRolesFile, "endpoint.roles_file", "init_roles.json", "contains role definitions that are loaded at startup and added to the authorization policy")
 	flag.StringVar(&authModelFile, "endpoint.model", "auth/model.conf", "location of the model file defining authorization schema model")
 	flag.StringVar(&authPolicyFile, "endpoint.policy", "auth/policy.csv", "location of the policy file defining authorization schema policy")
+	flag.IntVar(&rateBurst, "endpoint.rate.burst", 1, "number of scrapes a source can do in a row on a mapping with a frequency permission")
+	flag.DurationVar(&rateTolerance, "endpoint.rate.tolerance", 2*time.Second, "how much earlier than allowed by its frequency permission a scrape is still accepted")
+	flag.StringVar(&rateStateFile, "endpoint.rate.state", "auth/rate_limits.json", "file where the rate limiting state is persisted across restarts")
+	flag.DurationVar(&rateSaveInterval, "endpoint.rate.save-interval", time.Minute, "interval between saves of the rate limiting state")
+	flag.StringVar(&managedPolicyFile, "endpoint.managed-policy", "auth/managed_policy.json", "file where the last policy received from the manager is stored")
+	flag.StringVar(&capabilityRevocationFile, "endpoint.capabilities.revoked", "auth/revoked_capabilities.json", "file where the IDs of revoked capability tokens are stored")
+	flag.BoolVar(&capabilityTrustCA, "endpoint.capabilities.trust-ca", true, "accept capability tokens signed by the manager's CA, besides the ones signed by the endpoint")
+	flag.StringVar(&redactionRulesFile, "endpoint.redaction.rules", "auth/redaction_rules.json", "file where the redaction rules of the roles are stored")
+	flag.StringVar(&redactionKeyFile, "endpoint.redaction.key", "auth/redaction.key", "file with the key used to hash label values, generated if missing")
+	flag.StringVar(&selfMapping, "endpoint.self-mapping", "/endpoint", "path of the mapping exposing the endpoint's own metrics, empty to disable")
+	flag.DurationVar(&scrapeCacheTTL, "endpoint.cache.ttl", time.Second, "how long the metrics fetched from a mapped target are reused for other scrapes, 0 to only share concurrent fetches")
+	flag.StringVar(&auditFile, "endpoint.audit.file", "audit.log", "file where the scrape attempts are recorded, empty to disable")
+	flag.IntVar(&auditMaxSize, "endpoint.audit.max-size", 10, "size in megabytes after which the audit log is rotated")
+	flag.IntVar(&auditMaxBackups, "endpoint.audit.backups", 5, "number of rotated audit log files that are kept")
+	flag.DurationVar(&windowSweepInterval, "endpoint.window-sweep", time.Minute, "interval between removals of scrape permissions whose time window has expired")
 
 	flag.StringVar(&caCertsDir, "ca.certs", "ca_certs", "directory with trusted ca certificates")
 
 	flag.StringVar(&managerIP, "manager.IP", "", "ip address of the manager")
 	flag.StringVar(&managerUnverifPort, "manager.unverif-port", "10000", "port where manager listens for certificate request")
 	flag.StringVar(&managerVerifPort, "manager.verif-port", "10001", "port where manager listens for authenticated operations")
+	flag.DurationVar(&heartbeatInterval, "manager.heartbeat", 30*time.Second, "interval between heartbeats sent to the manager")
+	flag.DurationVar(&crlRefresh, "manager.crl-refresh", 5*time.Minute, "interval between downloads of the manager's certificate revocation list")
+	flag.DurationVar(&renewBefore, "endpoint.cert-renew-before", 30*24*time.Hour, "time before expiration at which the certificate is renewed")
+	flag.StringVar(&enrollToken, "endpoint.enroll-token", "", "one-time enrollment token issued by the manager, the certificate request must be approved otherwise")
+	flag.DurationVar(&policyPullInterval, "manager.policy-pull", 5*time.Minute, "interval between pulls of the policy distributed by the manager")
+	flag.DurationVar(&renewCheck, "endpoint.cert-renew-check", 12*time.Hour, "interval between checks of the certificate's expiration")
 
 	flag.StringVar(&genFolder, "gen", "", "path to the SCION gen folder")
+	flag.DurationVar(&asRefreshInterval, "gen.refresh", time.Minute, "interval between checks for changes of the topology, TRC and service files in the gen folder")
+	flag.BoolVar(&discoverServices, "gen.discover", true, "keep the mappings of the SCION services in the gen folder up to date")
 	flag.Var((*snet.Addr)(&local), "local", "(Mandatory) address to listen on")
 
 	flag.BoolVar(&doAccessControl, "", true, "")
@@ -136,21 +179,44 @@ func initialize_endpoint() {
 			Province:           []string{"Zurich"},
 			Locality:           []string{"Zurich"},
 		}
-		bts, _ = common.GenCertSignRequest(name, privKey, []string{endpointDNS}, []net.IP{net.ParseIP(endpointIP)})
+		bts, _ = common.GenCertSignRequest(name, privKey, []string{endpointDNS}, []net.IP{net.ParseIP(endpointIP)}, []*url.URL{common.IAURI(local.IA)})
 		common.WriteToPEMFile(endpointCSR, "CERTIFICATE REQUEST", bts)
 	}
 	// Request certificate to the manager
 	if !common.FileExists(endpointCert) {
 		if managerIP != "" {
 			log.Printf("Certificate not found on %s. Requesting one.", endpointCert)
-			common.RequestAndObtainCert(caCertsDir, managerIP, managerUnverifPort, endpointCert, endpointCSR, "Endpoint", endpointIP)
+			common.RequestAndObtainCert(caCertsDir, managerIP, managerUnverifPort, endpointCert, endpointCSR, "Endpoint", endpointIP, enrollToken)
 		} else {
 			log.Fatal("No certificate found and no connection with manager. Please manually generate and upload a certificate for the csr.")
 		}
 	}
+	// Reject peers whose certificate was revoked by the manager and renew our own before it expires
+	if managerIP != "" {
+		err = common.StartRevocationCheck(caCertsDir, "https://"+managerIP+":"+managerUnverifPort+"/crl", crlRefresh)
+		if err != nil {
+			log.Fatal("Failed starting revocation check:", err)
+		}
+		// The SCION server reads the certificate only when it starts listening, so it is restarted after a renewal
+		common.StartCertRenewal(caCertsDir, endpointCert, endpointPrivKey, endpointCSR, "https://"+managerIP+":"+managerVerifPort+"/certificate/renew", local.IA, renewBefore, renewCheck, restartSCIONServer)
+	}
+	scrapes = newScrapeCache(scrapeCacheTTL)
+	scrapes.startSweeping(time.Minute)
 	// Init mappings
+	discoverServices = discoverServices && genFolder != ""
 	if !common.FileExists("mappings.json") {
-		log.Fatal("Mappings mappings.json file not found in endpoint directory. \nMake sure to create such file with a list of types.Mapping objects in json format.")
+		if !discoverServices {
+			log.Fatal("Mappings mappings.json file not found in endpoint directory. \nMake sure to create such file with a list of types.Mapping objects in json format.")
+		}
+		// Start with node exporter, the SCION services are added once discovered
+		_, nodePort, err := net.SplitHostPort(nodeListenAddress)
+		if err != nil {
+			log.Fatal("Invalid node exporter address:", err)
+		}
+		err = SaveMappings(types.EndpointMappings{"/node": {Path: "/node", Port: nodePort, Service: "node"}})
+		if err != nil {
+			log.Fatal("Failed creating mappings file:", err)
+		}
 	}
 
 	// Load mapping from file
@@ -158,6 +224,13 @@ func initialize_endpoint() {
 	if err != nil {
 		log.Fatal("Failed initializing internal mappings:", err)
 	}
+	// Built-in mapping to the endpoint's own metrics, exposed by the local management server
+	if existing, ok := internalMapping[selfMapping]; selfMapping != "" && (!ok || existing.Port != localhostManagementPort) {
+		_, err = UpdateMappingBatch([]types.Mapping{{Path: selfMapping, Port: localhostManagementPort, Host: "localhost", Service: "2sms_endpoint"}})
+		if err != nil {
+			log.Fatal("Failed adding the mapping of the endpoint's own metrics:", err)
+		}
+	}
 	httpsClient = common.CreateHttpsClient(caCertsDir, endpointCert, endpointPrivKey)
 	localHTTPClient = &http.Client{}
 	// Initialize Access Controller
@@ -169,6 +242,39 @@ func initialize_endpoint() {
 		file.Close()
 	}
 	accessController = common.NewAccessController(authModelFile, authPolicyFile, doAccessControl, &local.IA)
+	accessController.Limiter, err = common.NewRateLimiter(rateStateFile, rateBurst, rateTolerance)
+	if err != nil {
+		log.Fatal("Failed initializing rate limiter:", err)
+	}
+	accessController.Limiter.StartPersisting(rateSaveInterval)
+	accessController.StartWindowSweeper(windowSweepInterval)
+	accessController.Redactor, err = common.NewRedactor(redactionRulesFile, redactionKeyFile)
+	if err != nil {
+		log.Fatal("Failed initializing redaction rules:", err)
+	}
+	err = initCapabilities()
+	if err != nil {
+		log.Fatal("Failed initializing capability verification:", err)
+	}
+	err = loadManagedPolicy()
+	if err != nil {
+		log.Fatal("Failed loading managed policy:", err)
+	}
+	if auditFile != "" {
+		auditLog, err = common.NewAuditLog(auditFile, int64(auditMaxSize)<<20, auditMaxBackups)
+		if err != nil {
+			log.Fatal("Failed opening audit log:", err)
+		}
+	}
+	// The reserved core and neighbor roles are given to sources based on the AS's topology and TRC
+	if genFolder != "" {
+		err = accessController.WatchASes(genFolder, local.IA, asRefreshInterval)
+		if err != nil {
+			log.Fatal("Failed loading core and neighboring ASes from the gen folder:", err)
+		}
+	} else {
+		log.Println("No gen folder given, the reserved core and neighbor roles are not assigned")
+	}
 }
 
 func main() {
@@ -208,30 +314,42 @@ func main() {
 		}
 	}
 	SyncPermissions(internalMapping, types.EndpointMappings{})
+	// The local management server isn't running yet, so the own metrics can't be listed by SyncPermissions
+	if selfMapping != "" {
+		accessController.AddRolePermissions("owner", selfMapping, selfMetricNames())
+	}
 	// Register at manager
 	err = SyncManager(internalMapping, types.EndpointMappings{})
 	if err != nil {
 		log.Fatalf("Initial synchronization to manager failed: %v", err)
 	}
+	if managerIP != "" {
+		common.StartHeartbeat(httpsClient, "https://"+managerIP+":"+managerVerifPort+"/endpoints/heartbeat", types.Heartbeat{
+			IA:         local.IA.String(),
+			IP:         endpointIP,
+			ManagePort: managementAPIPort,
+		}, heartbeatInterval)
+		startPolicyPull(policyPullInterval)
+	}
+	// Keep the mappings of the SCION services in the gen folder up to date
+	if discoverServices {
+		err = watchServices(common.ASServicesDir(genFolder, local.IA), asRefreshInterval)
+		if err != nil {
+			log.Fatal("Failed discovering the services in the gen folder:", err)
+		}
+	}
 
 	// HTTPS server
 	go func() {
 		log.Println("Starting HTTPS server")
 
-		srv := common.CreateHttpsServer(caCertsDir, endpointCert, endpointPrivKey, endpointPublicBind, externalPort, &LocalHandler{"HTTPS", localHTTPClient}, tls.RequireAndVerifyClientCert)
+		srv := common.CreateHttpsServer(caCertsDir, endpointCert, endpointPrivKey, endpointPublicBind, externalPort, &LocalHandler{httpsClientType, localHTTPClient}, tls.RequireAndVerifyClientCert)
 
-		log.Fatal("HTTPS server listening error: ", srv.ListenAndServeTLS(endpointCert, endpointPrivKey))
+		log.Fatal("HTTPS server listening error: ", srv.ListenAndServeTLS("", ""))
 	}()
 
 	// SCION server
-	go func() {
-		log.Printf("Starting SCION server")
-		err = shttp.ListenAndServeSCION(strings.Replace(local.String(), " (UDP)", "", 1), endpointCert, endpointPrivKey, &LocalHandler{"SCION HTTPS", localHTTPClient})
-
-		if err != nil {
-			log.Printf("SCION HTTP server listening error: %v", err)
-		}
-	}()
+	go serveSCION(strings.Replace(local.String(), " (UDP)", "", 1), &LocalHandler{scionClientType, localHTTPClient})
 
 	// Management Server
 	router := mux.NewRouter()
@@ -245,6 +363,10 @@ func main() {
 	router.HandleFunc("/access_control", enableAccessControl).Methods("POST")
 	router.HandleFunc("/access_control", disableAccessControl).Methods("DELETE")
 	router.HandleFunc("/sources", listSources).Methods("GET")
+	router.HandleFunc("/patterns", listPatternRoles).Methods("GET")
+	router.HandleFunc("/patterns/roles", addPatternRole).Methods("POST")
+	router.HandleFunc("/patterns/roles", removePatternRole).Methods("DELETE")
+	router.HandleFunc("/{source}/patterns", listSourcePatterns).Methods("GET")
 	router.HandleFunc("/{source}/roles", listSourceRoles).Methods("GET")
 	router.HandleFunc("/{source}/roles", addSourceRole).Methods("POST")
 	router.HandleFunc("/{source}/roles", removeSourceRole).Methods("DELETE")
@@ -257,6 +379,7 @@ func main() {
 	router.HandleFunc("/{source}/{mapping}/frequency", setSourceFrequency).Methods("POST")
 	router.HandleFunc("/{source}/{mapping}/window", removeSourceWindow).Methods("DELETE")
 	router.HandleFunc("/{source}/{mapping}/window", setSourceWindow).Methods("POST")
+	router.HandleFunc("/{source}/{mapping}/explain", explainSource).Methods("GET")
 
 	router.HandleFunc("/roles", listRoles).Methods("GET")
 	router.HandleFunc("/roles", createRole).Methods("POST")
@@ -264,6 +387,20 @@ func main() {
 	router.HandleFunc("/roles/{role}", getRoleInfo).Methods("GET")
 	router.HandleFunc("/roles/{role}/permissions/{mapping}", addRolePermissions).Methods("POST")
 	router.HandleFunc("/roles/{role}/permissions/{mapping}", removeRolePermissions).Methods("DELETE")
+	router.HandleFunc("/roles/{role}/redaction", getRoleRedaction).Methods("GET")
+	router.HandleFunc("/roles/{role}/redaction", setRoleRedaction).Methods("PUT")
+	router.HandleFunc("/roles/{role}/redaction", removeRoleRedaction).Methods("DELETE")
+
+	router.HandleFunc("/capabilities", mintCapability).Methods("POST")
+	router.HandleFunc("/capabilities/revoke", revokeCapability).Methods("POST")
+	router.HandleFunc("/capabilities/revoked", listRevokedCapabilities).Methods("GET")
+
+	router.HandleFunc("/policy", getManagedPolicy).Methods("GET")
+	router.HandleFunc("/policy", putManagedPolicy).Methods("PUT")
+
+	router.HandleFunc("/audit", queryAudit).Methods("GET")
+
+	router.HandleFunc("/metrics", common.SelfMetricsHandler).Methods("GET")
 
 	go func() {
 		srv := &http.Server{
@@ -275,53 +412,227 @@ func main() {
 
 	srv := common.CreateHttpsServer(caCertsDir, endpointCert, endpointPrivKey, endpointPublicBind, managementAPIPort, router, tls.RequireAndVerifyClientCert)
 	log.Println("Starting HTTPS management server")
-	log.Fatal("HTTPS server listening error: ", srv.ListenAndServeTLS(endpointCert, endpointPrivKey))
+	log.Fatal("HTTPS server listening error: ", srv.ListenAndServeTLS("", ""))
+}
+
+var (
+	scionServer        *shttp.Server
+	scionServerMutex   sync.Mutex
+	scionServerRestart = make(chan struct{}, 1)
+)
+
+// Serves handler over SCION on addr until the server fails. When it is closed by restartSCIONServer it listens again,
+// loading the certificate from disk.
+func serveSCION(addr string, handler http.Handler) {
+	for {
+		log.Printf("Starting SCION server")
+		srv := &shttp.Server{AddrString: addr, Handler: handler}
+		scionServerMutex.Lock()
+		scionServer = srv
+		scionServerMutex.Unlock()
+		err := srv.ListenAndServeSCION(endpointCert, endpointPrivKey)
+		select {
+		case <-scionServerRestart:
+			log.Println("Restarting SCION server with the renewed certificate")
+		default:
+			log.Printf("SCION HTTP server listening error: %v", err)
+			return
+		}
+	}
 }
 
+// Closes the SCION server so that serveSCION starts it again with the renewed certificate. Only the SCION listener is
+// restarted: the HTTPS servers already use the new certificate.
+func restartSCIONServer() {
+	scionServerMutex.Lock()
+	defer scionServerMutex.Unlock()
+	if scionServer == nil {
+		return
+	}
+	select {
+	case scionServerRestart <- struct{}{}:
+	default:
+	}
+	err := scionServer.Close()
+	if err != nil {
+		log.Printf("Failed closing SCION server: %v", err)
+		select {
+		case <-scionServerRestart:
+		default:
+		}
+	}
+}
+
+const (
+	httpsClientType = "HTTPS"
+	scionClientType = "SCION HTTPS"
+)
+
 type LocalHandler struct {
 	clientType string
 	client     *http.Client
 }
 
-// Redirects to the right port on localhost based on request path and configured mapping
+// Redirects to the right port on localhost based on request path and configured mapping. Only the metric families
+// the requesting source is allowed to read are returned. Every attempt is recorded in the audit log.
 func (h *LocalHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	log.Printf("Received %s request for path %s", h.clientType, req.URL)
 	// Get path from request
 	path := req.URL.Path
-	// Get internal port from mapping
-	resp, err := LocalhostGet(path, h.client)
+	var chain []types.Capability
+	source, err := requestSource(h.clientType, req)
+	if err != nil {
+		log.Printf("Could not identify source of %s request from %s: %v", h.clientType, req.RemoteAddr, err)
+		err = &common.AuthorizationError{Reason: common.ScrapeNotAuthorized, Message: "Unidentified source: " + err.Error()}
+	} else {
+		// Check that the source may scrape the mapping before contacting the local target, either with a capability
+		// token or according to the policy
+		chain, err = requestCapabilities(req, source, path)
+		if chain == nil && err == nil {
+			err = accessController.Authorized(source, path)
+		}
+	}
+	record := types.AuditRecord{
+		Source:     source,
+		RemoteAddr: req.RemoteAddr,
+		Transport:  h.clientType,
+		Mapping:    path,
+		Capability: capabilityID(chain),
+	}
+	if err != nil {
+		log.Printf("Refused: %s request from %s (%s) to %s%s: %v", h.clientType, req.RemoteAddr, source, req.Host, req.URL, err)
+		countRefusedScrape(path, err)
+		record.Decision, record.Reason = types.AuditRefused, authorizationReason(err)
+		audit(record)
+		writeAuthorizationError(w, err)
+		return
+	}
+	// Get the metrics from the mapped target, shared with concurrent and recent scrapes of the same mapping
+	upstream, err := scrapes.get(path, h.client)
 	if err != nil {
 		log.Printf("Failed: %s request from %s to %s%s. Error is: %v", h.clientType, req.RemoteAddr, req.Host, req.URL, err)
+		scrapesTotal.Inc(mappingLabel(path), "upstream_error")
+		record.Decision, record.Reason = types.AuditFailed, "upstream_error"
+		audit(record)
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
-	// Copy back response
-	io.Copy(w, resp.Body)
-	err = resp.Body.Close()
-	if err != nil {
-		log.Printf("serveHTTP: could not close response's body after copying it for redirection. Error is: %v", err)
+	// Filter metrics
+	metrics := upstream.metrics
+	var filteredMetrics []*common.MetricFamily
+	if chain != nil {
+		filteredMetrics = accessController.FilterMetricsByCapability(chain, path, metrics)
+		filteredMetrics = accessController.RedactMetricsByCapability(chain, source, path, filteredMetrics)
+	} else {
+		filteredMetrics = accessController.FilterMetrics(source, path, metrics)
+		filteredMetrics = accessController.RedactMetrics(source, path, filteredMetrics)
 	}
-	for k, vv := range resp.Header {
+	// Copy back headers, except the ones describing the original body
+	for k, vv := range upstream.header {
+		if k == "Content-Type" || k == "Content-Length" || k == "Content-Encoding" {
+			continue
+		}
 		for _, v := range vv {
 			w.Header().Add(k, v)
 		}
 	}
-	log.Printf("Succeeded: %s request from %s to %s%s", h.clientType, req.RemoteAddr, req.Host, req.URL)
+	w.Header().Set("Content-Type", common.TextFormatContentType)
+	record.Families, record.Total = len(filteredMetrics), len(metrics)
+	record.Bytes, err = common.WriteTextFormat(w, filteredMetrics)
+	if err != nil {
+		log.Printf("Failed: %s request from %s to %s%s. Could not encode metrics: %v", h.clientType, req.RemoteAddr, req.Host, req.URL, err)
+		record.Decision, record.Reason = types.AuditFailed, "write_error"
+		audit(record)
+		return
+	}
+	scrapesTotal.Inc(mappingLabel(path), "ok")
+	record.Decision = types.AuditAllowed
+	audit(record)
+	log.Printf("Succeeded: %s request from %s (%s) to %s%s, returned %d/%d metric families", h.clientType, req.RemoteAddr, source, req.Host, req.URL, len(filteredMetrics), len(metrics))
+}
+
+// Writes the reason for which a scrape was refused in json format: 429 with a Retry-After header if the source
+// scrapes too frequently, 403 otherwise
+func writeAuthorizationError(w http.ResponseWriter, err error) {
+	authErr, ok := err.(*common.AuthorizationError)
+	if !ok {
+		authErr = &common.AuthorizationError{Reason: common.ScrapeNotAuthorized, Message: err.Error()}
+	}
+	jsonErr, _ := json.Marshal(authErr)
+	w.Header().Set("Content-Type", "application/json")
+	if authErr.Reason == common.ScrapeTooFrequent {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(authErr.RetryAfter.Seconds()))))
+		w.WriteHeader(http.StatusTooManyRequests)
+	} else {
+		w.WriteHeader(http.StatusForbidden)
+	}
+	w.Write(jsonErr)
+}
+
+// Returns the reason for which a scrape was refused because of err
+func authorizationReason(err error) string {
+	if authErr, ok := err.(*common.AuthorizationError); ok {
+		return authErr.Reason
+	}
+	return common.ScrapeNotAuthorized
+}
+
+// Returns the source (IA:IP) that sent the request. Over SCION it is taken from the remote address, over HTTPS from the
+// IA and IP the Manager bound into the verified client certificate. A certificate without exactly one of each doesn't
+// identify a source.
+func requestSource(clientType string, req *http.Request) (string, error) {
+	if clientType == scionClientType {
+		remote, err := snet.AddrFromString(strings.Replace(req.RemoteAddr, " (UDP)", "", 1))
+		if err != nil {
+			return "", err
+		}
+		return remote.IA.String() + ":" + remote.Host.L3.IP().String(), nil
+	}
+	if req.TLS == nil || len(req.TLS.PeerCertificates) == 0 {
+		return "", errors.New("no client certificate")
+	}
+	cert := req.TLS.PeerCertificates[0]
+	if len(cert.IPAddresses) != 1 {
+		return "", fmt.Errorf("client certificate has %d IP addresses instead of one", len(cert.IPAddresses))
+	}
+	ia, err := common.IAFromURIs(cert.URIs)
+	if err != nil {
+		return "", fmt.Errorf("client certificate doesn't identify the IA: %v", err)
+	}
+	return ia.String() + ":" + cert.IPAddresses[0].String(), nil
 }
 
 func LocalhostGet(path string, client *http.Client) (*http.Response, error) {
-	// Make HTTP GET request to mapped target on localhost
+	// Make HTTP GET request to the upstream of the mapped target
 	reloadMappingsMutex.Lock()
-	internalPort := internalMapping[path]
+	mapping, ok := internalMapping[path]
 	reloadMappingsMutex.Unlock()
-	resp, err := client.Get("http://" + endpointLocalTarget + ":" + internalPort + "/metrics")
+	if !ok {
+		return nil, errors.New("no mapping for path " + path)
+	}
+	req, err := upstreamRequest(mapping)
+	if err != nil {
+		return nil, err
+	}
+	client, err = upstreamClient(mapping, client)
+	if err != nil {
+		return nil, err
+	}
+	url := req.URL.String()
+	start := time.Now()
+	resp, err := client.Do(req)
+	upstreamDuration.ObserveSince(start, path)
 	if err != nil {
 		log.Println("Error while contacting local target: ", err)
+		upstreamRequests.Inc(path, "error")
 		return nil, err
 	}
 	if resp.StatusCode != http.StatusOK {
-		log.Println("Status code", resp.StatusCode, "instead of 200 from", "http://"+endpointLocalTarget+":"+internalPort+path)
-		return nil, err
+		log.Println("Status code", resp.StatusCode, "instead of 200 from", url)
+		upstreamRequests.Inc(path, "error")
+		resp.Body.Close()
+		return nil, fmt.Errorf("status code %d from %s", resp.StatusCode, url)
 	}
+	upstreamRequests.Inc(path, "ok")
 	return resp, nil
 }
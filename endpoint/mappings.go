@@ -2,17 +2,23 @@ package main
 
 import (
 	"bytes"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"regexp"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/netsec-ethz/2SMS/common"
 	"github.com/netsec-ethz/2SMS/common/types"
 )
 
+// Loads the mappings from mappings.json. Files written before mappings had more than path and port are loaded as well.
 func LoadMappings() (types.EndpointMappings, error) {
 	dat, err := ioutil.ReadFile("mappings.json")
 	if err != nil {
@@ -24,21 +30,105 @@ func LoadMappings() (types.EndpointMappings, error) {
 	}
 	tmpMapping := make(types.EndpointMappings)
 	for _, mapping := range list {
-		tmpMapping[mapping.Path] = mapping.Port
+		if err := mapping.Validate(); err != nil {
+			return nil, fmt.Errorf("mapping %s: %v", mapping.Path, err)
+		}
+		tmpMapping[mapping.Path] = mapping
 	}
 	return tmpMapping, nil
 }
 
 func SaveMappings(mappings types.EndpointMappings) error {
 	var list []types.Mapping
-	for k, v := range mappings {
-		list = append(list, types.Mapping{Path: k, Port: v})
+	for _, v := range mappings {
+		list = append(list, v)
 	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Path < list[j].Path })
 	bytes, err := json.Marshal(list)
 	if err != nil {
 		return err
 	}
-	return ioutil.WriteFile("mappings.json", bytes, 0644)
+	// May contain basic auth passwords
+	return ioutil.WriteFile("mappings.json", bytes, 0600)
+}
+
+// Transports of the mappings with TLS settings, by path. Built on first use and dropped when the mapping changes.
+var mappingTransports = make(map[string]*http.Transport)
+
+// Returns the request for the metrics at the upstream of mapping
+func upstreamRequest(mapping types.Mapping) (*http.Request, error) {
+	req, err := http.NewRequest("GET", mapping.URL(endpointLocalTarget), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", acceptHeader)
+	if auth := mapping.BasicAuth; auth != nil {
+		password := auth.Password
+		if auth.PasswordFile != "" {
+			bts, err := ioutil.ReadFile(auth.PasswordFile)
+			if err != nil {
+				return nil, fmt.Errorf("reading password of %s: %v", mapping.Path, err)
+			}
+			password = strings.TrimSpace(string(bts))
+		}
+		req.SetBasicAuth(auth.Username, password)
+	}
+	return req, nil
+}
+
+// Returns client with the TLS settings and the timeout of mapping applied
+func upstreamClient(mapping types.Mapping, client *http.Client) (*http.Client, error) {
+	if mapping.TLS == nil && mapping.Timeout == "" {
+		return client, nil
+	}
+	upstream := *client
+	if mapping.Timeout != "" {
+		timeout, err := time.ParseDuration(mapping.Timeout)
+		if err != nil {
+			return nil, err
+		}
+		upstream.Timeout = timeout
+	}
+	if mapping.TLS != nil {
+		reloadMappingsMutex.Lock()
+		defer reloadMappingsMutex.Unlock()
+		transport, ok := mappingTransports[mapping.Path]
+		if !ok {
+			config, err := upstreamTLSConfig(mapping.TLS)
+			if err != nil {
+				return nil, fmt.Errorf("TLS settings of %s: %v", mapping.Path, err)
+			}
+			transport = &http.Transport{TLSClientConfig: config}
+			mappingTransports[mapping.Path] = transport
+		}
+		upstream.Transport = transport
+	}
+	return &upstream, nil
+}
+
+func upstreamTLSConfig(settings *types.MappingTLS) (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName:         settings.ServerName,
+		InsecureSkipVerify: settings.InsecureSkipVerify,
+	}
+	if settings.CAFile != "" {
+		bts, err := ioutil.ReadFile(settings.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(bts) {
+			return nil, fmt.Errorf("no certificates in %s", settings.CAFile)
+		}
+	}
+	if settings.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(settings.CertFile, settings.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
 }
 
 func UpdateMappings(newMapping types.Mapping) error {
@@ -51,8 +141,10 @@ func UpdateMappingBatch(mappings []types.Mapping) (types.EndpointMappings, error
 	defer reloadMappingsMutex.Unlock()
 	added := types.EndpointMappings{}
 	for _, m := range mappings {
-		internalMapping[m.Path] = m.Port
-		added[m.Path] = m.Port
+		internalMapping[m.Path] = m
+		added[m.Path] = m
+		delete(mappingTransports, m.Path)
+		scrapes.forget(m.Path)
 	}
 	return added, SaveMappings(internalMapping)
 }
@@ -66,6 +158,8 @@ func RemoveMappingBatch(pathsToRemove []string) error {
 	defer reloadMappingsMutex.Unlock()
 	for _, p := range pathsToRemove {
 		delete(internalMapping, p)
+		delete(mappingTransports, p)
+		scrapes.forget(p)
 	}
 	return SaveMappings(internalMapping)
 }
@@ -96,6 +190,8 @@ func RemoveMappingRegexpBatch(pathsToRemove []string) (types.EndpointMappings, e
 			log.Printf("Removed %s\n", s)
 			removed[s] = internalMapping[s]
 			delete(internalMapping, s)
+			delete(mappingTransports, s)
+			scrapes.forget(s)
 		}
 	}
 	return removed, SaveMappings(internalMapping)
@@ -149,8 +245,12 @@ func SyncManager(addMappings, delMappings types.EndpointMappings) error {
 	}
 
 	// Add all addMappings:
-	for mapping := range addMappings {
-		paths = append(paths, mapping)
+	labels := make(map[string]map[string]string)
+	for path, mapping := range addMappings {
+		paths = append(paths, path)
+		if targetLabels := mapping.TargetLabels(); len(targetLabels) > 0 {
+			labels[path] = targetLabels
+		}
 	}
 	data, err := json.Marshal(types.Endpoint{
 		IA:         local.IA.String(),
@@ -158,6 +258,7 @@ func SyncManager(addMappings, delMappings types.EndpointMappings) error {
 		ScrapePort: fmt.Sprint(local.Host.L4.Port()),
 		ManagePort: managementAPIPort,
 		Paths:      paths,
+		Labels:     labels,
 	})
 	if err != nil {
 		return fmt.Errorf("Failed marshalling Endpoint struct: %v", err)
@@ -190,16 +291,14 @@ func SyncManager(addMappings, delMappings types.EndpointMappings) error {
 }
 
 func GetMetricsInfoForMapping(mapping string, client *http.Client) []*MetricInfo {
-	resp, err := LocalhostGet(mapping, client)
+	upstream, err := scrapes.get(mapping, client)
 	if err != nil {
 		return []*MetricInfo{}
 	}
-	// Parse response body to metric families
-	metrics := DecodeResponseBody(resp)
 	// Keep only name, type and help fields
-	metricsInfo := make([]*MetricInfo, len(metrics))
-	for i, metric := range metrics {
-		metricsInfo[i] = &MetricInfo{*metric.Name, metric.Type.String(), *metric.Help}
+	metricsInfo := make([]*MetricInfo, len(upstream.metrics))
+	for i, metric := range upstream.metrics {
+		metricsInfo[i] = &MetricInfo{metric.GetName(), metric.GetType().String(), metric.GetHelp()}
 	}
 	return metricsInfo
 }
@@ -9,6 +9,13 @@ import (
 	"net/http"
 )
 
+// Accept header sent to exporters. The delimited protobuf format is preferred, followed by OpenMetrics and the text
+// format (version 0.0.4) that is also assumed when no (or an unknown) content type is returned.
+const acceptHeader = "application/vnd.google.protobuf;proto=io.prometheus.client.MetricFamily;encoding=delimited;q=0.8," +
+	"application/openmetrics-text;version=0.0.1;q=0.7," +
+	"text/plain;version=0.0.4;q=0.5," +
+	"*/*;q=0.1"
+
 // Taken from: prom2json.ParseResponse
 func DecodeResponseBody(resp *http.Response) []*common.MetricFamily {
 	metrics := []*common.MetricFamily{}
@@ -19,27 +26,28 @@ func DecodeResponseBody(resp *http.Response) []*common.MetricFamily {
 		for {
 			mf := &common.MetricFamily{}
 			if _, err = pbutil.ReadDelimited(resp.Body, mf); err != nil {
-				if err == io.EOF {
-					break
+				if err != io.EOF {
+					log.Printf("MetricsParser: reading metric family protocol buffer failed: %v", err)
 				}
-				//return fmt.Errorf("reading metric family protocol buffer failed: %v", err)
+				break
 			}
 			metrics = append(metrics, mf)
 		}
+	} else if err == nil && mediaType == "application/openmetrics-text" {
+		metrics, err = common.ParseOpenMetrics(resp.Body)
+		if err != nil {
+			log.Printf("MetricsParser: reading OpenMetrics format failed: %v", err)
+			return []*common.MetricFamily{}
+		}
 	} else {
-		// TODO: removing these prometheus dependencies seems quite hard so for the moment just don't support the fallback
-		log.Printf("MetricsParser: %s Media Type is not supported, decoding failed.", mediaType)
-		//	// We could do further content-type checks here, but the
-		//	// fallback for now will anyway be the text format
-		//	// version 0.0.4, so just go for it and see if it works.
-		//	var parser expfmt.TextParser
-		//	metricFamilies, err := parser.TextToMetricFamilies(resp.Body)
-		//	if err != nil {
-		//		//return fmt.Errorf("reading text format failed: %v", err)
-		//	}
-		//	for _, mf := range metricFamilies {
-		//		metrics = append(metrics, mf)
-		//	}
+		// We could do further content-type checks here, but the
+		// fallback for now will anyway be the text format
+		// version 0.0.4, so just go for it and see if it works.
+		metrics, err = common.ParseTextFormat(resp.Body)
+		if err != nil {
+			log.Printf("MetricsParser: reading text format (media type %s) failed: %v", mediaType, err)
+			return []*common.MetricFamily{}
+		}
 	}
 	return metrics
 }
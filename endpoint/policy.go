@@ -0,0 +1,331 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/netsec-ethz/2SMS/common"
+	"github.com/netsec-ethz/2SMS/common/types"
+	"github.com/pkg/errors"
+)
+
+// Returned when a policy older than the applied one is received, e.g. because a pull raced a push
+var errStalePolicy = errors.New("policy is older than the applied one")
+
+var (
+	managedPolicyFile  string
+	managedPolicy      types.Policy // Last policy received from the manager and applied
+	managedPolicyMutex = &sync.Mutex{}
+	policyPullInterval time.Duration
+)
+
+// Loads the last applied managed policy, so that it can be replaced by the next one
+func loadManagedPolicy() error {
+	if !common.FileExists(managedPolicyFile) {
+		return nil
+	}
+	bts, err := ioutil.ReadFile(managedPolicyFile)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(bts, &managedPolicy)
+}
+
+// Replaces the currently applied managed policy with policy. Roles, bindings and timing rules that were added locally
+// and aren't part of either policy are left untouched. Policies older than the applied one are refused with
+// errStalePolicy.
+func applyManagedPolicy(policy types.Policy) error {
+	for _, rule := range policy.Timing {
+		if rule.Window != nil {
+			if _, err := common.NewWindow(*rule.Window); err != nil {
+				return errors.Wrapf(err, "window of %s on %s", rule.Subject, rule.Mapping)
+			}
+		}
+		if rule.Frequency != "" {
+			if _, err := time.ParseDuration(rule.Frequency); err != nil {
+				return errors.Wrapf(err, "frequency of %s on %s", rule.Subject, rule.Mapping)
+			}
+		}
+	}
+	managedPolicyMutex.Lock()
+	defer managedPolicyMutex.Unlock()
+	if policy.Version < managedPolicy.Version ||
+		(policy.Version == managedPolicy.Version && policy.OverrideVersion < managedPolicy.OverrideVersion) {
+		log.Printf("Refused managed policy version %d (override %d), version %d (override %d) is applied",
+			policy.Version, policy.OverrideVersion, managedPolicy.Version, managedPolicy.OverrideVersion)
+		return errStalePolicy
+	}
+	if policy.Version == managedPolicy.Version && policy.OverrideVersion == managedPolicy.OverrideVersion {
+		return nil
+	}
+	old := managedPolicy
+
+	// Roles
+	newRoles := make(map[string]types.Role)
+	for _, role := range policy.Roles {
+		newRoles[role.Name] = role
+	}
+	for _, role := range old.Roles {
+		newRole, ok := newRoles[role.Name]
+		if !ok {
+			accessController.DeleteRole(role.Name)
+			continue
+		}
+		for mapping, perms := range role.Permissions {
+			removed := []string{}
+			for _, perm := range perms {
+				if !contains(newRole.Permissions[mapping], perm) {
+					removed = append(removed, perm)
+				}
+			}
+			accessController.RemoveRolePermissions(role.Name+"_role", mapping, removed)
+		}
+	}
+	for _, role := range policy.Roles {
+		accessController.CreateRole(role)
+	}
+
+	// Bindings
+	newBindings := make(map[types.RoleBinding]bool)
+	for _, binding := range policy.Bindings {
+		newBindings[binding] = true
+	}
+	for _, binding := range old.Bindings {
+		if !newBindings[binding] {
+			unbindRole(binding)
+		}
+	}
+	for _, binding := range policy.Bindings {
+		if err := bindRole(binding); err != nil {
+			log.Printf("Managed policy: failed binding role %s to %s: %v", binding.Role, binding.Subject, err)
+		}
+	}
+
+	// Timing rules
+	oldTiming := make(map[string]types.TimingRule)
+	for _, rule := range old.Timing {
+		oldTiming[rule.Subject+" "+rule.Mapping] = rule
+	}
+	for _, rule := range policy.Timing {
+		oldRule, ok := oldTiming[rule.Subject+" "+rule.Mapping]
+		delete(oldTiming, rule.Subject+" "+rule.Mapping)
+		if !ok || rule.Frequency != oldRule.Frequency {
+			if rule.Frequency != "" {
+				// Checked when the policy was validated
+				accessController.AddTimingPermission(rule.Subject, rule.Mapping, "frequency", rule.Frequency)
+			} else {
+				accessController.DeleteTimingPermission(rule.Subject, rule.Mapping, "frequency")
+			}
+		}
+		if !ok || !sameWindow(rule.Window, oldRule.Window) {
+			if rule.Window != nil {
+				window, _ := common.NewWindow(*rule.Window)
+				accessController.AddWindowPermission(rule.Subject, rule.Mapping, window)
+			} else {
+				accessController.DeleteTimingPermission(rule.Subject, rule.Mapping, "window")
+			}
+		}
+	}
+	for _, rule := range oldTiming {
+		accessController.DeleteTimingPermission(rule.Subject, rule.Mapping, "frequency")
+		accessController.DeleteTimingPermission(rule.Subject, rule.Mapping, "window")
+	}
+
+	bts, err := json.Marshal(policy)
+	if err != nil {
+		return err
+	}
+	if err = common.WriteFileAtomic(managedPolicyFile, bts, 0600); err != nil {
+		return errors.Wrap(err, "writing managed policy")
+	}
+	managedPolicy = policy
+	log.Printf("Applied managed policy version %d (override %d)", policy.Version, policy.OverrideVersion)
+	return nil
+}
+
+func bindRole(binding types.RoleBinding) error {
+	if common.IsSourcePattern(binding.Subject) {
+		return accessController.AddPatternRole(binding.Subject, binding.Role)
+	}
+	return accessController.AddRole(binding.Subject, binding.Role)
+}
+
+func unbindRole(binding types.RoleBinding) {
+	if common.IsSourcePattern(binding.Subject) {
+		accessController.RemovePatternRole(binding.Subject, binding.Role)
+	} else {
+		accessController.RemoveRole(binding.Subject, binding.Role)
+	}
+}
+
+func sameWindow(a, b *types.Window) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the differences between the applied managed policy and the current state of the access controller, e.g.
+// because of local changes or expired windows
+func managedPolicyDrift() []string {
+	managedPolicyMutex.Lock()
+	policy := managedPolicy
+	managedPolicyMutex.Unlock()
+	drift := []string{}
+	for _, role := range policy.Roles {
+		info := accessController.GetRoleInfo(role.Name)
+		for mapping, perms := range role.Permissions {
+			for _, perm := range perms {
+				if info == nil || !contains(info.Permissions[mapping], perm) {
+					drift = append(drift, "role "+role.Name+" is missing permission "+perm+" on "+mapping)
+				}
+			}
+		}
+		if info == nil {
+			continue
+		}
+		for mapping, perms := range info.Permissions {
+			for _, perm := range perms {
+				if !contains(role.Permissions[mapping], perm) {
+					drift = append(drift, "role "+role.Name+" has additional permission "+perm+" on "+mapping)
+				}
+			}
+		}
+	}
+	patternRoles := accessController.GetPatternRoles()
+	for _, binding := range policy.Bindings {
+		var roles []string
+		if common.IsSourcePattern(binding.Subject) {
+			roles = patternRoles[binding.Subject]
+		} else {
+			roles = accessController.GetRoles(binding.Subject)
+		}
+		if !contains(roles, binding.Role) {
+			drift = append(drift, binding.Subject+" is missing role "+binding.Role)
+		}
+	}
+	for _, rule := range policy.Timing {
+		perms := accessController.GetPermissionsForObject(rule.Subject, rule.Mapping)
+		if rule.Frequency != "" && !contains(perms, "frequency:"+rule.Frequency) {
+			drift = append(drift, rule.Subject+" has no frequency "+rule.Frequency+" on "+rule.Mapping)
+		}
+		if rule.Window != nil {
+			window, _ := common.NewWindow(*rule.Window)
+			current := accessController.GetWindow(rule.Subject, rule.Mapping)
+			if current == nil || current.String() != window.String() {
+				drift = append(drift, rule.Subject+" has no window "+window.String()+" on "+rule.Mapping)
+			}
+		}
+	}
+	sort.Strings(drift)
+	return drift
+}
+
+// Fetches the policy for this endpoint from the manager and applies it if it changed
+func pullManagedPolicy() error {
+	resp, err := httpsClient.Get("https://" + managerIP + ":" + managerVerifPort + "/endpoints/policy")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("status code %d", resp.StatusCode)
+	}
+	var policy types.Policy
+	if err = json.NewDecoder(resp.Body).Decode(&policy); err != nil {
+		return errors.Wrap(err, "decoding policy")
+	}
+	return applyManagedPolicy(policy)
+}
+
+// Pulls the managed policy every interval, so that pushes missed while offline are caught up
+func startPolicyPull(interval time.Duration) {
+	go func() {
+		for {
+			if err := pullManagedPolicy(); err != nil {
+				log.Println("Failed pulling policy from the manager:", err)
+			}
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// Returns the version of the applied managed policy and how the current policy diverges from it.
+func getManagedPolicy(w http.ResponseWriter, r *http.Request) {
+	managedPolicyMutex.Lock()
+	status := types.PolicyStatus{Version: managedPolicy.Version, OverrideVersion: managedPolicy.OverrideVersion}
+	managedPolicyMutex.Unlock()
+	status.Drift = managedPolicyDrift()
+	jsonStatus, err := json.Marshal(status)
+	if err != nil {
+		log.Println("Error while marshalling json:", err)
+		w.WriteHeader(500)
+		return
+	}
+	w.Write(jsonStatus)
+}
+
+// Applies the policy pushed by the manager. Only the manager and local requests may set it.
+func putManagedPolicy(w http.ResponseWriter, r *http.Request) {
+	if !fromManagerOrLocal(r) {
+		log.Printf("Rejected policy from %s: not the manager", r.RemoteAddr)
+		w.WriteHeader(403)
+		return
+	}
+	var policy types.Policy
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Println("Error while reading request body:", err)
+		w.WriteHeader(500)
+		return
+	}
+	err = json.Unmarshal(data, &policy)
+	if err != nil {
+		log.Println("Error while unmarshalling json:", err)
+		w.WriteHeader(400)
+		return
+	}
+	err = applyManagedPolicy(policy)
+	if err == errStalePolicy {
+		w.WriteHeader(409)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if err != nil {
+		log.Println("Failed applying managed policy:", err)
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	w.WriteHeader(204)
+}
+
+// Whether the request comes from the localhost management server or with a Manager certificate
+func fromManagerOrLocal(r *http.Request) bool {
+	if r.TLS == nil {
+		return true
+	}
+	if len(r.TLS.PeerCertificates) == 0 {
+		return false
+	}
+	for _, ou := range r.TLS.PeerCertificates[0].Subject.OrganizationalUnit {
+		if ou == "Manager" {
+			return true
+		}
+	}
+	return false
+}
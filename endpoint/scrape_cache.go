@@ -0,0 +1,112 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/netsec-ethz/2SMS/common"
+)
+
+// Metrics fetched from the upstream of a mapping. They are shared by all scrapes served from the cache and must not be
+// modified.
+type upstreamMetrics struct {
+	metrics []*common.MetricFamily
+	header  http.Header
+	fetched time.Time
+}
+
+// Fetch of the metrics of a mapping in progress, waited for by all concurrent scrapes of the mapping
+type upstreamFetch struct {
+	done   chan struct{}
+	result *upstreamMetrics
+	err    error
+}
+
+// Caches the metrics of each mapping for a short time and coalesces concurrent fetches, so that scrapes arriving
+// together, e.g. from replicated scrapers, cause a single request to the upstream. Failed fetches aren't cached.
+type scrapeCache struct {
+	ttl      time.Duration // Zero disables caching, concurrent fetches are still coalesced
+	mutex    sync.Mutex
+	entries  map[string]*upstreamMetrics
+	inflight map[string]*upstreamFetch
+}
+
+func newScrapeCache(ttl time.Duration) *scrapeCache {
+	return &scrapeCache{
+		ttl:      ttl,
+		entries:  make(map[string]*upstreamMetrics),
+		inflight: make(map[string]*upstreamFetch),
+	}
+}
+
+// Returns the metrics of the mapping at path, from the cache if fresh enough, otherwise fetched with client
+func (c *scrapeCache) get(path string, client *http.Client) (*upstreamMetrics, error) {
+	c.mutex.Lock()
+	if entry, ok := c.entries[path]; ok && time.Since(entry.fetched) < c.ttl {
+		c.mutex.Unlock()
+		scrapeCacheRequests.Inc("hit")
+		return entry, nil
+	}
+	if fetch, ok := c.inflight[path]; ok {
+		c.mutex.Unlock()
+		scrapeCacheRequests.Inc("coalesced")
+		<-fetch.done
+		return fetch.result, fetch.err
+	}
+	fetch := &upstreamFetch{done: make(chan struct{})}
+	c.inflight[path] = fetch
+	c.mutex.Unlock()
+
+	scrapeCacheRequests.Inc("fetched")
+	fetch.result, fetch.err = fetchUpstreamMetrics(path, client)
+	c.mutex.Lock()
+	// Not cached if the mapping changed during the fetch
+	if c.inflight[path] == fetch {
+		delete(c.inflight, path)
+		if fetch.err == nil && c.ttl > 0 {
+			c.entries[path] = fetch.result
+		}
+	}
+	c.mutex.Unlock()
+	close(fetch.done)
+	return fetch.result, fetch.err
+}
+
+// Drops the cached metrics of the mapping at path because the mapping changed. Fetches in progress are no longer
+// joined by new scrapes.
+func (c *scrapeCache) forget(path string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.entries, path)
+	delete(c.inflight, path)
+}
+
+// Drops the expired entries every interval, so that removed mappings don't keep their metrics in memory
+func (c *scrapeCache) startSweeping(interval time.Duration) {
+	go func() {
+		for range time.NewTicker(interval).C {
+			c.mutex.Lock()
+			for path, entry := range c.entries {
+				if time.Since(entry.fetched) >= c.ttl {
+					delete(c.entries, path)
+				}
+			}
+			c.mutex.Unlock()
+		}
+	}()
+}
+
+func fetchUpstreamMetrics(path string, client *http.Client) (*upstreamMetrics, error) {
+	resp, err := LocalhostGet(path, client)
+	if err != nil {
+		return nil, err
+	}
+	metrics := DecodeResponseBody(resp)
+	err = resp.Body.Close()
+	if err != nil {
+		log.Printf("fetchUpstreamMetrics: could not close response's body after decoding it. Error is: %v", err)
+	}
+	return &upstreamMetrics{metrics: metrics, header: resp.Header, fetched: time.Now()}, nil
+}
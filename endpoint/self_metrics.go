@@ -0,0 +1,41 @@
+package main
+
+import (
+	"github.com/netsec-ethz/2SMS/common"
+)
+
+// Metrics about the endpoint itself, served at /metrics by the management API and scraped through selfMapping
+var (
+	selfMapping          string
+	scrapesTotal         = common.NewCounterVec("twosms_endpoint_scrapes_total", "Scrapes received, by mapping and result (ok, refused or upstream_error).", "mapping", "result")
+	authorizationDenials = common.NewCounterVec("twosms_endpoint_authorization_denials_total", "Scrapes refused, by mapping and reason.", "mapping", "reason")
+	upstreamRequests     = common.NewCounterVec("twosms_endpoint_upstream_requests_total", "Requests to the targets of the mappings, by mapping and result (ok or error).", "mapping", "result")
+	upstreamDuration     = common.NewHistogramVec("twosms_endpoint_upstream_request_duration_seconds", "Duration of the requests to the targets of the mappings.", common.DurationBuckets, "mapping")
+	scrapeCacheRequests  = common.NewCounterVec("twosms_endpoint_scrape_cache_requests_total", "Metrics of mappings requested from the scrape cache, by result (hit, coalesced or fetched).", "result")
+)
+
+// Returns path if it is a mapping, so that requests for arbitrary paths don't create new series
+func mappingLabel(path string) string {
+	reloadMappingsMutex.Lock()
+	defer reloadMappingsMutex.Unlock()
+	if _, ok := internalMapping[path]; ok {
+		return path
+	}
+	return "unknown"
+}
+
+// Counts a scrape refused because of err
+func countRefusedScrape(path string, err error) {
+	label := mappingLabel(path)
+	scrapesTotal.Inc(label, "refused")
+	authorizationDenials.Inc(label, authorizationReason(err))
+}
+
+// Returns the names of the endpoint's own metrics, which the owner role may read on selfMapping
+func selfMetricNames() []string {
+	names := []string{}
+	for _, family := range common.SelfMetrics.Gather() {
+		names = append(names, family.GetName())
+	}
+	return names
+}
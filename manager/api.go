@@ -10,6 +10,7 @@ import (
 	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"strings"
 	"time"
@@ -19,74 +20,210 @@ import (
 	"github.com/netsec-ethz/2SMS/common/types"
 )
 
-// Requires a CSR, verifies it's validity and, if it is allowed, generates and returns a certificate.
+// Requires a CSR, verifies it's validity and, if it is allowed, generates and returns a certificate. A request is
+// allowed if it comes with a valid enrollment token for the component or if signing is enabled, otherwise it is
+// queued for the approval of the administrator.
 func requestCert(w http.ResponseWriter, r *http.Request) {
 	log.Printf("Received certificate request.")
-	if refuseSigning {
-		log.Printf("Rejected certificate request from %s: signing is blocked\n", r.Host)
-		w.WriteHeader(401)
-		w.Write([]byte("Certificate request is blocked. Contact the administrator."))
-		return
-	}
 	// Process csr in the request's body
-	data, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		w.WriteHeader(400)
-		log.Println("Failed reading body", err)
-		return
-	}
-	csrBytes := make([]byte, len(data))
-	dec, err := base64.StdEncoding.Decode(csrBytes, data)
+	csr, err := readCSR(r)
 	if err != nil {
-		w.WriteHeader(400)
-		log.Println("Failed decoding body", err)
-		return
-	}
-	csrBytes = csrBytes[:dec]
-	pemBlock, _ := pem.Decode(csrBytes)
-	if pemBlock == nil {
-		log.Println("Failed decoding csr:", err)
-		w.WriteHeader(400)
-		return
-	}
-	csr, err := x509.ParseCertificateRequest(pemBlock.Bytes)
-	if err != nil {
-		log.Println("Failed parsing csr:", err)
-		w.WriteHeader(400)
+		writeCSRError(w, r, err)
 		return
 	}
 
 	ip := csr.IPAddresses[0].String()
-	OU := csr.Subject.OrganizationalUnit
-	crtFile := approvedCertsDir + "/" + OU[0] + "_" + ip + ".crt"
+	OU := csr.Subject.OrganizationalUnit[0]
+	ia, _ := common.IAFromURIs(csr.URIs) // Checked by the CSR policy
+	crtFile := approvedCertsDir + "/" + OU + "_" + ip + ".crt"
 	// If certificate for csr already exists, just return it
+	reissue := false
 	if common.FileExists(crtFile) {
-		log.Printf("Certificate for %s already exists\n", ip)
-		byts, _ := ioutil.ReadFile(crtFile)
-		// Encode it to base64 and write it to the response buffer
-		data := make([]byte, base64.StdEncoding.EncodedLen(len(byts)))
-		base64.StdEncoding.Encode(data, byts)
-		w.Write(data)
+		cached, err := common.ReadCertFromPEMFile(crtFile)
+		if err == nil && cached != nil && hasIA(cached, ia.String()) {
+			log.Printf("Certificate for %s already exists\n", ip)
+			byts, _ := ioutil.ReadFile(crtFile)
+			// Encode it to base64 and write it to the response buffer
+			data := make([]byte, base64.StdEncoding.EncodedLen(len(byts)))
+			base64.StdEncoding.Encode(data, byts)
+			w.Write(data)
+			return
+		}
+		// Certificates issued before the IA was bound into them, or for another IA, are replaced. The component
+		// doesn't have to enroll again if the registry knows it in the IA of the csr.
+		log.Printf("Certificate for %s exists without IA %s, replacing it\n", ip, ia)
+		reissue = isRegisteredIn(OU, ip, ia.String())
+	}
+
+	if reissue {
+		log.Printf("%s %s is registered in IA %s, reissuing its certificate\n", OU, ip, ia)
+	} else if token := r.Header.Get(types.EnrollmentTokenHeader); token != "" {
+		valid, err := enrollmentTokens.consume(token, OU, ip, ia.String())
+		if err != nil {
+			log.Println("Failed consuming enrollment token:", err)
+			w.WriteHeader(500)
+			return
+		}
+		if !valid {
+			log.Printf("Rejected certificate request for %s %s from %s: invalid enrollment token\n", OU, ip, r.RemoteAddr)
+			w.WriteHeader(403)
+			w.Write([]byte("Invalid enrollment token."))
+			return
+		}
+	} else if refuseSigning {
+		if isRejected(OU, ip) {
+			log.Printf("Rejected certificate request for %s %s from %s: request was rejected\n", OU, ip, r.RemoteAddr)
+			w.WriteHeader(403)
+			w.Write([]byte("Certificate request was rejected. Contact the administrator."))
+			return
+		}
+		err = queueCertRequest(csr, OU, ip, ia.String(), r.RemoteAddr)
+		if err != nil {
+			log.Println("Failed queueing certificate request:", err)
+			w.WriteHeader(500)
+			return
+		}
+		log.Printf("Certificate request for %s %s from %s is waiting for approval\n", OU, ip, r.RemoteAddr)
+		w.WriteHeader(202)
+		w.Write([]byte("Certificate request is waiting for approval."))
 		return
 	}
 
-	// TODO: add some sort of verification (e.g. registration token)
 	// Create new certificate
-	certBytes, err := ca.GenCertFromCSR(csr, &common.Duration{1, 0, 0})
+	certPEM, err := issueCert(csr, crtFile)
 	if err != nil {
 		log.Println("Failed generating certificate:", err)
 		w.WriteHeader(400)
 		return
 	}
-	common.WriteToPEMFile(crtFile, "CERTIFICATE", certBytes)
 	log.Printf("Successfully generated new certificate for %s %s\n", OU, ip)
-	byts, _ := ioutil.ReadFile(crtFile)
 	// Encode it to base64 and write it to the response buffer
-	data = make([]byte, base64.StdEncoding.EncodedLen(len(byts)))
-	base64.StdEncoding.Encode(data, byts)
+	data := make([]byte, base64.StdEncoding.EncodedLen(len(certPEM)))
+	base64.StdEncoding.Encode(data, certPEM)
 	w.Write(data)
 }
 
+// Requires a CSR from a component authenticated with its current certificate and returns a new certificate for it.
+// The CSR must be for the same type, IP and IA as the certificate used to authenticate.
+func renewCert(w http.ResponseWriter, r *http.Request) {
+	log.Printf("Received certificate renewal request.")
+	csr, err := readCSR(r)
+	if err != nil {
+		writeCSRError(w, r, err)
+		return
+	}
+	ip := csr.IPAddresses[0].String()
+	OU := csr.Subject.OrganizationalUnit[0]
+	if !peerIs(r, OU, ip) {
+		log.Printf("Rejected certificate renewal for %s %s from %s: certificate doesn't match", OU, ip, r.RemoteAddr)
+		w.WriteHeader(403)
+		return
+	}
+	// Certificates issued before the IA was bound into them get the IA of the csr if the registry knows the
+	// component in it
+	ia, _ := common.IAFromURIs(csr.URIs)
+	peerCert := r.TLS.PeerCertificates[0]
+	if len(peerCert.URIs) == 0 {
+		if !isRegisteredIn(OU, ip, ia.String()) {
+			log.Printf("Rejected certificate renewal for %s %s from %s: not registered in IA %s", OU, ip, r.RemoteAddr, ia)
+			w.WriteHeader(403)
+			return
+		}
+	} else if !hasIA(peerCert, ia.String()) {
+		log.Printf("Rejected certificate renewal for %s %s from %s: IA %s doesn't match the certificate", OU, ip, r.RemoteAddr, ia)
+		w.WriteHeader(403)
+		return
+	}
+	// Replace the approved certificate, so that it can be downloaded again
+	certPEM, err := issueCert(csr, approvedCertsDir+"/"+OU+"_"+ip+".crt")
+	if err != nil {
+		log.Println("Failed generating certificate:", err)
+		w.WriteHeader(500)
+		return
+	}
+	log.Printf("Successfully renewed certificate for %s %s\n", OU, ip)
+	data := make([]byte, base64.StdEncoding.EncodedLen(len(certPEM)))
+	base64.StdEncoding.Encode(data, certPEM)
+	w.Write(data)
+}
+
+// Returns whether cert carries exactly the IA ia
+func hasIA(cert *x509.Certificate, ia string) bool {
+	certIA, err := common.IAFromURIs(cert.URIs)
+	return err == nil && certIA.String() == ia
+}
+
+// Returns whether the registry knows the component of type OU with ip in ia
+func isRegisteredIn(OU, ip, ia string) bool {
+	registered := false
+	registry.View(func(data *RegistryData) {
+		switch OU {
+		case endpointKind:
+			for _, end := range data.Endpoints {
+				registered = registered || end.IP == ip && end.IA == ia
+			}
+		case scraperKind:
+			for _, scr := range data.Scrapers {
+				registered = registered || scr.IP == ip && scr.IA == ia
+			}
+		case storageKind:
+			for _, str := range data.Storages {
+				registered = registered || str.IP == ip && str.IA == ia
+			}
+		}
+	})
+	return registered
+}
+
+// Reads the base64 encoded, PEM CSR in the request's body and checks it against the CSR policy. The returned error,
+// if any, is a *common.CSRPolicyError.
+func readCSR(r *http.Request) (*x509.CertificateRequest, error) {
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, &common.CSRPolicyError{Code: common.CSRMalformed, Message: err.Error()}
+	}
+	csrBytes := make([]byte, base64.StdEncoding.DecodedLen(len(data)))
+	dec, err := base64.StdEncoding.Decode(csrBytes, data)
+	if err != nil {
+		return nil, &common.CSRPolicyError{Code: common.CSRMalformed, Message: "invalid base64: " + err.Error()}
+	}
+	pemBlock, _ := pem.Decode(csrBytes[:dec])
+	if pemBlock == nil || pemBlock.Type != "CERTIFICATE REQUEST" {
+		return nil, &common.CSRPolicyError{Code: common.CSRMalformed, Message: "no CERTIFICATE REQUEST PEM block found"}
+	}
+	csr, err := x509.ParseCertificateRequest(pemBlock.Bytes)
+	if err != nil {
+		return nil, &common.CSRPolicyError{Code: common.CSRMalformed, Message: err.Error()}
+	}
+	remoteIP, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		remoteIP = r.RemoteAddr
+	}
+	err = csrPolicy.Check(csr, remoteIP)
+	if err != nil {
+		return nil, err
+	}
+	return csr, nil
+}
+
+// Writes the reason for which a CSR was refused in json format
+func writeCSRError(w http.ResponseWriter, r *http.Request, err error) {
+	log.Printf("Refused csr from %s: %v", r.RemoteAddr, err)
+	policyErr, ok := err.(*common.CSRPolicyError)
+	if !ok {
+		policyErr = &common.CSRPolicyError{Code: common.CSRMalformed, Message: err.Error()}
+	}
+	jsonErr, _ := json.Marshal(policyErr)
+	w.Header().Set("Content-Type", "application/json")
+	switch policyErr.Code {
+	case common.CSRInvalidOU, common.CSRIPMismatch:
+		w.WriteHeader(403)
+	default:
+		w.WriteHeader(400)
+	}
+	w.Write(jsonErr)
+}
+
 // Returns the certificate for the requesting entity (if it exists).
 func getCert(w http.ResponseWriter, r *http.Request) {
 	log.Println("Certificate get received")
@@ -108,24 +245,32 @@ func getCert(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// Returns the list of all registered endpoints.
+// Returns the list of all registered endpoints together with their liveness.
 func listEndpoints(w http.ResponseWriter, r *http.Request) {
 	log.Println("List endpoints received")
-	jsonEnds, err := ioutil.ReadFile("endpoints.json")
+	ends := []endpointStatus{}
+	for _, end := range getEndpoints() {
+		ends = append(ends, endpointStatus{end, liveness.get(endpointKind, end.IP, end.ManagePort)})
+	}
+	jsonEnds, err := json.Marshal(ends)
 	if err != nil {
-		log.Println("Error while reading file:", err)
+		log.Println("Error while marshalling json:", err)
 		w.WriteHeader(500)
 		return
 	}
 	w.Write(jsonEnds)
 }
 
-// Returns the list of all registered scrapers.
+// Returns the list of all registered scrapers together with their liveness.
 func listScrapers(w http.ResponseWriter, r *http.Request) {
 	log.Println("List scrapers received")
-	jsonScrs, err := ioutil.ReadFile("scrapers.json")
+	scrs := []scraperStatus{}
+	for _, scr := range getScrapers() {
+		scrs = append(scrs, scraperStatus{scr, liveness.get(scraperKind, scr.IP, scr.ManagePort)})
+	}
+	jsonScrs, err := json.Marshal(scrs)
 	if err != nil {
-		log.Println("Error while reading file:", err)
+		log.Println("Error while marshalling json:", err)
 		w.WriteHeader(500)
 		return
 	}
@@ -158,6 +303,19 @@ func notifyAddedMapping(w http.ResponseWriter, r *http.Request) {
 	w.Write(jsonScrapers)
 }
 
+var fanoutRequests = common.NewCounterVec("twosms_manager_fanout_requests_total", "Requests sent by the manager to the other components to propagate changes, by method and result (ok, rejected or error).", "method", "result")
+
+// Counts a request sent to another component, rejected if it answered with a non-2xx status code
+func countFanout(method string, resp *http.Response, err error) {
+	if err != nil {
+		fanoutRequests.Inc(method, "error")
+	} else if resp.StatusCode/100 != 2 {
+		fanoutRequests.Inc(method, "rejected")
+	} else {
+		fanoutRequests.Inc(method, "ok")
+	}
+}
+
 // byts is the json binary encoding of target, used just to avoid encoding/decoding multiple times
 func addTargetToScrapers(target *types.Target, byts []byte) []types.Scraper {
 	addedTo := []types.Scraper{}
@@ -174,6 +332,7 @@ func addTargetToScrapers(target *types.Target, byts []byte) []types.Scraper {
 // byts is the json binary encoding of the target, used just to avoid encoding/decoding multiple times
 func addTargetToScraper(byts []byte, scraper *types.Scraper) {
 	resp, err := httpsClient.Post("https://"+scraper.IP+":"+scraper.ManagePort+"/targets", "application/json", bytes.NewReader(byts))
+	countFanout("POST", resp, err)
 	if err != nil {
 		log.Println("Error in adding scraper target:", err)
 		return
@@ -191,6 +350,7 @@ func notifyRemovedMapping(w http.ResponseWriter, r *http.Request) {
 	for _, scr := range getScrapers() {
 		req, err := http.NewRequest("DELETE", "https://"+scr.IP+":"+scr.ManagePort+"/targets", r.Body)
 		resp, err := httpsClient.Do(req)
+		countFanout("DELETE", resp, err)
 		if err != nil {
 			log.Println("Error in removing scraper target:", err)
 			continue
@@ -220,11 +380,26 @@ func registerEndpoint(w http.ResponseWriter, r *http.Request) {
 	}
 	err = addEndpoint(&end)
 	if err != nil {
-		w.WriteHeader(400)
+		log.Println("Error registering endpoint:", err)
+		w.WriteHeader(500)
 		return
 	}
+	liveness.seen(endpointKind, end.IP, end.ManagePort, "")
 
-	scrapersToAuthorize := []types.Scraper{}
+	scrapersToAuthorize := addEndpointTargets(&end)
+	// Return addresses of scrapers for authorization purposes
+	jsonScrapers, err := json.Marshal(scrapersToAuthorize)
+	if err != nil {
+		log.Println("Failed marshaling json:", err)
+		w.WriteHeader(500)
+		return
+	}
+	w.Write(jsonScrapers)
+}
+
+// Returns the scrape targets for all paths of the endpoint
+func endpointTargets(end *types.Endpoint) []types.Target {
+	targets := []types.Target{}
 	for _, path := range end.Paths {
 		// Build target endpoint's path
 		target := types.Target{}
@@ -234,22 +409,16 @@ func registerEndpoint(w http.ResponseWriter, r *http.Request) {
 		target.Path = path
 		target.Port = end.ScrapePort
 		target.Labels = make(map[string]string)
+		for name, value := range end.Labels[path] {
+			target.Labels[name] = value
+		}
 		target.Labels["AS"] = target.AS
 		target.Labels["ISD"] = target.ISD
 		target.Labels["service"] = target.Path[1:] // Assumes path is of the form `/<service-name>`
 		target.Name = target.Path[1:]
-		jsonBytes, _ := json.Marshal(target) // TODO: handle error
-
-		scrapersToAuthorize = addTargetToScrapers(&target, jsonBytes)
+		targets = append(targets, target)
 	}
-	// Return addresses of scrapers for authorization purposes
-	jsonScrapers, err := json.Marshal(scrapersToAuthorize)
-	if err != nil {
-		log.Println("Failed marshaling json:", err)
-		w.WriteHeader(500)
-		return
-	}
-	w.Write(jsonScrapers)
+	return targets
 }
 
 // TODO: test
@@ -272,6 +441,7 @@ func removeEndpoint(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(400)
 		return
 	}
+	liveness.forget(endpointKind, end.IP, end.ManagePort)
 
 	// Get all Enpoint's targets
 	resp, err := httpsClient.Get("https://" + end.IP + ":" + end.ManagePort + "/mappings")
@@ -340,9 +510,12 @@ func registerScraper(w http.ResponseWriter, r *http.Request) {
 	}
 	err = addScraper(&scr)
 	if err != nil {
+		log.Println("Error registering scraper:", err)
 		w.WriteHeader(500)
 		return
 	}
+	liveness.seen(scraperKind, scr.IP, scr.ManagePort, "")
+	go assignStoragesToScraper(&scr)
 	w.WriteHeader(204)
 }
 
@@ -365,6 +538,8 @@ func removeScraper(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(500)
 		return
 	}
+	liveness.forget(scraperKind, scr.IP, scr.ManagePort)
+	go unauthorizeScraperAtStorages(&scr)
 	// Get scraper targets
 	resp, err := httpsClient.Get("https://" + scr.IP + ":" + scr.ManagePort + "/targets")
 	if err != nil {
@@ -408,16 +583,20 @@ func removeScraper(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// Returns the list of all registered scrapers.
+// Returns the list of all registered storages together with their liveness.
 func listStorages(w http.ResponseWriter, r *http.Request) {
 	log.Println("List storages received")
-	jsonScrs, err := ioutil.ReadFile("storages.json")
+	strs := []storageStatus{}
+	for _, str := range getStorages() {
+		strs = append(strs, storageStatus{str, liveness.get(storageKind, str.IP, str.ManagePort)})
+	}
+	jsonStrs, err := json.Marshal(strs)
 	if err != nil {
-		log.Println("Error while reading file:", err)
-		w.WriteHeader(400)
+		log.Println("Error while marshalling json:", err)
+		w.WriteHeader(500)
 		return
 	}
-	w.Write(jsonScrs)
+	w.Write(jsonStrs)
 }
 
 func registerStorage(w http.ResponseWriter, r *http.Request) {
@@ -436,9 +615,12 @@ func registerStorage(w http.ResponseWriter, r *http.Request) {
 	}
 	err = addStorage(&str)
 	if err != nil {
-		w.WriteHeader(400)
+		log.Println("Error registering storage:", err)
+		w.WriteHeader(500)
 		return
 	}
+	liveness.seen(storageKind, str.IP, str.ManagePort, "")
+	go assignStorageToScrapers(&str)
 	w.WriteHeader(204)
 }
 
@@ -461,6 +643,20 @@ func removeStorage(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(400)
 		return
 	}
+	liveness.forget(storageKind, str.IP, str.ManagePort)
+	go unassignStorage(&str)
+	w.WriteHeader(204)
+}
+
+// Replaces the registered components with the ones in the JSON lists (endpoints.json, scrapers.json and
+// storages.json) in the working directory.
+func importRegistry(w http.ResponseWriter, r *http.Request) {
+	err := registry.Import(".")
+	if err != nil {
+		log.Println("Error importing registry:", err)
+		w.WriteHeader(500)
+		return
+	}
 	w.WriteHeader(204)
 }
 
@@ -580,26 +776,8 @@ func syncScraperTargets(w http.ResponseWriter, r *http.Request) {
 	// Try adding targets for each endpoint to the scraper
 	for _, end := range endpoints {
 		targetISD := strings.Split(end.IA, "-")[0]
-		targetAS := strings.Split(end.IA, "-")[1]
-		labels := make(map[string]string)
-		labels["ISD"] = targetISD
-		labels["AS"] = targetAS
 		if scraper.Covers(targetISD) {
-			// Build generic target for all target on `end`
-			target := types.Target{
-				"",
-				targetISD,
-				targetAS,
-				end.IP,
-				end.ScrapePort,
-				"",
-				labels,
-			}
-			for _, path := range end.Paths {
-				// Add specific path and name infos
-				target.Name = path[1:]
-				target.Path = path
-				labels["service"] = target.Name
+			for _, target := range endpointTargets(&end) {
 				// Encode target to json
 				jsonTarget, _ := json.Marshal(target) // TODO: handle error
 				// Add target to scraper
@@ -641,6 +819,9 @@ func syncScraperTargets(w http.ResponseWriter, r *http.Request) {
 func redirect(w http.ResponseWriter, r *http.Request) {
 	// Redirection call path are defined to have /component/address as prefix
 	redirAddr := "https://" + strings.SplitN(r.URL.Path, "/", 3)[2]
+	if r.URL.RawQuery != "" {
+		redirAddr += "?" + r.URL.RawQuery
+	}
 	var resp *http.Response
 	defer func() {
 		if resp == nil {
@@ -0,0 +1,526 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/netsec-ethz/2SMS/common"
+	"github.com/netsec-ethz/2SMS/common/types"
+	"github.com/pkg/errors"
+	"github.com/scionproto/scion/go/lib/addr"
+)
+
+// Requests of sources from other ASes for permissions on the endpoints of this AS, persisted in a file. Anyone can
+// file requests, so the number of pending ones is limited, in total and by the host they come from.
+type permissionRequestStore struct {
+	file           string
+	requests       map[string]types.PermissionRequest // By ID
+	maxPending     int
+	maxHostPending int
+	mutex          sync.Mutex
+}
+
+func newPermissionRequestStore(file string, maxPending, maxHostPending int) (*permissionRequestStore, error) {
+	ps := &permissionRequestStore{
+		file:           file,
+		requests:       make(map[string]types.PermissionRequest),
+		maxPending:     maxPending,
+		maxHostPending: maxHostPending,
+	}
+	if common.FileExists(file) {
+		bts, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, errors.Wrap(err, "reading permission requests")
+		}
+		err = json.Unmarshal(bts, &ps.requests)
+		if err != nil {
+			return nil, errors.Wrap(err, "decoding permission requests")
+		}
+	}
+	return ps, nil
+}
+
+// Persists the request and makes it the current one with its ID. Must be called with the lock held.
+func (ps *permissionRequestStore) save(req types.PermissionRequest) error {
+	requests := make(map[string]types.PermissionRequest)
+	for id, r := range ps.requests {
+		requests[id] = r
+	}
+	requests[req.ID] = req
+	bts, err := json.Marshal(requests)
+	if err != nil {
+		return err
+	}
+	err = common.WriteFileAtomic(ps.file, bts, 0600)
+	if err != nil {
+		return errors.Wrap(err, "writing permission requests")
+	}
+	ps.requests = requests
+	return nil
+}
+
+func (ps *permissionRequestStore) add(req types.PermissionRequest) (types.PermissionRequest, error) {
+	random := make([]byte, 8)
+	_, err := rand.Read(random)
+	if err != nil {
+		return req, err
+	}
+	req.ID = hex.EncodeToString(random)
+	req.Status = types.PermissionRequestPending
+	req.Received = time.Now()
+	req.Decided = nil
+	req.Comment = ""
+	req.Granted = nil
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	pending, hostPending := 0, 0
+	for _, r := range ps.requests {
+		if r.Status == types.PermissionRequestPending {
+			pending++
+			if remoteHost(r.RemoteAddr) == remoteHost(req.RemoteAddr) {
+				hostPending++
+			}
+		}
+	}
+	if pending >= ps.maxPending || hostPending >= ps.maxHostPending {
+		return req, errTooManyPermissionRequests
+	}
+	return req, ps.save(req)
+}
+
+func remoteHost(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return remoteAddr
+	}
+	return host
+}
+
+func (ps *permissionRequestStore) get(id string) (types.PermissionRequest, bool) {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	req, ok := ps.requests[id]
+	return req, ok
+}
+
+// Returns the requests with the given status, or all of them if status is empty, oldest first
+func (ps *permissionRequestStore) list(status string) []types.PermissionRequest {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	requests := []types.PermissionRequest{}
+	for _, req := range ps.requests {
+		if status == "" || req.Status == status {
+			requests = append(requests, req)
+		}
+	}
+	sort.Slice(requests, func(i, j int) bool { return requests[i].Received.Before(requests[j].Received) })
+	return requests
+}
+
+// Moves the request from one of the states in from to the state to, calling apply before. The request is left
+// unchanged if apply fails.
+func (ps *permissionRequestStore) decide(id string, from []string, to string, apply func(*types.PermissionRequest) error) (types.PermissionRequest, error) {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	req, ok := ps.requests[id]
+	if !ok {
+		return req, errPermissionRequestNotFound
+	}
+	if !contains(from, req.Status) {
+		return req, errors.Wrapf(errPermissionRequestState, "request %s is %s", id, req.Status)
+	}
+	if err := apply(&req); err != nil {
+		return req, err
+	}
+	now := time.Now()
+	req.Status, req.Decided = to, &now
+	return req, ps.save(req)
+}
+
+var (
+	errPermissionRequestNotFound = errors.New("no such permission request")
+	errPermissionRequestState    = errors.New("permission request can't be decided in its state")
+	errTooManyPermissionRequests = errors.New("too many pending permission requests")
+)
+
+// Name of the role holding the permissions granted by the request on the endpoint
+func permissionRequestRole(req *types.PermissionRequest) string {
+	return "request_" + req.ID
+}
+
+// Checks that the request targets mappings of a registered endpoint and has valid constraints
+func validatePermissionRequest(req *types.PermissionRequest) error {
+	if err := validateSource(req.Source); err != nil {
+		return err
+	}
+	end := getEndpointByIP(req.Endpoint)
+	if end == nil {
+		return errors.Errorf("no registered endpoint %s", req.Endpoint)
+	}
+	if len(req.Permissions) == 0 {
+		return errors.New("no mapping requested")
+	}
+	for mapping := range req.Permissions {
+		if !contains(end.Paths, mapping) {
+			return errors.Errorf("endpoint %s has no mapping %s", req.Endpoint, mapping)
+		}
+	}
+	return validateConstraints(req.Frequency, req.Window)
+}
+
+func validateConstraints(frequency string, window *types.Window) error {
+	if frequency != "" {
+		if d, err := time.ParseDuration(frequency); err != nil || d <= 0 {
+			return errors.Errorf("invalid frequency %q", frequency)
+		}
+	}
+	if window != nil {
+		if _, err := common.NewWindow(*window); err != nil {
+			return errors.Wrap(err, "invalid window")
+		}
+	}
+	return nil
+}
+
+// Checks that source is of the form IA:IP
+func validateSource(source string) error {
+	i := strings.LastIndex(source, ":")
+	if i < 0 || net.ParseIP(source[i+1:]) == nil {
+		return errors.Errorf("invalid source %q, expected ISD-AS:IP", source)
+	}
+	if _, err := addr.IAFromString(source[:i]); err != nil {
+		return errors.Wrapf(err, "invalid source %q", source)
+	}
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Gets the JSON document at url and decodes it into v
+func getJSON(url string, v interface{}) error {
+	resp, err := httpsClient.Get(url)
+	countFanout("GET", resp, err)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return errors.Errorf("status code %d", resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// Returns the frequency and window permissions of source on the endpoint at base, by mapping
+func sourceTimingPermissions(base, source string) (frequencies, windows map[string]string, err error) {
+	var perms map[string][]string
+	if err = getJSON(base+"/"+source+"/permissions", &perms); err != nil {
+		return nil, nil, err
+	}
+	frequencies, windows = make(map[string]string), make(map[string]string)
+	for mapping, mappingPerms := range perms {
+		for _, perm := range mappingPerms {
+			if strings.HasPrefix(perm, "frequency:") {
+				frequencies[mapping] = strings.TrimPrefix(perm, "frequency:")
+			} else if strings.HasPrefix(perm, "window:") {
+				windows[mapping] = strings.TrimPrefix(perm, "window:")
+			}
+		}
+	}
+	return frequencies, windows, nil
+}
+
+// Grants the permissions of the request on its endpoint: a role with scrape permission and the requested metrics
+// (or the mapping's owner role if all metrics were requested) is bound to the source, and the frequency and window
+// are set on each mapping. What was changed is recorded in req.Granted.
+func grantRequestedPermissions(req *types.PermissionRequest) error {
+	end := getEndpointByIP(req.Endpoint)
+	if end == nil {
+		return errors.Errorf("endpoint %s is not registered anymore", req.Endpoint)
+	}
+	base := "https://" + end.IP + ":" + end.ManagePort
+	var bound []string
+	if err := getJSON(base+"/"+req.Source+"/roles", &bound); err != nil {
+		return errors.Wrap(err, "reading roles of the source")
+	}
+	frequencies, windows, err := sourceTimingPermissions(base, req.Source)
+	if err != nil {
+		return errors.Wrap(err, "reading permissions of the source")
+	}
+	granted := &types.GrantedPermissions{
+		Role:        permissionRequestRole(req),
+		Frequencies: make(map[string]string),
+		Windows:     make(map[string]string),
+	}
+	role := types.Role{Name: granted.Role, Permissions: make(map[string][]string)}
+	roles := []string{role.Name}
+	for mapping, metrics := range req.Permissions {
+		role.Permissions[mapping] = append([]string{common.ScrapePermission}, metrics...)
+		if len(metrics) == 0 {
+			roles = append(roles, mapping[1:]+"_"+common.OwnerRole)
+		}
+	}
+	jsonRole, err := json.Marshal(role)
+	if err != nil {
+		return err
+	}
+	if err = sendJSON("POST", base+"/roles", jsonRole); err != nil {
+		return errors.Wrap(err, "creating role")
+	}
+	for _, name := range roles {
+		jsonName, _ := json.Marshal(name)
+		if err = sendJSON("POST", base+"/"+req.Source+"/roles", jsonName); err != nil {
+			return errors.Wrapf(err, "binding role %s", name)
+		}
+		if name != role.Name && !contains(bound, name) {
+			granted.OwnerRoles = append(granted.OwnerRoles, name)
+		}
+	}
+	for mapping := range req.Permissions {
+		if req.Frequency != "" {
+			jsonFrequency, _ := json.Marshal(req.Frequency)
+			if err = sendJSON("POST", base+"/"+req.Source+mapping+"/frequency", jsonFrequency); err != nil {
+				return errors.Wrapf(err, "setting frequency on %s", mapping)
+			}
+			granted.Frequencies[mapping] = frequencies[mapping]
+		}
+		if req.Window != nil {
+			jsonWindow, _ := json.Marshal(req.Window)
+			if err = sendJSON("POST", base+"/"+req.Source+mapping+"/window", jsonWindow); err != nil {
+				return errors.Wrapf(err, "setting window on %s", mapping)
+			}
+			granted.Windows[mapping] = windows[mapping]
+		}
+	}
+	req.Granted = granted
+	return nil
+}
+
+// Undoes the changes recorded when the request was approved on its endpoint. Owner roles the source had already are
+// kept, and frequencies and windows are set back to the previous ones unless they were changed since.
+func revokeGrantedPermissions(req *types.PermissionRequest) error {
+	end := getEndpointByIP(req.Endpoint)
+	if end == nil {
+		// The endpoint's policy was removed together with it
+		return nil
+	}
+	base := "https://" + end.IP + ":" + end.ManagePort
+	if err := sendJSON("DELETE", base+"/roles/"+permissionRequestRole(req), nil); err != nil {
+		return errors.Wrap(err, "deleting role")
+	}
+	granted := req.Granted
+	if granted == nil {
+		// Approved before the changes were recorded, only the role is known to come from the request
+		log.Printf("Permission request %s has no record of its changes, only its role was removed", req.ID)
+		return nil
+	}
+	for _, name := range granted.OwnerRoles {
+		jsonName, _ := json.Marshal(name)
+		if err := sendJSON("DELETE", base+"/"+req.Source+"/roles", jsonName); err != nil {
+			return errors.Wrapf(err, "removing role %s", name)
+		}
+	}
+	frequencies, windows, err := sourceTimingPermissions(base, req.Source)
+	if err != nil {
+		return errors.Wrap(err, "reading permissions of the source")
+	}
+	for mapping, previous := range granted.Frequencies {
+		if frequencies[mapping] != req.Frequency {
+			continue
+		}
+		if previous == "" {
+			err = sendJSON("DELETE", base+"/"+req.Source+mapping+"/frequency", nil)
+		} else {
+			jsonFrequency, _ := json.Marshal(previous)
+			err = sendJSON("POST", base+"/"+req.Source+mapping+"/frequency", jsonFrequency)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "restoring frequency on %s", mapping)
+		}
+	}
+	if req.Window == nil {
+		return nil
+	}
+	set, err := common.NewWindow(*req.Window)
+	if err != nil {
+		return errors.Wrap(err, "invalid window")
+	}
+	for mapping, previous := range granted.Windows {
+		if windows[mapping] != set.String() {
+			continue
+		}
+		if previous == "" {
+			err = sendJSON("DELETE", base+"/"+req.Source+mapping+"/window", nil)
+		} else {
+			var window *common.Window
+			if window, err = common.ParseWindow(previous); err == nil {
+				jsonWindow, _ := json.Marshal(window.Spec())
+				err = sendJSON("POST", base+"/"+req.Source+mapping+"/window", jsonWindow)
+			}
+		}
+		if err != nil {
+			return errors.Wrapf(err, "restoring window on %s", mapping)
+		}
+	}
+	return nil
+}
+
+func readPermissionRequestDecision(r *http.Request) (*types.PermissionRequestDecision, error) {
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	var decision types.PermissionRequestDecision
+	err = json.Unmarshal(data, &decision)
+	if err != nil {
+		return nil, err
+	}
+	return &decision, nil
+}
+
+func writePermissionRequest(w http.ResponseWriter, req types.PermissionRequest, err error) {
+	switch errors.Cause(err) {
+	case nil:
+		writeJSON(w, req)
+	case errPermissionRequestNotFound:
+		w.WriteHeader(404)
+	case errPermissionRequestState:
+		w.WriteHeader(409)
+		w.Write([]byte(err.Error()))
+	default:
+		log.Printf("Failed deciding permission request %s: %v", req.ID, err)
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+	}
+}
+
+// Files a request for permissions on an endpoint of this AS, to be approved by the administrator.
+func requestPermission(w http.ResponseWriter, r *http.Request) {
+	log.Printf("Received permission request from %s", r.RemoteAddr)
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Println("Error reading request body:", err)
+		w.WriteHeader(400)
+		return
+	}
+	var req types.PermissionRequest
+	if err = json.Unmarshal(data, &req); err != nil {
+		log.Println("Error unmarshalling json:", err)
+		w.WriteHeader(400)
+		return
+	}
+	if err = validatePermissionRequest(&req); err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	req.RemoteAddr = r.RemoteAddr
+	req, err = permRequests.add(req)
+	if err == errTooManyPermissionRequests {
+		log.Printf("Refused permission request from %s: %v", r.RemoteAddr, err)
+		w.WriteHeader(429)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if err != nil {
+		log.Println("Failed storing permission request:", err)
+		w.WriteHeader(500)
+		return
+	}
+	w.WriteHeader(202)
+	jsonReq, _ := json.Marshal(req)
+	w.Write(jsonReq)
+}
+
+// Returns the request with the given ID, so that the requester can follow it.
+func getPermissionRequest(w http.ResponseWriter, r *http.Request) {
+	req, ok := permRequests.get(mux.Vars(r)["id"])
+	if !ok {
+		w.WriteHeader(404)
+		return
+	}
+	writeJSON(w, req)
+}
+
+// Returns the permission requests, optionally filtered by status.
+func listPermissionRequests(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, permRequests.list(r.URL.Query().Get("status")))
+}
+
+// Approves a pending request and grants its permissions on the endpoint.
+func approvePermissionRequest(w http.ResponseWriter, r *http.Request) {
+	decision, err := readPermissionRequestDecision(r)
+	if err != nil {
+		log.Println("Error reading decision:", err)
+		w.WriteHeader(400)
+		return
+	}
+	if err = validateConstraints(decision.Frequency, decision.Window); err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	log.Printf("Approving permission request %s", decision.ID)
+	req, err := permRequests.decide(decision.ID, []string{types.PermissionRequestPending}, types.PermissionRequestApproved,
+		func(req *types.PermissionRequest) error {
+			if decision.Frequency != "" {
+				req.Frequency = decision.Frequency
+			}
+			if decision.Window != nil {
+				req.Window = decision.Window
+			}
+			req.Comment = decision.Comment
+			return grantRequestedPermissions(req)
+		})
+	writePermissionRequest(w, req, err)
+}
+
+// Rejects a pending request.
+func rejectPermissionRequest(w http.ResponseWriter, r *http.Request) {
+	decision, err := readPermissionRequestDecision(r)
+	if err != nil {
+		log.Println("Error reading decision:", err)
+		w.WriteHeader(400)
+		return
+	}
+	log.Printf("Rejecting permission request %s", decision.ID)
+	req, err := permRequests.decide(decision.ID, []string{types.PermissionRequestPending}, types.PermissionRequestRejected,
+		func(req *types.PermissionRequest) error {
+			req.Comment = decision.Comment
+			return nil
+		})
+	writePermissionRequest(w, req, err)
+}
+
+// Revokes the permissions granted by an approved request.
+func revokePermissionRequest(w http.ResponseWriter, r *http.Request) {
+	decision, err := readPermissionRequestDecision(r)
+	if err != nil {
+		log.Println("Error reading decision:", err)
+		w.WriteHeader(400)
+		return
+	}
+	log.Printf("Revoking permission request %s", decision.ID)
+	req, err := permRequests.decide(decision.ID, []string{types.PermissionRequestApproved}, types.PermissionRequestRevoked,
+		func(req *types.PermissionRequest) error {
+			req.Comment = decision.Comment
+			return revokeGrantedPermissions(req)
+		})
+	writePermissionRequest(w, req, err)
+}
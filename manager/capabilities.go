@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/netsec-ethz/2SMS/common"
+	"github.com/netsec-ethz/2SMS/common/types"
+)
+
+// Mints a capability token signed by the CA, accepted by every endpoint trusting it.
+func mintCapability(w http.ResponseWriter, r *http.Request) {
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Println("Error reading request body:", err)
+		w.WriteHeader(400)
+		return
+	}
+	var capability types.Capability
+	if err = json.Unmarshal(data, &capability); err != nil {
+		log.Println("Error unmarshalling json:", err)
+		w.WriteHeader(400)
+		return
+	}
+	if capability.ID == "" {
+		if capability.ID, err = common.NewCapabilityID(); err != nil {
+			w.WriteHeader(500)
+			return
+		}
+	}
+	token, err := ca.MintCapability(capability)
+	if err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	log.Printf("Minted capability %s for %q on %s until %s", capability.ID, capability.Subject, capability.Endpoint, capability.Expires.Format(time.RFC3339))
+	w.WriteHeader(201)
+	writeJSON(w, types.CapabilityResponse{Capability: capability, Token: token})
+}
+
+// Revokes a capability on all registered endpoints and returns the ones where it failed.
+func revokeCapability(w http.ResponseWriter, r *http.Request) {
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Println("Error reading request body:", err)
+		w.WriteHeader(400)
+		return
+	}
+	var revocation types.CapabilityRevocation
+	if err = json.Unmarshal(data, &revocation); err != nil || revocation.ID == "" {
+		log.Println("Error unmarshalling json:", err)
+		w.WriteHeader(400)
+		return
+	}
+	log.Printf("Revoking capability %s", revocation.ID)
+	jsonRevocation, _ := json.Marshal(revocation)
+	failures := make(map[string]string)
+	for _, end := range getEndpoints() {
+		err = sendJSON("POST", "https://"+end.IP+":"+end.ManagePort+"/capabilities/revoke", jsonRevocation)
+		if err != nil {
+			log.Printf("Failed revoking capability %s on endpoint %s: %v", revocation.ID, end.IP, err)
+			failures[end.IP] = err.Error()
+		}
+	}
+	writeJSON(w, failures)
+}
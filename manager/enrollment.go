@@ -0,0 +1,347 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/netsec-ethz/2SMS/common"
+	"github.com/netsec-ethz/2SMS/common/types"
+	"github.com/pkg/errors"
+	"github.com/scionproto/scion/go/lib/addr"
+)
+
+// One-time enrollment tokens, persisted in a file
+type tokenStore struct {
+	file   string
+	tokens []types.EnrollmentToken
+	mutex  sync.Mutex
+}
+
+func newTokenStore(file string) (*tokenStore, error) {
+	ts := &tokenStore{file: file, tokens: []types.EnrollmentToken{}}
+	if common.FileExists(file) {
+		bts, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, errors.Wrap(err, "reading enrollment tokens")
+		}
+		err = json.Unmarshal(bts, &ts.tokens)
+		if err != nil {
+			return nil, errors.Wrap(err, "decoding enrollment tokens")
+		}
+	}
+	return ts, nil
+}
+
+// Persists tokens (dropping the expired ones) and makes them the current ones. Must be called with the lock held.
+func (ts *tokenStore) save(tokens []types.EnrollmentToken) error {
+	valid := []types.EnrollmentToken{}
+	for _, token := range tokens {
+		if time.Now().Before(token.Expires) {
+			valid = append(valid, token)
+		}
+	}
+	bts, err := json.Marshal(valid)
+	if err != nil {
+		return err
+	}
+	err = common.WriteFileAtomic(ts.file, bts, 0600)
+	if err != nil {
+		return errors.Wrap(err, "writing enrollment tokens")
+	}
+	ts.tokens = valid
+	return nil
+}
+
+func (ts *tokenStore) create(typ, ip, ia string, ttl time.Duration) (types.EnrollmentToken, error) {
+	random := make([]byte, 16)
+	_, err := rand.Read(random)
+	if err != nil {
+		return types.EnrollmentToken{}, err
+	}
+	token := types.EnrollmentToken{Token: hex.EncodeToString(random), Type: typ, IP: ip, IA: ia, Expires: time.Now().Add(ttl)}
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+	return token, ts.save(append(append([]types.EnrollmentToken{}, ts.tokens...), token))
+}
+
+// Removes the token if it is valid for the given type, ip and ia and returns whether it was
+func (ts *tokenStore) consume(token, typ, ip, ia string) (bool, error) {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+	remaining := []types.EnrollmentToken{}
+	found := false
+	for _, t := range ts.tokens {
+		if !found && subtle.ConstantTimeCompare([]byte(t.Token), []byte(token)) == 1 &&
+			t.Type == typ && t.IP == ip && (t.IA == "" || t.IA == ia) && time.Now().Before(t.Expires) {
+			found = true
+			continue
+		}
+		remaining = append(remaining, t)
+	}
+	if !found {
+		return false, nil
+	}
+	return true, ts.save(remaining)
+}
+
+func (ts *tokenStore) list() []types.EnrollmentToken {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+	tokens := []types.EnrollmentToken{}
+	for _, token := range ts.tokens {
+		if time.Now().Before(token.Expires) {
+			tokens = append(tokens, token)
+		}
+	}
+	return tokens
+}
+
+// Pending certificate requests are stored in waitingCSRDir as <type>_<ip>.csr, together with their metadata in
+// <type>_<ip>.json. A rejected request leaves a <type>_<ip>.rejected marker until a token is issued for the component.
+var pendingMutex sync.Mutex
+
+func pendingFile(typ, ip, ext string) string {
+	return waitingCSRDir + "/" + typ + "_" + ip + ext
+}
+
+// Adds the csr to the pending requests, replacing an older one for the same component
+func queueCertRequest(csr *x509.CertificateRequest, typ, ip, ia, remoteAddr string) error {
+	pendingMutex.Lock()
+	defer pendingMutex.Unlock()
+	meta, err := json.Marshal(types.PendingCertRequest{
+		Type:       typ,
+		IP:         ip,
+		IA:         ia,
+		DNSNames:   csr.DNSNames,
+		RemoteAddr: remoteAddr,
+		Received:   time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	err = common.WriteFileAtomic(pendingFile(typ, ip, ".csr"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csr.Raw}), 0600)
+	if err != nil {
+		return err
+	}
+	return common.WriteFileAtomic(pendingFile(typ, ip, ".json"), meta, 0600)
+}
+
+func isRejected(typ, ip string) bool {
+	return common.FileExists(pendingFile(typ, ip, ".rejected"))
+}
+
+func listPendingRequests() ([]types.PendingCertRequest, error) {
+	pendingMutex.Lock()
+	defer pendingMutex.Unlock()
+	files, err := ioutil.ReadDir(waitingCSRDir)
+	if err != nil {
+		return nil, err
+	}
+	requests := []types.PendingCertRequest{}
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+		bts, err := ioutil.ReadFile(waitingCSRDir + "/" + file.Name())
+		if err != nil {
+			return nil, err
+		}
+		var req types.PendingCertRequest
+		err = json.Unmarshal(bts, &req)
+		if err != nil {
+			log.Printf("Skipping invalid pending request %s: %v", file.Name(), err)
+			continue
+		}
+		requests = append(requests, req)
+	}
+	return requests, nil
+}
+
+// Removes the pending request of the component, returning its csr. If reject is set, further requests of the
+// component are refused.
+func takePendingRequest(typ, ip string, reject bool) (*x509.CertificateRequest, error) {
+	pendingMutex.Lock()
+	defer pendingMutex.Unlock()
+	csr, err := common.ReadCSRFromPEMFile(pendingFile(typ, ip, ".csr"))
+	if err != nil || csr == nil {
+		return nil, errors.Errorf("no pending request for %s %s", typ, ip)
+	}
+	if reject {
+		err = ioutil.WriteFile(pendingFile(typ, ip, ".rejected"), []byte(time.Now().Format(time.RFC3339)), 0600)
+		if err != nil {
+			return nil, err
+		}
+	}
+	os.Remove(pendingFile(typ, ip, ".csr"))
+	os.Remove(pendingFile(typ, ip, ".json"))
+	return csr, nil
+}
+
+// Signs the csr, stores the certificate as the approved one for the component and returns it in PEM format
+func issueCert(csr *x509.CertificateRequest, crtFile string) ([]byte, error) {
+	certBytes, err := ca.GenCertFromCSR(csr, &common.Duration{1, 0, 0})
+	if err != nil {
+		return nil, err
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certBytes})
+	return certPEM, common.WriteFileAtomic(crtFile, certPEM, 0644)
+}
+
+func isComponentKind(typ string) bool {
+	return typ == endpointKind || typ == scraperKind || typ == storageKind
+}
+
+// Creates a one-time enrollment token for the given component type and IP.
+func createEnrollmentToken(w http.ResponseWriter, r *http.Request) {
+	log.Println("Create enrollment token received")
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Println("Error reading request body:", err)
+		w.WriteHeader(400)
+		return
+	}
+	var req types.EnrollmentTokenRequest
+	if err := json.Unmarshal(data, &req); err != nil {
+		log.Println("Error unmarshalling json:", err)
+		w.WriteHeader(400)
+		return
+	}
+	if !isComponentKind(req.Type) || net.ParseIP(req.IP) == nil {
+		w.WriteHeader(400)
+		w.Write([]byte("type must be one of Endpoint, Scraper or Storage and ip must be set"))
+		return
+	}
+	if req.IA != "" {
+		if _, err := addr.IAFromString(req.IA); err != nil {
+			w.WriteHeader(400)
+			w.Write([]byte("Invalid ia"))
+			return
+		}
+	}
+	ttl := enrollmentTTL
+	if req.TTL != "" {
+		ttl, err = time.ParseDuration(req.TTL)
+		if err != nil || ttl <= 0 {
+			w.WriteHeader(400)
+			w.Write([]byte("Invalid ttl"))
+			return
+		}
+	}
+	token, err := enrollmentTokens.create(req.Type, req.IP, req.IA, ttl)
+	if err != nil {
+		log.Println("Failed creating enrollment token:", err)
+		w.WriteHeader(500)
+		return
+	}
+	// A new token gives a rejected component another chance
+	os.Remove(pendingFile(req.Type, req.IP, ".rejected"))
+	jsonToken, err := json.Marshal(token)
+	if err != nil {
+		log.Println("Error while marshalling json:", err)
+		w.WriteHeader(500)
+		return
+	}
+	w.Write(jsonToken)
+}
+
+// Returns the list of all enrollment tokens that are still valid.
+func listEnrollmentTokens(w http.ResponseWriter, r *http.Request) {
+	log.Println("List enrollment tokens received")
+	jsonTokens, err := json.Marshal(enrollmentTokens.list())
+	if err != nil {
+		log.Println("Error while marshalling json:", err)
+		w.WriteHeader(500)
+		return
+	}
+	w.Write(jsonTokens)
+}
+
+// Returns the list of certificate requests waiting for approval.
+func listCertRequests(w http.ResponseWriter, r *http.Request) {
+	log.Println("List certificate requests received")
+	requests, err := listPendingRequests()
+	if err != nil {
+		log.Println("Failed listing pending requests:", err)
+		w.WriteHeader(500)
+		return
+	}
+	jsonRequests, err := json.Marshal(requests)
+	if err != nil {
+		log.Println("Error while marshalling json:", err)
+		w.WriteHeader(500)
+		return
+	}
+	w.Write(jsonRequests)
+}
+
+func readDecision(r *http.Request) (*types.CertRequestDecision, error) {
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	var decision types.CertRequestDecision
+	err = json.Unmarshal(data, &decision)
+	if err != nil {
+		return nil, err
+	}
+	if !isComponentKind(decision.Type) || net.ParseIP(decision.IP) == nil {
+		return nil, errors.Errorf("invalid type %s or ip %s", decision.Type, decision.IP)
+	}
+	return &decision, nil
+}
+
+// Signs the pending certificate request of the given component. The component obtains the certificate on its next try.
+func approveCertRequest(w http.ResponseWriter, r *http.Request) {
+	log.Println("Approve certificate request received")
+	decision, err := readDecision(r)
+	if err != nil {
+		log.Println("Error reading decision:", err)
+		w.WriteHeader(400)
+		return
+	}
+	csr, err := takePendingRequest(decision.Type, decision.IP, false)
+	if err != nil {
+		w.WriteHeader(404)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	_, err = issueCert(csr, approvedCertsDir+"/"+decision.Type+"_"+decision.IP+".crt")
+	if err != nil {
+		log.Println("Failed generating certificate:", err)
+		w.WriteHeader(500)
+		return
+	}
+	log.Printf("Approved certificate request of %s %s", decision.Type, decision.IP)
+	w.WriteHeader(204)
+}
+
+// Discards the pending certificate request of the given component and refuses its further requests.
+func rejectCertRequest(w http.ResponseWriter, r *http.Request) {
+	log.Println("Reject certificate request received")
+	decision, err := readDecision(r)
+	if err != nil {
+		log.Println("Error reading decision:", err)
+		w.WriteHeader(400)
+		return
+	}
+	_, err = takePendingRequest(decision.Type, decision.IP, true)
+	if err != nil {
+		w.WriteHeader(404)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	log.Printf("Rejected certificate request of %s %s", decision.Type, decision.IP)
+	w.WriteHeader(204)
+}
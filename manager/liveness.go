@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/netsec-ethz/2SMS/common/types"
+)
+
+// Component kinds, equal to the organizational unit in the components' certificates
+const (
+	endpointKind = "Endpoint"
+	scraperKind  = "Scraper"
+	storageKind  = "Storage"
+)
+
+type livenessEntry struct {
+	lastSeen time.Time
+	version  string
+	removed  bool // Set once the targets of a dead endpoint have been removed from the scrapers
+}
+
+// Keeps track of the last heartbeat of every registered component. Components that never sent a heartbeat since the
+// Manager started are considered alive from the start time on, so they get the same grace period as the others.
+type livenessTracker struct {
+	staleAfter time.Duration
+	deadAfter  time.Duration
+	started    time.Time
+	mutex      sync.Mutex
+	entries    map[string]*livenessEntry
+}
+
+func newLivenessTracker(staleAfter, deadAfter time.Duration) *livenessTracker {
+	return &livenessTracker{
+		staleAfter: staleAfter,
+		deadAfter:  deadAfter,
+		started:    time.Now(),
+		entries:    make(map[string]*livenessEntry),
+	}
+}
+
+func livenessKey(kind, ip, managePort string) string {
+	return kind + "/" + ip + ":" + managePort
+}
+
+// Records a sign of life of the component and returns whether it was considered dead before
+func (lt *livenessTracker) seen(kind, ip, managePort, version string) bool {
+	lt.mutex.Lock()
+	defer lt.mutex.Unlock()
+	key := livenessKey(kind, ip, managePort)
+	entry, ok := lt.entries[key]
+	if !ok {
+		entry = &livenessEntry{}
+		lt.entries[key] = entry
+	}
+	revived := entry.removed
+	entry.lastSeen = time.Now()
+	entry.removed = false
+	if version != "" {
+		entry.version = version
+	}
+	return revived
+}
+
+func (lt *livenessTracker) forget(kind, ip, managePort string) {
+	lt.mutex.Lock()
+	defer lt.mutex.Unlock()
+	delete(lt.entries, livenessKey(kind, ip, managePort))
+}
+
+func (lt *livenessTracker) get(kind, ip, managePort string) types.Liveness {
+	lt.mutex.Lock()
+	defer lt.mutex.Unlock()
+	liveness := types.Liveness{LastSeen: lt.started}
+	if entry, ok := lt.entries[livenessKey(kind, ip, managePort)]; ok {
+		liveness.LastSeen = entry.lastSeen
+		liveness.Version = entry.version
+	}
+	liveness.Status = lt.status(liveness.LastSeen)
+	return liveness
+}
+
+func (lt *livenessTracker) status(lastSeen time.Time) string {
+	since := time.Since(lastSeen)
+	switch {
+	case since > lt.deadAfter:
+		return types.LivenessDead
+	case since > lt.staleAfter:
+		return types.LivenessStale
+	default:
+		return types.LivenessHealthy
+	}
+}
+
+// Marks the targets of a dead endpoint as removed. Returns false if they already were.
+func (lt *livenessTracker) markRemoved(kind, ip, managePort string) bool {
+	lt.mutex.Lock()
+	defer lt.mutex.Unlock()
+	key := livenessKey(kind, ip, managePort)
+	entry, ok := lt.entries[key]
+	if !ok {
+		entry = &livenessEntry{lastSeen: lt.started}
+		lt.entries[key] = entry
+	}
+	if entry.removed {
+		return false
+	}
+	entry.removed = true
+	return true
+}
+
+// Periodically removes the targets of dead endpoints from the scrapers
+func (lt *livenessTracker) start(interval time.Duration) {
+	go func() {
+		for range time.NewTicker(interval).C {
+			for _, end := range getEndpoints() {
+				if lt.get(endpointKind, end.IP, end.ManagePort).Status != types.LivenessDead {
+					continue
+				}
+				if lt.markRemoved(endpointKind, end.IP, end.ManagePort) {
+					log.Printf("Liveness: endpoint %s %s is dead, removing its targets from the scrapers", end.IA, end.IP)
+					removeEndpointTargets(&end)
+				}
+			}
+		}
+	}()
+}
+
+// Registered components together with their liveness, as returned by the list calls
+type endpointStatus struct {
+	types.Endpoint
+	types.Liveness
+}
+
+type scraperStatus struct {
+	types.Scraper
+	types.Liveness
+}
+
+type storageStatus struct {
+	types.Storage
+	types.Liveness
+}
+
+// Returns a handler receiving the heartbeats of components of the given kind. The heartbeat must come from a
+// registered component and match the client certificate it is sent with.
+func heartbeat(kind string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			log.Println("Error reading request body:", err)
+			w.WriteHeader(400)
+			return
+		}
+		var hb types.Heartbeat
+		if err := json.Unmarshal(data, &hb); err != nil {
+			log.Println("Error unmarshalling json:", err)
+			w.WriteHeader(400)
+			return
+		}
+		if !peerIs(r, kind, hb.IP) {
+			log.Printf("Rejected %s heartbeat for %s from %s: certificate doesn't match", kind, hb.IP, r.RemoteAddr)
+			w.WriteHeader(403)
+			return
+		}
+		var registered bool
+		var end types.Endpoint
+		switch kind {
+		case endpointKind:
+			for _, e := range getEndpoints() {
+				if e.IP == hb.IP && e.ManagePort == hb.ManagePort {
+					registered, end = true, e
+				}
+			}
+		case scraperKind:
+			for _, scr := range getScrapers() {
+				registered = registered || (scr.IP == hb.IP && scr.ManagePort == hb.ManagePort)
+			}
+		case storageKind:
+			for _, str := range getStorages() {
+				registered = registered || (str.IP == hb.IP && str.ManagePort == hb.ManagePort)
+			}
+		}
+		if !registered {
+			w.WriteHeader(404)
+			w.Write([]byte(kind + " is not registered"))
+			return
+		}
+		if liveness.seen(kind, hb.IP, hb.ManagePort, hb.Version) && kind == endpointKind {
+			log.Printf("Liveness: endpoint %s %s is alive again, adding back its targets to the scrapers", end.IA, end.IP)
+			go addEndpointTargets(&end)
+		}
+		w.WriteHeader(204)
+	}
+}
+
+// Checks that the request was sent with a client certificate of the given kind and ip
+func peerIs(r *http.Request, kind, ip string) bool {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return false
+	}
+	cert := r.TLS.PeerCertificates[0]
+	kindMatches, ipMatches := false, false
+	for _, ou := range cert.Subject.OrganizationalUnit {
+		kindMatches = kindMatches || ou == kind
+	}
+	for _, certIP := range cert.IPAddresses {
+		ipMatches = ipMatches || certIP.String() == ip
+	}
+	return kindMatches && ipMatches
+}
+
+// Adds the targets of all paths of the endpoint to the scrapers covering it and returns these scrapers
+func addEndpointTargets(end *types.Endpoint) []types.Scraper {
+	addedTo := []types.Scraper{}
+	for _, target := range endpointTargets(end) {
+		jsonBytes, err := json.Marshal(target)
+		if err != nil {
+			log.Println("Failed marshaling json:", err)
+			continue
+		}
+		for _, scr := range addTargetToScrapers(&target, jsonBytes) {
+			if !containsScraper(addedTo, &scr) {
+				addedTo = append(addedTo, scr)
+			}
+		}
+	}
+	return addedTo
+}
+
+func containsScraper(scrapers []types.Scraper, scraper *types.Scraper) bool {
+	for _, scr := range scrapers {
+		if scraper.Equal(&scr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Removes the targets of all paths of the endpoint from the scrapers covering it
+func removeEndpointTargets(end *types.Endpoint) {
+	for _, target := range endpointTargets(end) {
+		jsonBytes, err := json.Marshal(target)
+		if err != nil {
+			log.Println("Failed marshaling json:", err)
+			continue
+		}
+		for _, scr := range getScrapers() {
+			if !scr.Covers(target.ISD) {
+				continue
+			}
+			req, err := http.NewRequest("DELETE", "https://"+scr.IP+":"+scr.ManagePort+"/targets", bytes.NewReader(jsonBytes))
+			if err != nil {
+				log.Println("Error in creating DELETE target request:", err)
+				continue
+			}
+			resp, err := httpsClient.Do(req)
+			if err != nil {
+				log.Println("Error in removing scraper target:", err)
+				continue
+			}
+			err = resp.Body.Close()
+			if err != nil {
+				log.Printf("removeEndpointTargets: failed to close response's body getting scraper's response: %v", err)
+			}
+		}
+	}
+}
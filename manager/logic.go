@@ -1,25 +1,14 @@
 package main
 
 import (
-	"encoding/json"
 	"github.com/netsec-ethz/2SMS/common/types"
-	"github.com/pkg/errors"
-	"io/ioutil"
-	"log"
 )
 
 func getScrapers() []types.Scraper {
-	jsonScrs, err := ioutil.ReadFile("scrapers.json")
-	if err != nil {
-		log.Println("Error while reading file:", err)
-		return nil
-	}
 	var scrs []types.Scraper
-	err = json.Unmarshal(jsonScrs, &scrs)
-	if err != nil {
-		log.Println("Error while unmarshalling json:", err)
-		return nil
-	}
+	registry.View(func(data *RegistryData) {
+		scrs = append([]types.Scraper{}, data.Scrapers...)
+	})
 	return scrs
 }
 
@@ -33,86 +22,88 @@ func getScraperByIP(ip string) *types.Scraper {
 }
 
 func addScraper(scraper *types.Scraper) error {
-	scrapers := getScrapers()
-	// If scraper already registered just return
-	for _, scr := range scrapers {
-		if scraper.Equal(&scr) {
-			return nil
+	return registry.Update(func(data *RegistryData) error {
+		// If scraper already registered just return
+		for _, scr := range data.Scrapers {
+			if scraper.Equal(&scr) {
+				return nil
+			}
 		}
-	}
-	// Add new scraper to the list and write to file
-	scrapers = append(scrapers, *scraper)
-	jsonScrs, err := json.Marshal(scrapers)
-	if err != nil {
-		return errors.New("Error marshalling json: " + err.Error())
-	}
-	return ioutil.WriteFile("scrapers.json", jsonScrs, 0644)
+		// Add new scraper to the list
+		data.Scrapers = append(data.Scrapers, *scraper)
+		return nil
+	})
 }
 
 func RemoveScraper(scraper *types.Scraper) error {
-	scrapers := getScrapers()
-	new_scrapers := []types.Scraper{}
-
-	// Copy other storages
-	for _, scr := range scrapers {
-		if !scraper.Equal(&scr) {
-			new_scrapers = append(new_scrapers, scr)
+	return registry.Update(func(data *RegistryData) error {
+		newScrapers := []types.Scraper{}
+		// Copy other scrapers
+		for _, scr := range data.Scrapers {
+			if !scraper.Equal(&scr) {
+				newScrapers = append(newScrapers, scr)
+			}
 		}
-	}
-	jsonScrs, err := json.Marshal(new_scrapers)
-	if err != nil {
-		return errors.New("Error marshalling json: " + err.Error())
-	}
-	return ioutil.WriteFile("scrapers.json", jsonScrs, 0644)
+		data.Scrapers = newScrapers
+		return nil
+	})
 }
 
 func getEndpoints() []types.Endpoint {
-	jsonEnds, err := ioutil.ReadFile("endpoints.json")
-	if err != nil {
-		log.Println("Error while reading file:", err)
-		return nil
-	}
 	var ends []types.Endpoint
-	err = json.Unmarshal(jsonEnds, &ends)
-	if err != nil {
-		log.Println("Error while unmarshalling json:", err)
-		return nil
-	}
+	registry.View(func(data *RegistryData) {
+		ends = append([]types.Endpoint{}, data.Endpoints...)
+	})
 	return ends
 }
 
 func addEndpoint(endpoint *types.Endpoint) error {
-	endpoints := getEndpoints()
-	// If endpoint already registered just return
-	for _, end := range endpoints {
-		if endpoint.Equal(&end) {
-			return nil
+	return registry.Update(func(data *RegistryData) error {
+		// If endpoint already registered just add the new paths and their labels
+		for i, end := range data.Endpoints {
+			if endpoint.Equal(&end) {
+				data.Endpoints[i] = mergeEndpointPaths(end, endpoint)
+				return nil
+			}
+		}
+		// Add new endpoint to the list
+		data.Endpoints = append(data.Endpoints, *endpoint)
+		return nil
+	})
+}
+
+// Returns end with the paths and target labels of registered added
+func mergeEndpointPaths(end types.Endpoint, registered *types.Endpoint) types.Endpoint {
+	labels := make(map[string]map[string]string)
+	for path, pathLabels := range end.Labels {
+		labels[path] = pathLabels
+	}
+	for _, path := range registered.Paths {
+		if !contains(end.Paths, path) {
+			end.Paths = append(end.Paths, path)
+		}
+		if len(registered.Labels[path]) > 0 {
+			labels[path] = registered.Labels[path]
+		} else {
+			delete(labels, path)
 		}
 	}
-	// Add new scraper to the list and write to file
-	endpoints = append(endpoints, *endpoint)
-	jsonEnds, err := json.Marshal(endpoints)
-	if err != nil {
-		return errors.New("Error marshalling json: " + err.Error())
-	}
-	return ioutil.WriteFile("endpoints.json", jsonEnds, 0644)
+	end.Labels = labels
+	return end
 }
 
 func RemoveEndpoint(endpoint *types.Endpoint) error {
-	endpoints := getEndpoints()
-	new_endpoints := []types.Endpoint{}
-
-	// Copy other storages
-	for _, end := range endpoints {
-		if !endpoint.Equal(&end) {
-			new_endpoints = append(new_endpoints, end)
+	return registry.Update(func(data *RegistryData) error {
+		newEndpoints := []types.Endpoint{}
+		// Copy other endpoints
+		for _, end := range data.Endpoints {
+			if !endpoint.Equal(&end) {
+				newEndpoints = append(newEndpoints, end)
+			}
 		}
-	}
-	jsonEnds, err := json.Marshal(new_endpoints)
-	if err != nil {
-		return errors.New("Error marshalling json: " + err.Error())
-	}
-	return ioutil.WriteFile("endpoints.json", jsonEnds, 0644)
+		data.Endpoints = newEndpoints
+		return nil
+	})
 }
 
 func getEndpointByIP(ip string) *types.Endpoint {
@@ -125,50 +116,37 @@ func getEndpointByIP(ip string) *types.Endpoint {
 }
 
 func addStorage(storage *types.Storage) error {
-	storages := getStorages()
-	// If scraper already registered just return
-	for _, str := range storages {
-		if storage.Equal(&str) {
-			return nil
+	return registry.Update(func(data *RegistryData) error {
+		// If storage already registered just return
+		for _, str := range data.Storages {
+			if storage.Equal(&str) {
+				return nil
+			}
 		}
-	}
-	// Add new scraper to the list and write to file
-	storages = append(storages, *storage)
-	jsonScrs, err := json.Marshal(storages)
-	if err != nil {
-		return errors.New("Error marshalling json: " + err.Error())
-	}
-	return ioutil.WriteFile("storages.json", jsonScrs, 0644)
+		// Add new storage to the list
+		data.Storages = append(data.Storages, *storage)
+		return nil
+	})
 }
 
 func RemoveStorage(storage *types.Storage) error {
-	storages := getStorages()
-	new_storages := []types.Storage{}
-
-	// Copy other storages
-	for _, str := range storages {
-		if !storage.Equal(&str) {
-			new_storages = append(new_storages, str)
+	return registry.Update(func(data *RegistryData) error {
+		newStorages := []types.Storage{}
+		// Copy other storages
+		for _, str := range data.Storages {
+			if !storage.Equal(&str) {
+				newStorages = append(newStorages, str)
+			}
 		}
-	}
-	jsonScrs, err := json.Marshal(storages)
-	if err != nil {
-		return errors.New("Error marshalling json: " + err.Error())
-	}
-	return ioutil.WriteFile("storages.json", jsonScrs, 0644)
+		data.Storages = newStorages
+		return nil
+	})
 }
 
 func getStorages() []types.Storage {
-	jsonStrs, err := ioutil.ReadFile("storages.json")
-	if err != nil {
-		log.Println("Error while reading file:", err)
-		return nil
-	}
 	var strs []types.Storage
-	err = json.Unmarshal(jsonStrs, &strs)
-	if err != nil {
-		log.Println("Error while unmarshalling json:", err)
-		return nil
-	}
+	registry.View(func(data *RegistryData) {
+		strs = append([]types.Storage{}, data.Storages...)
+	})
 	return strs
 }
@@ -5,17 +5,16 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
-	"encoding/json"
 	"flag"
-	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/netsec-ethz/2SMS/common"
-	"github.com/netsec-ethz/2SMS/common/types"
 	"github.com/scionproto/scion/go/lib/snet"
 )
 
@@ -38,6 +37,27 @@ var (
 	local             snet.Addr
 	refuseSigning     = true
 	httpsClient       *http.Client
+	registryFile      string
+	registry          Registry
+	heartbeatStale    time.Duration
+	heartbeatGrace    time.Duration
+	liveness          *livenessTracker
+	revocationFile    string = "ca/revoked.json"
+	crlFile           string = "ca/ca.crl"
+	crlValidity       time.Duration
+	revocations       *revocationList
+	revocationChecker *common.RevocationChecker
+	enrollmentFile    string = "ca/enrollment_tokens.json"
+	enrollmentTTL     time.Duration
+	enrollmentTokens  *tokenStore
+	csrCurves         string
+	csrPolicy         *common.CSRPolicy
+	policyDir         string
+	policies          *policyRepository
+	permissionsFile   string
+	permRequests      *permissionRequestStore
+	maxPendingPerms   int
+	maxHostPerms      int
 )
 
 func initManager() {
@@ -50,9 +70,22 @@ func initManager() {
 	flag.StringVar(&managementPort, "ports.management", "10002", "port where the management api is exposed")
 	flag.StringVar(&approvedCertsDir, "manager.approved-certs", "approved_certs", "directory where approved certificate are stored")
 	flag.StringVar(&waitingCSRDir, "manager.waiting-csrs", "waiting_csrs", "directory where still non approved csr are stored")
+	flag.StringVar(&registryFile, "manager.registry", "registry.db", "BoltDB file where the registered components are stored")
+	flag.DurationVar(&heartbeatStale, "heartbeat.stale", 90*time.Second, "time without heartbeat after which a component is considered stale")
+	flag.DurationVar(&heartbeatGrace, "heartbeat.grace", 10*time.Minute, "time without heartbeat after which a component is considered dead and its targets are removed from the scrapers")
+	flag.DurationVar(&crlValidity, "crl.validity", 24*time.Hour, "validity of the generated certificate revocation lists, they are regenerated after half of it")
+	flag.DurationVar(&enrollmentTTL, "enrollment.ttl", 24*time.Hour, "default validity of enrollment tokens")
+	flag.StringVar(&csrCurves, "csr.curves", "P-256,P-384", "comma separated list of elliptic curves allowed for the keys in certificate requests")
+	csrPolicy = &common.CSRPolicy{AllowedOUs: []string{endpointKind, scraperKind, storageKind}}
+	flag.BoolVar(&csrPolicy.RequireRemoteIP, "csr.check-remote-ip", true, "require the IP address in certificate requests to be the one the request comes from")
+	flag.StringVar(&permissionsFile, "manager.permission-requests", "auth/permission_requests.json", "file where the permission requests of sources from other ASes are stored")
+	flag.IntVar(&maxPendingPerms, "manager.permission-requests.max-pending", 100, "maximum number of pending permission requests, further ones are refused")
+	flag.IntVar(&maxHostPerms, "manager.permission-requests.max-pending-per-host", 5, "maximum number of pending permission requests filed from the same host")
+	flag.StringVar(&policyDir, "manager.policy", "policy", "directory where the policy distributed to the endpoints and its history are stored")
 	flag.Var((*snet.Addr)(&local), "local", "(Mandatory) local SCION information (port is not needed)")
 
 	flag.Parse()
+	csrPolicy.AllowedCurves = strings.Split(csrCurves, ",")
 
 	var err error
 	// Create directory to store auth data
@@ -112,27 +145,11 @@ func initManager() {
 		}
 		common.WriteToPEMFile(managerCert, "CERTIFICATE", certBytes)
 	}
-	if !common.FileExists("endpoints.json") {
-		bts, _ := json.Marshal([]types.Endpoint{})
-		err = ioutil.WriteFile("endpoints.json", bts, 0644)
-		if err != nil {
-			log.Fatal("Failed initializing endpoints file:", err)
-		}
-	}
-	if !common.FileExists("scrapers.json") {
-		bts, _ := json.Marshal([]types.Scraper{})
-		err = ioutil.WriteFile("scrapers.json", bts, 0644)
-		if err != nil {
-			log.Fatal("Failed initializing scrapers file:", err)
-		}
-	}
-	if !common.FileExists("storages.json") {
-		bts, _ := json.Marshal([]types.Scraper{})
-		err = ioutil.WriteFile("storages.json", bts, 0644)
-		if err != nil {
-			log.Fatal("Failed initializing storages file:", err)
-		}
+	registry, err = NewBoltRegistry(registryFile, ".")
+	if err != nil {
+		log.Fatal("Failed opening registry:", err)
 	}
+	liveness = newLivenessTracker(heartbeatStale, heartbeatGrace)
 
 	// Bootstrap PKI
 	err = common.Bootstrap(caCertFile, "ca/bootstrap.json") // TODO: use param for caData
@@ -142,12 +159,40 @@ func initManager() {
 		log.Println("Successfully verified ca certificate.")
 	}
 
+	// The Manager checks peers against its own revocation list, which is updated on every new CRL
+	revocationChecker, err = common.NewRevocationChecker(caDir)
+	if err != nil {
+		log.Fatal("Failed creating revocation checker:", err)
+	}
+	common.EnableRevocationCheck(revocationChecker)
+	revocations, err = newRevocationList(revocationFile, crlFile)
+	if err != nil {
+		log.Fatal("Failed loading revocation list:", err)
+	}
+
+	enrollmentTokens, err = newTokenStore(enrollmentFile)
+	if err != nil {
+		log.Fatal("Failed loading enrollment tokens:", err)
+	}
+
+	policies, err = newPolicyRepository(policyDir)
+	if err != nil {
+		log.Fatal("Failed loading policy:", err)
+	}
+
+	permRequests, err = newPermissionRequestStore(permissionsFile, maxPendingPerms, maxHostPerms)
+	if err != nil {
+		log.Fatal("Failed loading permission requests:", err)
+	}
+
 	httpsClient = common.CreateHttpsClient(caDir, managerCert, managerPrivKey)
 }
 
 func main() {
 	initManager()
 	log.Println("Started Manager Application")
+	liveness.start(heartbeatStale / 3)
+	revocations.start(crlValidity / 2)
 
 	// HTTPS Server for PKI operations without client side verification
 	go func() {
@@ -156,42 +201,71 @@ func main() {
 		router.HandleFunc("/certificate/request", requestCert).Methods("POST")
 		// Retrieve certificate
 		router.HandleFunc("/certificates/{type}/{ip}/get", getCert).Methods("GET")
+		// Retrieve certificate revocation list
+		router.HandleFunc("/crl", getCRL).Methods("GET")
+		// Request permissions on an endpoint and follow the request
+		router.HandleFunc("/authorization/request", requestPermission).Methods("POST")
+		router.HandleFunc("/authorization/requests/{id}", getPermissionRequest).Methods("GET")
 
 		srv := common.CreateHttpsServer(caDir, managerCert, managerPrivKey, "", noClientVerifPort, router, tls.NoClientCert)
 		log.Println("Starting server without client verification")
-		log.Fatal("Server without client verification listening error:", srv.ListenAndServeTLS(managerCert, managerPrivKey))
+		log.Fatal("Server without client verification listening error:", srv.ListenAndServeTLS("", ""))
 	}()
 
 	// HTTPS Server for operations with client side verification
 	go func() {
 		router := mux.NewRouter()
 
+		// Send csr authenticated with the current certificate and ask to renew it
+		router.HandleFunc("/certificate/renew", renewCert).Methods("POST")
 		router.HandleFunc("/endpoint/mappings/notify", notifyAddedMapping).Methods("POST")
 		router.HandleFunc("/endpoint/mappings/notify", notifyRemovedMapping).Methods("DELETE")
 		router.HandleFunc("/endpoints/register", registerEndpoint).Methods("POST")
+		router.HandleFunc("/endpoints/heartbeat", heartbeat(endpointKind)).Methods("POST")
+		router.HandleFunc("/endpoints/policy", pullPolicy).Methods("GET")
 
 		router.HandleFunc("/scrapers/register", registerScraper).Methods("POST")
+		router.HandleFunc("/scrapers/heartbeat", heartbeat(scraperKind)).Methods("POST")
 
 		router.HandleFunc("/storages/register", registerStorage).Methods("POST")
+		router.HandleFunc("/storages/heartbeat", heartbeat(storageKind)).Methods("POST")
 
 		srv := common.CreateHttpsServer(caDir, managerCert, managerPrivKey, "", clientVerifPort, router, tls.RequireAndVerifyClientCert)
 		log.Println("Starting server with client verification")
-		log.Fatal("Server with client verification listening error:", srv.ListenAndServeTLS(managerCert, managerPrivKey))
+		log.Fatal("Server with client verification listening error:", srv.ListenAndServeTLS("", ""))
 	}()
 
 	// HTTP Management Server (localhost only)
 	router := mux.NewRouter()
-	// TODO: currently a csr is either signed or refused, but never put in waiting list.
-	//router.HandleFunc("/manager/certificate/requests", getRequests).Methods("GET")
-	//router.HandleFunc("/manager/certificate/approve", approveRequest).Methods("POST")
+	router.HandleFunc("/manager/certificate/requests", listCertRequests).Methods("GET")
+	router.HandleFunc("/manager/certificate/approve", approveCertRequest).Methods("POST")
+	router.HandleFunc("/manager/certificate/reject", rejectCertRequest).Methods("POST")
+	router.HandleFunc("/manager/enrollment/tokens", listEnrollmentTokens).Methods("GET")
+	router.HandleFunc("/manager/enrollment/tokens", createEnrollmentToken).Methods("POST")
 	router.HandleFunc("/manager/signing/block", blockSigning).Methods("GET")
 	router.HandleFunc("/manager/signing/enable", enableSigning).Methods("GET")
+	router.HandleFunc("/manager/certificates/revoke", revokeCert).Methods("POST")
+	router.HandleFunc("/manager/certificates/revoked", listRevokedCerts).Methods("GET")
 	router.HandleFunc("/manager/endpoints", listEndpoints).Methods("GET")
 	router.HandleFunc("/manager/scrapers", listScrapers).Methods("GET")
 	router.HandleFunc("/manager/storages", listStorages).Methods("GET")
 	router.HandleFunc("/manager/scrapers/remove", removeScraper).Methods("DELETE")
 	router.HandleFunc("/manager/endpoints/remove", removeEndpoint).Methods("DELETE")
 	router.HandleFunc("/manager/storages/remove", removeStorage).Methods("DELETE")
+	router.HandleFunc("/manager/registry/import", importRegistry).Methods("POST")
+	router.HandleFunc("/manager/capabilities", mintCapability).Methods("POST")
+	router.HandleFunc("/manager/capabilities/revoke", revokeCapability).Methods("POST")
+	router.HandleFunc("/manager/policy", getPolicy).Methods("GET")
+	router.HandleFunc("/manager/policy", putPolicy).Methods("PUT")
+	router.HandleFunc("/manager/policy/versions", listPolicyVersions).Methods("GET")
+	router.HandleFunc("/manager/policy/versions/{version}", getPolicyVersion).Methods("GET")
+	router.HandleFunc("/manager/policy/versions/{version}/restore", restorePolicyVersion).Methods("POST")
+	router.HandleFunc("/manager/policy/overrides/{ip}", getPolicyOverride).Methods("GET")
+	router.HandleFunc("/manager/policy/overrides/{ip}", putPolicyOverride).Methods("PUT")
+	router.HandleFunc("/manager/policy/overrides/{ip}", deletePolicyOverride).Methods("DELETE")
+	router.HandleFunc("/manager/policy/push", pushPolicies).Methods("POST")
+	router.HandleFunc("/manager/policy/drift", listPolicyDrift).Methods("GET")
+	router.HandleFunc("/metrics", common.SelfMetricsHandler).Methods("GET")
 
 	router.HandleFunc("/endpoint/{addr}/mappings", redirect).Methods("GET")
 	router.HandleFunc("/endpoint/{addr}/mappings", redirect).Methods("POST")
@@ -200,6 +274,10 @@ func main() {
 	router.HandleFunc("/endpoint/{addr}/access_control", redirect).Methods("POST")
 	router.HandleFunc("/endpoint/{addr}/access_control", redirect).Methods("DELETE")
 	router.HandleFunc("/endpoint/{addr}/sources", redirect).Methods("GET")
+	router.HandleFunc("/endpoint/{addr}/patterns", redirect).Methods("GET")
+	router.HandleFunc("/endpoint/{addr}/patterns/roles", redirect).Methods("POST")
+	router.HandleFunc("/endpoint/{addr}/patterns/roles", redirect).Methods("DELETE")
+	router.HandleFunc("/endpoint/{addr}/{source}/patterns", redirect).Methods("GET")
 	router.HandleFunc("/endpoint/{addr}/{source}/roles", redirect).Methods("GET")
 	router.HandleFunc("/endpoint/{addr}/{source}/roles", redirect).Methods("POST")
 	router.HandleFunc("/endpoint/{addr}/{source}/roles", redirect).Methods("DELETE")
@@ -212,12 +290,20 @@ func main() {
 	router.HandleFunc("/endpoint/{addr}/{source}/{mapping}/frequency", redirect).Methods("POST")
 	router.HandleFunc("/endpoint/{addr}/{source}/{mapping}/window", redirect).Methods("DELETE")
 	router.HandleFunc("/endpoint/{addr}/{source}/{mapping}/window", redirect).Methods("POST")
+	router.HandleFunc("/endpoint/{addr}/{source}/{mapping}/explain", redirect).Methods("GET")
 	router.HandleFunc("/endpoint/{addr}/roles", redirect).Methods("GET")
 	router.HandleFunc("/endpoint/{addr}/roles", redirect).Methods("POST")
 	router.HandleFunc("/endpoint/{addr}/roles/{role}", redirect).Methods("DELETE")
 	router.HandleFunc("/endpoint/{addr}/roles/{role}", redirect).Methods("GET")
 	router.HandleFunc("/endpoint/{addr}/roles/{role}/permissions/{mapping}", redirect).Methods("POST")
 	router.HandleFunc("/endpoint/{addr}/roles/{role}/permissions/{mapping}", redirect).Methods("DELETE")
+	router.HandleFunc("/endpoint/{addr}/roles/{role}/redaction", redirect).Methods("GET")
+	router.HandleFunc("/endpoint/{addr}/roles/{role}/redaction", redirect).Methods("PUT")
+	router.HandleFunc("/endpoint/{addr}/roles/{role}/redaction", redirect).Methods("DELETE")
+	router.HandleFunc("/endpoint/{addr}/policy", redirect).Methods("GET")
+	router.HandleFunc("/endpoint/{addr}/capabilities", redirect).Methods("POST")
+	router.HandleFunc("/endpoint/{addr}/capabilities/revoked", redirect).Methods("GET")
+	router.HandleFunc("/endpoint/{addr}/audit", redirect).Methods("GET")
 
 	router.HandleFunc("/scraper/{addr}/targets", redirect).Methods("GET")
 	router.HandleFunc("/scraper/{addr}/targets", addScraperTarget).Methods("POST")
@@ -226,9 +312,12 @@ func main() {
 	router.HandleFunc("/scraper/{addr}/storages", redirect).Methods("GET")
 	router.HandleFunc("/scraper/{addr}/storages", redirect).Methods("POST")
 	router.HandleFunc("/scraper/{addr}/storages", redirect).Methods("DELETE")
+	router.HandleFunc("/scraper/{addr}/storages/sync", syncScraperStorages).Methods("GET")
 
-	//router.HandleFunc("/authorization/requests", listPermissionRequests).Methods("GET")
-	//router.HandleFunc("/authorization/approve", approvePermissionRequest).Methods("POST")
+	router.HandleFunc("/authorization/requests", listPermissionRequests).Methods("GET")
+	router.HandleFunc("/authorization/approve", approvePermissionRequest).Methods("POST")
+	router.HandleFunc("/authorization/reject", rejectPermissionRequest).Methods("POST")
+	router.HandleFunc("/authorization/revoke", revokePermissionRequest).Methods("POST")
 
 	srv := &http.Server{
 		Addr:    "127.0.0.1:" + managementPort,
@@ -0,0 +1,457 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+	"github.com/netsec-ethz/2SMS/common"
+	"github.com/netsec-ethz/2SMS/common/types"
+	"github.com/pkg/errors"
+)
+
+// Roles, role bindings and timing rules distributed to all Endpoints. The current policy is stored in
+// <dir>/policy.json, every version of it in <dir>/history/<version>.json, the per-endpoint overrides in
+// <dir>/overrides.json and the last override version of each endpoint in <dir>/override_versions.json.
+type policyRepository struct {
+	dir       string
+	policy    types.Policy
+	overrides map[string]types.Policy // By endpoint IP
+	// Last override version by endpoint IP, kept when the override is removed so that the versions only increase
+	overrideVersions map[string]int
+	mutex            sync.RWMutex
+}
+
+func newPolicyRepository(dir string) (*policyRepository, error) {
+	pr := &policyRepository{
+		dir:              dir,
+		policy:           emptyPolicy(),
+		overrides:        make(map[string]types.Policy),
+		overrideVersions: make(map[string]int),
+	}
+	err := os.MkdirAll(filepath.Join(dir, "history"), 0700)
+	if err != nil {
+		return nil, err
+	}
+	if err = readJSONFile(filepath.Join(dir, "policy.json"), &pr.policy); err != nil {
+		return nil, errors.Wrap(err, "reading policy")
+	}
+	if err = readJSONFile(filepath.Join(dir, "overrides.json"), &pr.overrides); err != nil {
+		return nil, errors.Wrap(err, "reading policy overrides")
+	}
+	if err = readJSONFile(filepath.Join(dir, "override_versions.json"), &pr.overrideVersions); err != nil {
+		return nil, errors.Wrap(err, "reading policy override versions")
+	}
+	for ip, override := range pr.overrides {
+		if override.OverrideVersion > pr.overrideVersions[ip] {
+			pr.overrideVersions[ip] = override.OverrideVersion
+		}
+	}
+	return pr, nil
+}
+
+func emptyPolicy() types.Policy {
+	return types.Policy{Roles: []types.Role{}, Bindings: []types.RoleBinding{}, Timing: []types.TimingRule{}}
+}
+
+// Decodes file into v, leaving v untouched if the file doesn't exist
+func readJSONFile(file string, v interface{}) error {
+	if !common.FileExists(file) {
+		return nil
+	}
+	bts, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(bts, v)
+}
+
+func writeJSONFile(file string, v interface{}) error {
+	bts, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return common.WriteFileAtomic(file, bts, 0600)
+}
+
+func (pr *policyRepository) get() types.Policy {
+	pr.mutex.RLock()
+	defer pr.mutex.RUnlock()
+	return pr.policy
+}
+
+// Stores policy as the new version of the current policy and returns it
+func (pr *policyRepository) update(policy types.Policy) (types.Policy, error) {
+	pr.mutex.Lock()
+	defer pr.mutex.Unlock()
+	policy.Version = pr.policy.Version + 1
+	policy.OverrideVersion = 0
+	err := writeJSONFile(filepath.Join(pr.dir, "history", strconv.Itoa(policy.Version)+".json"), policy)
+	if err != nil {
+		return types.Policy{}, errors.Wrap(err, "writing policy history")
+	}
+	err = writeJSONFile(filepath.Join(pr.dir, "policy.json"), policy)
+	if err != nil {
+		return types.Policy{}, errors.Wrap(err, "writing policy")
+	}
+	pr.policy = policy
+	return policy, nil
+}
+
+// Returns the given version of the policy
+func (pr *policyRepository) version(version int) (types.Policy, error) {
+	policy := types.Policy{}
+	file := filepath.Join(pr.dir, "history", strconv.Itoa(version)+".json")
+	if !common.FileExists(file) {
+		return policy, errors.Errorf("no policy version %d", version)
+	}
+	return policy, readJSONFile(file, &policy)
+}
+
+// Returns all stored versions of the policy, oldest first
+func (pr *policyRepository) versions() ([]int, error) {
+	files, err := ioutil.ReadDir(filepath.Join(pr.dir, "history"))
+	if err != nil {
+		return nil, err
+	}
+	versions := []int{}
+	for _, file := range files {
+		version, err := strconv.Atoi(strings.TrimSuffix(file.Name(), ".json"))
+		if err == nil {
+			versions = append(versions, version)
+		}
+	}
+	sort.Ints(versions)
+	return versions, nil
+}
+
+func (pr *policyRepository) getOverride(ip string) (types.Policy, bool) {
+	pr.mutex.RLock()
+	defer pr.mutex.RUnlock()
+	override, ok := pr.overrides[ip]
+	return override, ok
+}
+
+// Sets the override of the endpoint with the given ip, or removes it if override is nil
+func (pr *policyRepository) setOverride(ip string, override *types.Policy) error {
+	pr.mutex.Lock()
+	defer pr.mutex.Unlock()
+	overrides := make(map[string]types.Policy)
+	for k, v := range pr.overrides {
+		overrides[k] = v
+	}
+	// Removing the override is a change as well: endpoints refuse policies with a lower override version
+	versions := make(map[string]int)
+	for k, v := range pr.overrideVersions {
+		versions[k] = v
+	}
+	versions[ip]++
+	if override == nil {
+		delete(overrides, ip)
+	} else {
+		override.Version = 0
+		override.OverrideVersion = versions[ip]
+		overrides[ip] = *override
+	}
+	err := writeJSONFile(filepath.Join(pr.dir, "override_versions.json"), versions)
+	if err != nil {
+		return errors.Wrap(err, "writing policy override versions")
+	}
+	err = writeJSONFile(filepath.Join(pr.dir, "overrides.json"), overrides)
+	if err != nil {
+		return errors.Wrap(err, "writing policy overrides")
+	}
+	pr.overrides, pr.overrideVersions = overrides, versions
+	return nil
+}
+
+// Returns the policy for the endpoint with the given ip: the current policy with the endpoint's override applied
+func (pr *policyRepository) effective(ip string) types.Policy {
+	pr.mutex.RLock()
+	defer pr.mutex.RUnlock()
+	override, ok := pr.overrides[ip]
+	if !ok {
+		policy := pr.policy
+		policy.OverrideVersion = pr.overrideVersions[ip]
+		return policy
+	}
+	return mergePolicy(pr.policy, override)
+}
+
+// Applies override to base: roles and timing rules of the override replace the ones of base with the same name
+// (respectively subject and mapping), bindings are added
+func mergePolicy(base, override types.Policy) types.Policy {
+	merged := emptyPolicy()
+	merged.Version, merged.OverrideVersion = base.Version, override.OverrideVersion
+	overridden := make(map[string]bool)
+	for _, role := range override.Roles {
+		overridden[role.Name] = true
+	}
+	for _, role := range base.Roles {
+		if !overridden[role.Name] {
+			merged.Roles = append(merged.Roles, role)
+		}
+	}
+	merged.Roles = append(merged.Roles, override.Roles...)
+	bound := make(map[types.RoleBinding]bool)
+	for _, binding := range append(append([]types.RoleBinding{}, base.Bindings...), override.Bindings...) {
+		if !bound[binding] {
+			bound[binding] = true
+			merged.Bindings = append(merged.Bindings, binding)
+		}
+	}
+	overridden = make(map[string]bool)
+	for _, rule := range override.Timing {
+		overridden[rule.Subject+" "+rule.Mapping] = true
+	}
+	for _, rule := range base.Timing {
+		if !overridden[rule.Subject+" "+rule.Mapping] {
+			merged.Timing = append(merged.Timing, rule)
+		}
+	}
+	merged.Timing = append(merged.Timing, override.Timing...)
+	return merged
+}
+
+// Sends its effective policy to the endpoint
+func pushPolicy(end *types.Endpoint) error {
+	jsonPolicy, err := json.Marshal(policies.effective(end.IP))
+	if err != nil {
+		return err
+	}
+	return sendJSON("PUT", "https://"+end.IP+":"+end.ManagePort+"/policy", jsonPolicy)
+}
+
+// Sends their effective policy to all registered endpoints and returns the failures by endpoint IP
+func pushPolicyToEndpoints() map[string]string {
+	failures := make(map[string]string)
+	for _, end := range getEndpoints() {
+		if err := pushPolicy(&end); err != nil {
+			log.Printf("Failed pushing policy to endpoint %s: %v", end.IP, err)
+			failures[end.IP] = err.Error()
+		}
+	}
+	return failures
+}
+
+// Compares the policy state reported by the endpoint with its effective policy
+func endpointPolicyStatus(end *types.Endpoint) types.EndpointPolicyStatus {
+	expected := policies.effective(end.IP)
+	status := types.EndpointPolicyStatus{
+		IP:               end.IP,
+		Expected:         expected.Version,
+		ExpectedOverride: expected.OverrideVersion,
+		Drift:            []string{},
+	}
+	resp, err := httpsClient.Get("https://" + end.IP + ":" + end.ManagePort + "/policy")
+	if err != nil {
+		status.Error = err.Error()
+		return status
+	}
+	defer resp.Body.Close()
+	var reported types.PolicyStatus
+	if err = json.NewDecoder(resp.Body).Decode(&reported); err != nil {
+		status.Error = "invalid policy status: " + err.Error()
+		return status
+	}
+	status.Version, status.OverrideVersion = reported.Version, reported.OverrideVersion
+	if reported.Drift != nil {
+		status.Drift = reported.Drift
+	}
+	status.InSync = status.Version == status.Expected && status.OverrideVersion == status.ExpectedOverride &&
+		len(status.Drift) == 0
+	return status
+}
+
+func readPolicy(r *http.Request) (*types.Policy, error) {
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	policy := emptyPolicy()
+	err = json.Unmarshal(data, &policy)
+	if err != nil {
+		return nil, err
+	}
+	for _, rule := range policy.Timing {
+		if rule.Window != nil {
+			if _, err := common.NewWindow(*rule.Window); err != nil {
+				return nil, errors.Wrapf(err, "window of %s on %s", rule.Subject, rule.Mapping)
+			}
+		}
+	}
+	return &policy, nil
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	jsonBytes, err := json.Marshal(v)
+	if err != nil {
+		log.Println("Error while marshalling json:", err)
+		w.WriteHeader(500)
+		return
+	}
+	w.Write(jsonBytes)
+}
+
+// Returns the current policy.
+func getPolicy(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, policies.get())
+}
+
+// Replaces the policy with a new version and pushes it to all endpoints.
+func putPolicy(w http.ResponseWriter, r *http.Request) {
+	log.Println("Update policy received")
+	policy, err := readPolicy(r)
+	if err != nil {
+		log.Println("Error reading policy:", err)
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	updated, err := policies.update(*policy)
+	if err != nil {
+		log.Println("Failed updating policy:", err)
+		w.WriteHeader(500)
+		return
+	}
+	log.Printf("Policy updated to version %d", updated.Version)
+	go pushPolicyToEndpoints()
+	writeJSON(w, updated)
+}
+
+// Returns the list of stored policy versions.
+func listPolicyVersions(w http.ResponseWriter, r *http.Request) {
+	versions, err := policies.versions()
+	if err != nil {
+		log.Println("Failed listing policy versions:", err)
+		w.WriteHeader(500)
+		return
+	}
+	writeJSON(w, versions)
+}
+
+// Returns the given version of the policy.
+func getPolicyVersion(w http.ResponseWriter, r *http.Request) {
+	version, err := strconv.Atoi(mux.Vars(r)["version"])
+	if err != nil {
+		w.WriteHeader(400)
+		return
+	}
+	policy, err := policies.version(version)
+	if err != nil {
+		w.WriteHeader(404)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	writeJSON(w, policy)
+}
+
+// Makes the given version of the policy the current one (as a new version) and pushes it to all endpoints.
+func restorePolicyVersion(w http.ResponseWriter, r *http.Request) {
+	version, err := strconv.Atoi(mux.Vars(r)["version"])
+	if err != nil {
+		w.WriteHeader(400)
+		return
+	}
+	policy, err := policies.version(version)
+	if err != nil {
+		w.WriteHeader(404)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	updated, err := policies.update(policy)
+	if err != nil {
+		log.Println("Failed updating policy:", err)
+		w.WriteHeader(500)
+		return
+	}
+	log.Printf("Policy version %d restored as version %d", version, updated.Version)
+	go pushPolicyToEndpoints()
+	writeJSON(w, updated)
+}
+
+// Returns the override of the endpoint with the given IP.
+func getPolicyOverride(w http.ResponseWriter, r *http.Request) {
+	override, ok := policies.getOverride(mux.Vars(r)["ip"])
+	if !ok {
+		w.WriteHeader(404)
+		return
+	}
+	writeJSON(w, override)
+}
+
+// Sets the override of the endpoint with the given IP and pushes the resulting policy to it.
+func putPolicyOverride(w http.ResponseWriter, r *http.Request) {
+	ip := mux.Vars(r)["ip"]
+	override, err := readPolicy(r)
+	if err != nil {
+		log.Println("Error reading policy override:", err)
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if err = policies.setOverride(ip, override); err != nil {
+		log.Println("Failed setting policy override:", err)
+		w.WriteHeader(500)
+		return
+	}
+	if end := getEndpointByIP(ip); end != nil {
+		go func() {
+			if err := pushPolicy(end); err != nil {
+				log.Printf("Failed pushing policy to endpoint %s: %v", end.IP, err)
+			}
+		}()
+	}
+	w.WriteHeader(204)
+}
+
+// Removes the override of the endpoint with the given IP and pushes the current policy to it.
+func deletePolicyOverride(w http.ResponseWriter, r *http.Request) {
+	ip := mux.Vars(r)["ip"]
+	if err := policies.setOverride(ip, nil); err != nil {
+		log.Println("Failed removing policy override:", err)
+		w.WriteHeader(500)
+		return
+	}
+	if end := getEndpointByIP(ip); end != nil {
+		go func() {
+			if err := pushPolicy(end); err != nil {
+				log.Printf("Failed pushing policy to endpoint %s: %v", end.IP, err)
+			}
+		}()
+	}
+	w.WriteHeader(204)
+}
+
+// Pushes their effective policy to all endpoints and returns the failures by endpoint IP.
+func pushPolicies(w http.ResponseWriter, r *http.Request) {
+	log.Println("Push policy received")
+	writeJSON(w, pushPolicyToEndpoints())
+}
+
+// Returns for each endpoint whether its policy matches the effective one and how it diverges.
+func listPolicyDrift(w http.ResponseWriter, r *http.Request) {
+	statuses := []types.EndpointPolicyStatus{}
+	for _, end := range getEndpoints() {
+		statuses = append(statuses, endpointPolicyStatus(&end))
+	}
+	writeJSON(w, statuses)
+}
+
+// Returns its effective policy to the requesting endpoint, identified by its certificate.
+func pullPolicy(w http.ResponseWriter, r *http.Request) {
+	cert := r.TLS.PeerCertificates[0]
+	if len(cert.IPAddresses) != 1 || !peerIs(r, endpointKind, cert.IPAddresses[0].String()) {
+		w.WriteHeader(403)
+		return
+	}
+	writeJSON(w, policies.effective(cert.IPAddresses[0].String()))
+}
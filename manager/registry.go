@@ -0,0 +1,246 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/netsec-ethz/2SMS/common"
+	"github.com/netsec-ethz/2SMS/common/types"
+	"github.com/pkg/errors"
+)
+
+// Files used to import and export the registry's content (one list per component type)
+const (
+	endpointsFile = "endpoints.json"
+	scrapersFile  = "scrapers.json"
+	storagesFile  = "storages.json"
+)
+
+// RegistryData is the content of the registry, i.e. everything the Manager knows about the other components
+type RegistryData struct {
+	Endpoints []types.Endpoint `json:"endpoints"`
+	Scrapers  []types.Scraper  `json:"scrapers"`
+	Storages  []types.Storage  `json:"storages"`
+}
+
+// Replaces missing lists with empty ones, so that they are encoded as [] instead of null
+func (data *RegistryData) normalize() {
+	if data.Endpoints == nil {
+		data.Endpoints = []types.Endpoint{}
+	}
+	if data.Scrapers == nil {
+		data.Scrapers = []types.Scraper{}
+	}
+	if data.Storages == nil {
+		data.Storages = []types.Storage{}
+	}
+}
+
+// Registry stores the components registered at the Manager. All reads see a consistent snapshot and updates are
+// serialized and persisted atomically.
+type Registry interface {
+	// View calls fn with the current content of the registry. fn must not modify or retain data.
+	View(fn func(data *RegistryData))
+	// Update calls fn with a copy of the current content of the registry. If fn returns nil, the modified copy is
+	// persisted and replaces the current content, otherwise the registry is left unchanged and the error returned.
+	Update(fn func(data *RegistryData) error) error
+	// Import replaces the content of the registry with the JSON lists in dir
+	Import(dir string) error
+	// Export writes the content of the registry as JSON lists to dir
+	Export(dir string) error
+}
+
+// Bucket of the BoltDB file holding the registry, with one JSON list per component type
+var (
+	registryBucket = []byte("registry")
+	endpointsKey   = []byte("endpoints")
+	scrapersKey    = []byte("scrapers")
+	storagesKey    = []byte("storages")
+)
+
+// boltRegistry is a Registry stored in a BoltDB file. Every update is a BoltDB transaction, so it is either persisted
+// completely or not at all.
+type boltRegistry struct {
+	db        *bolt.DB
+	exportDir string     // If set, the JSON lists are exported here after every update
+	mutex     sync.Mutex // Orders the exports like the updates
+}
+
+// Opens the registry stored in file, creating it if needed. A new registry is initialized with the JSON lists found
+// in exportDir, which are kept in sync with the registry's content.
+func NewBoltRegistry(file, exportDir string) (Registry, error) {
+	db, err := bolt.Open(file, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, errors.Wrap(err, "opening registry")
+	}
+	reg := &boltRegistry{db: db, exportDir: exportDir}
+	created := false
+	err = db.Update(func(tx *bolt.Tx) error {
+		created = tx.Bucket(registryBucket) == nil
+		_, err := tx.CreateBucketIfNotExists(registryBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, errors.Wrap(err, "initializing registry")
+	}
+	if created && exportDir != "" {
+		err = reg.Import(exportDir)
+		if err != nil {
+			db.Close()
+			return nil, errors.Wrap(err, "initializing registry")
+		}
+	}
+	return reg, nil
+}
+
+// Decodes the content of the registry in tx
+func readRegistry(tx *bolt.Tx) (*RegistryData, error) {
+	data := &RegistryData{}
+	bucket := tx.Bucket(registryBucket)
+	lists := map[string]interface{}{
+		string(endpointsKey): &data.Endpoints,
+		string(scrapersKey):  &data.Scrapers,
+		string(storagesKey):  &data.Storages,
+	}
+	for key, list := range lists {
+		bts := bucket.Get([]byte(key))
+		if bts == nil {
+			continue
+		}
+		err := json.Unmarshal(bts, list)
+		if err != nil {
+			return nil, errors.Wrap(err, "decoding registry "+key)
+		}
+	}
+	data.normalize()
+	return data, nil
+}
+
+// Encodes data as the content of the registry in tx
+func writeRegistry(tx *bolt.Tx, data *RegistryData) error {
+	data.normalize()
+	bucket := tx.Bucket(registryBucket)
+	lists := map[string]interface{}{
+		string(endpointsKey): data.Endpoints,
+		string(scrapersKey):  data.Scrapers,
+		string(storagesKey):  data.Storages,
+	}
+	for key, list := range lists {
+		bts, err := json.Marshal(list)
+		if err != nil {
+			return errors.Wrap(err, "encoding registry "+key)
+		}
+		err = bucket.Put([]byte(key), bts)
+		if err != nil {
+			return errors.Wrap(err, "writing registry "+key)
+		}
+	}
+	return nil
+}
+
+func (reg *boltRegistry) View(fn func(data *RegistryData)) {
+	err := reg.db.View(func(tx *bolt.Tx) error {
+		data, err := readRegistry(tx)
+		if err != nil {
+			return err
+		}
+		fn(data)
+		return nil
+	})
+	if err != nil {
+		// The registry is only written by Update, which encodes valid lists
+		log.Printf("Registry: failed reading: %v", err)
+		fn(&RegistryData{Endpoints: []types.Endpoint{}, Scrapers: []types.Scraper{}, Storages: []types.Storage{}})
+	}
+}
+
+func (reg *boltRegistry) Update(fn func(data *RegistryData) error) error {
+	reg.mutex.Lock()
+	defer reg.mutex.Unlock()
+	var newData *RegistryData
+	err := reg.db.Update(func(tx *bolt.Tx) error {
+		data, err := readRegistry(tx)
+		if err != nil {
+			return err
+		}
+		err = fn(data)
+		if err != nil {
+			return err
+		}
+		newData = data
+		return writeRegistry(tx, data)
+	})
+	if err != nil {
+		return err
+	}
+	if reg.exportDir != "" {
+		// The registry is authoritative, so a failed export is not an error for the update
+		if err := export(newData, reg.exportDir); err != nil {
+			log.Printf("Registry: failed exporting to %s: %v", reg.exportDir, err)
+		}
+	}
+	return nil
+}
+
+func (reg *boltRegistry) Import(dir string) error {
+	imported := &RegistryData{}
+	lists := map[string]interface{}{
+		endpointsFile: &imported.Endpoints,
+		scrapersFile:  &imported.Scrapers,
+		storagesFile:  &imported.Storages,
+	}
+	for file, list := range lists {
+		path := filepath.Join(dir, file)
+		if !common.FileExists(path) {
+			continue
+		}
+		bts, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		err = json.Unmarshal(bts, list)
+		if err != nil {
+			return errors.Wrap(err, "decoding "+path)
+		}
+	}
+	return reg.Update(func(data *RegistryData) error {
+		data.Endpoints = imported.Endpoints
+		data.Scrapers = imported.Scrapers
+		data.Storages = imported.Storages
+		return nil
+	})
+}
+
+func (reg *boltRegistry) Export(dir string) error {
+	var err error
+	reg.View(func(data *RegistryData) {
+		err = export(data, dir)
+	})
+	return err
+}
+
+// Writes data as JSON lists to dir
+func export(data *RegistryData, dir string) error {
+	lists := map[string]interface{}{
+		endpointsFile: data.Endpoints,
+		scrapersFile:  data.Scrapers,
+		storagesFile:  data.Storages,
+	}
+	for file, list := range lists {
+		bts, err := json.Marshal(list)
+		if err != nil {
+			return err
+		}
+		err = common.WriteFileAtomic(filepath.Join(dir, file), bts, 0644)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"crypto/x509/pkix"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/netsec-ethz/2SMS/common"
+	"github.com/netsec-ethz/2SMS/common/types"
+	"github.com/pkg/errors"
+)
+
+// Revocation list of the CA together with the last CRL generated from it
+type revocationList struct {
+	file    string
+	crlFile string
+	entries []types.RevokedCert
+	crl     []byte
+	mutex   sync.RWMutex
+}
+
+// Loads the revoked certificates from file (if it exists) and generates a first CRL
+func newRevocationList(file, crlFile string) (*revocationList, error) {
+	rl := &revocationList{file: file, crlFile: crlFile, entries: []types.RevokedCert{}}
+	if common.FileExists(file) {
+		bts, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, errors.Wrap(err, "reading revocation list")
+		}
+		err = json.Unmarshal(bts, &rl.entries)
+		if err != nil {
+			return nil, errors.Wrap(err, "decoding revocation list")
+		}
+	}
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+	return rl, rl.refresh()
+}
+
+// Generates a new CRL, stores it and passes it to the Manager's own revocation checker. Must be called with the write
+// lock held.
+func (rl *revocationList) refresh() error {
+	revoked := []pkix.RevokedCertificate{}
+	for _, entry := range rl.entries {
+		serial, ok := new(big.Int).SetString(entry.Serial, 10)
+		if !ok {
+			log.Printf("Revocation: ignoring invalid serial %s", entry.Serial)
+			continue
+		}
+		revoked = append(revoked, pkix.RevokedCertificate{SerialNumber: serial, RevocationTime: entry.RevokedAt})
+	}
+	crl, err := ca.GenCRL(revoked, crlValidity)
+	if err != nil {
+		return errors.Wrap(err, "generating CRL")
+	}
+	err = common.WriteFileAtomic(rl.crlFile, crl, 0644)
+	if err != nil {
+		return errors.Wrap(err, "writing CRL")
+	}
+	rl.crl = crl
+	if revocationChecker != nil {
+		return revocationChecker.Update(crl)
+	}
+	return nil
+}
+
+// Regenerates the CRL every interval, so that it never expires
+func (rl *revocationList) start(interval time.Duration) {
+	go func() {
+		for range time.NewTicker(interval).C {
+			rl.mutex.Lock()
+			err := rl.refresh()
+			rl.mutex.Unlock()
+			if err != nil {
+				log.Println("Revocation: failed refreshing CRL:", err)
+			}
+		}
+	}()
+}
+
+// Adds the entry to the list, persists it and generates a new CRL. Returns false if the serial was already revoked.
+func (rl *revocationList) revoke(entry types.RevokedCert) (bool, error) {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+	for _, e := range rl.entries {
+		if e.Serial == entry.Serial {
+			return false, nil
+		}
+	}
+	entries := append(append([]types.RevokedCert{}, rl.entries...), entry)
+	bts, err := json.Marshal(entries)
+	if err != nil {
+		return false, err
+	}
+	err = common.WriteFileAtomic(rl.file, bts, 0600)
+	if err != nil {
+		return false, errors.Wrap(err, "writing revocation list")
+	}
+	rl.entries = entries
+	return true, rl.refresh()
+}
+
+func (rl *revocationList) list() []types.RevokedCert {
+	rl.mutex.RLock()
+	defer rl.mutex.RUnlock()
+	return append([]types.RevokedCert{}, rl.entries...)
+}
+
+func (rl *revocationList) currentCRL() []byte {
+	rl.mutex.RLock()
+	defer rl.mutex.RUnlock()
+	return rl.crl
+}
+
+// Returns the current CRL (DER encoded) signed by the CA.
+func getCRL(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", common.CRLContentType)
+	w.Write(revocations.currentCRL())
+}
+
+// Revokes the certificate with the given serial or the one approved for the given component type and IP.
+func revokeCert(w http.ResponseWriter, r *http.Request) {
+	log.Println("Revoke certificate received")
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Println("Error reading request body:", err)
+		w.WriteHeader(400)
+		return
+	}
+	var req types.RevocationRequest
+	if err := json.Unmarshal(data, &req); err != nil {
+		log.Println("Error unmarshalling json:", err)
+		w.WriteHeader(400)
+		return
+	}
+	entry := types.RevokedCert{Serial: req.Serial, Type: req.Type, IP: req.IP, Reason: req.Reason, RevokedAt: time.Now()}
+	crtFile := ""
+	if req.Serial == "" {
+		if req.Type == "" || req.IP == "" {
+			w.WriteHeader(400)
+			w.Write([]byte("Either serial or type and ip must be given"))
+			return
+		}
+		crtFile = approvedCertsDir + "/" + req.Type + "_" + req.IP + ".crt"
+		if !common.FileExists(crtFile) {
+			w.WriteHeader(404)
+			w.Write([]byte("Certificate doesn't exists"))
+			return
+		}
+		cert, err := common.ReadCertFromPEMFile(crtFile)
+		if err != nil || cert == nil {
+			log.Println("Failed reading certificate:", err)
+			w.WriteHeader(500)
+			return
+		}
+		entry.Serial = cert.SerialNumber.String()
+	} else if _, ok := new(big.Int).SetString(req.Serial, 10); !ok {
+		w.WriteHeader(400)
+		w.Write([]byte("Invalid serial number"))
+		return
+	} else {
+		crtFile = findApprovedCert(req.Serial)
+	}
+	added, err := revocations.revoke(entry)
+	if err != nil {
+		log.Println("Failed revoking certificate:", err)
+		w.WriteHeader(500)
+		return
+	}
+	if !added {
+		log.Printf("Certificate %s is already revoked", entry.Serial)
+	} else {
+		log.Printf("Revoked certificate %s %s %s", entry.Serial, entry.Type, entry.IP)
+	}
+	// Keep the revoked certificate aside, so that a new one can be issued for the component
+	if crtFile != "" {
+		err = os.Rename(crtFile, fmt.Sprintf("%s.%s.revoked", crtFile, entry.Serial))
+		if err != nil {
+			log.Println("Failed moving revoked certificate:", err)
+		}
+	}
+	w.WriteHeader(204)
+}
+
+// Returns the approved certificate file with the given serial, or "" if there is none
+func findApprovedCert(serial string) string {
+	files, err := ioutil.ReadDir(approvedCertsDir)
+	if err != nil {
+		log.Println("Failed reading approved certificates:", err)
+		return ""
+	}
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), ".crt") {
+			continue
+		}
+		cert, err := common.ReadCertFromPEMFile(approvedCertsDir + "/" + file.Name())
+		if err == nil && cert != nil && cert.SerialNumber.String() == serial {
+			return approvedCertsDir + "/" + file.Name()
+		}
+	}
+	return ""
+}
+
+// Returns the list of revoked certificates.
+func listRevokedCerts(w http.ResponseWriter, r *http.Request) {
+	log.Println("List revoked certificates received")
+	jsonList, err := json.Marshal(revocations.list())
+	if err != nil {
+		log.Println("Error while marshalling json:", err)
+		w.WriteHeader(500)
+		return
+	}
+	w.Write(jsonList)
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/netsec-ethz/2SMS/common/types"
+	"github.com/pkg/errors"
+)
+
+// Assigns the storage to all scrapers covering its ISD and returns these scrapers
+func assignStorageToScrapers(str *types.Storage) []types.Scraper {
+	assignedTo := []types.Scraper{}
+	isd := strings.Split(str.IA, "-")[0]
+	for _, scr := range getScrapers() {
+		if scr.Covers(isd) {
+			assignStorageToScraper(str, &scr)
+			assignedTo = append(assignedTo, scr)
+		}
+	}
+	return assignedTo
+}
+
+// Assigns all registered storages in the ISDs covered by the scraper to it
+func assignStoragesToScraper(scr *types.Scraper) {
+	for _, str := range getStorages() {
+		if scr.Covers(strings.Split(str.IA, "-")[0]) {
+			assignStorageToScraper(&str, scr)
+		}
+	}
+}
+
+// Authorizes the scraper at the storage, then adds the storage as remote write/read to the scraper
+func assignStorageToScraper(str *types.Storage, scr *types.Scraper) {
+	jsonScraper, err := json.Marshal(scr)
+	if err != nil {
+		log.Println("Failed marshaling json:", err)
+		return
+	}
+	err = sendJSON("POST", "https://"+str.IP+":"+str.ManagePort+"/scrapers", jsonScraper)
+	if err != nil {
+		log.Printf("Failed authorizing scraper %s at storage %s: %v", scr.IP, str.IP, err)
+		return
+	}
+	jsonStorage, err := json.Marshal(str)
+	if err != nil {
+		log.Println("Failed marshaling json:", err)
+		return
+	}
+	err = sendJSON("POST", "https://"+scr.IP+":"+scr.ManagePort+"/storages", jsonStorage)
+	if err != nil {
+		log.Printf("Failed adding storage %s to scraper %s: %v", str.IP, scr.IP, err)
+		return
+	}
+	log.Printf("Assigned storage %s %s to scraper %s %s", str.IA, str.IP, scr.IA, scr.IP)
+}
+
+// Removes the storage from all scrapers covering its ISD and their authorizations at the storage
+func unassignStorage(str *types.Storage) {
+	jsonStorage, err := json.Marshal(str)
+	if err != nil {
+		log.Println("Failed marshaling json:", err)
+		return
+	}
+	isd := strings.Split(str.IA, "-")[0]
+	for _, scr := range getScrapers() {
+		if !scr.Covers(isd) {
+			continue
+		}
+		err = sendJSON("DELETE", "https://"+scr.IP+":"+scr.ManagePort+"/storages", jsonStorage)
+		if err != nil {
+			log.Printf("Failed removing storage %s from scraper %s: %v", str.IP, scr.IP, err)
+		}
+		jsonScraper, err := json.Marshal(scr)
+		if err != nil {
+			log.Println("Failed marshaling json:", err)
+			continue
+		}
+		err = sendJSON("DELETE", "https://"+str.IP+":"+str.ManagePort+"/scrapers", jsonScraper)
+		if err != nil {
+			log.Printf("Failed removing authorization of scraper %s at storage %s: %v", scr.IP, str.IP, err)
+		}
+	}
+}
+
+// Removes the authorization of the scraper at all storages in the ISDs it covers
+func unauthorizeScraperAtStorages(scr *types.Scraper) {
+	jsonScraper, err := json.Marshal(scr)
+	if err != nil {
+		log.Println("Failed marshaling json:", err)
+		return
+	}
+	for _, str := range getStorages() {
+		if !scr.Covers(strings.Split(str.IA, "-")[0]) {
+			continue
+		}
+		err = sendJSON("DELETE", "https://"+str.IP+":"+str.ManagePort+"/scrapers", jsonScraper)
+		if err != nil {
+			log.Printf("Failed removing authorization of scraper %s at storage %s: %v", scr.IP, str.IP, err)
+		}
+	}
+}
+
+// Sends a request with a json body to a component's management API and checks that it succeeded
+func sendJSON(method, url string, body []byte) error {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := httpsClient.Do(req)
+	countFanout(method, resp, err)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return errors.Errorf("status code %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Assigns all registered storages in the ISDs covered by the scraper to it.
+func syncScraperStorages(w http.ResponseWriter, r *http.Request) {
+	// Get scraper by ip address in path
+	scraper := getScraperByIP(strings.Split(mux.Vars(r)["addr"], ":")[0])
+	if scraper == nil {
+		w.WriteHeader(404)
+		return
+	}
+	assignStoragesToScraper(scraper)
+	w.WriteHeader(204)
+}
@@ -19,4 +19,16 @@ func (config *Config) ContainsTarget(target *types.Target) bool {
 		}
 	}
 	return false
-}
\ No newline at end of file
+}
+
+// Whether the remote write or the remote read configuration of the storage is present
+func (config *Config) ContainsStorage(storage *types.Storage) bool {
+	write, read := false, false
+	for _, rw := range config.RemoteWrites {
+		write = write || rw.URL == storage.BuildWriteURL()
+	}
+	for _, rr := range config.RemoteReads {
+		read = read || rr.URL == storage.BuildReadURL()
+	}
+	return write || read
+}
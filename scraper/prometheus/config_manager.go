@@ -9,28 +9,39 @@ import (
 	"net/http"
 	"os"
 	"regexp"
+	"sync"
 	"time"
 
+	"github.com/netsec-ethz/2SMS/common"
 	"github.com/pkg/errors"
 )
 
+var configReloads = common.NewCounterVec("twosms_scraper_prometheus_reloads_total", "Reloads of the Prometheus server after configuration updates, by result (ok or error).", "result")
+
 type ConfigManager struct {
 	configFile    string	// Path to the prometheus configuration file
 	scraperProxyURL	string	// Proxy URL from the Prometheus server to the Scraper component
+	writeProxyURL	string	// Proxy URL from the Prometheus server to the Storage components (remote write and read)
 	promListenURL string	// Base URL where the Prometheus API is exposed
 	addChannel chan *types.Target
 	removeChannel chan *types.Target
+	addStorageChannel chan *types.Storage
+	removeStorageChannel chan *types.Storage
 	updateTicker *time.Ticker
 	config 		*Config
+	mutex		sync.RWMutex	// Protects config, which is modified by the update loop
 }
 
-func CreateConfigManager(configFilePath, promListenURL, scraperProxyURL string, updateFrequency, updatesBufferSize int) (*ConfigManager, error) {
+func CreateConfigManager(configFilePath, promListenURL, scraperProxyURL, writeProxyURL string, updateFrequency, updatesBufferSize int) (*ConfigManager, error) {
 	configManager := ConfigManager{
 		configFile: configFilePath,
 		scraperProxyURL: scraperProxyURL,
+		writeProxyURL: writeProxyURL,
 		promListenURL: promListenURL,
 		addChannel: make(chan *types.Target, updatesBufferSize),
 		removeChannel: make(chan *types.Target, updatesBufferSize),
+		addStorageChannel: make(chan *types.Storage, updatesBufferSize),
+		removeStorageChannel: make(chan *types.Storage, updatesBufferSize),
 		updateTicker: time.NewTicker(time.Duration(updateFrequency) * time.Second),
 	}
 
@@ -50,8 +61,11 @@ func (cm *ConfigManager) Start() {
 			additions := len(toAdd)
 			toRemove := readChannelTargets(cm.removeChannel)
 			removals := len(toRemove)
-			if additions + removals > 0 {
+			storagesToAdd := readChannelStorages(cm.addStorageChannel)
+			storagesToRemove := readChannelStorages(cm.removeStorageChannel)
+			if additions + removals + len(storagesToAdd) + len(storagesToRemove) > 0 {
 				log.Println("ConfigManager: Updating Prometheus configuration.")
+				cm.mutex.Lock()
 				added, removed := 0, 0
 				if additions > 0 {
 					added = cm.addTargets(toAdd, cm.config)
@@ -61,10 +75,21 @@ func (cm *ConfigManager) Start() {
 					removed = cm.removeTargets(toRemove, cm.config)
 					log.Printf("ConfigManager: Removed %d/%d targets from the configuration.", removed, removals)
 				}
+				if len(storagesToAdd) > 0 {
+					addedStorages := cm.addStorages(storagesToAdd, cm.config)
+					log.Printf("ConfigManager: Added %d/%d storages to the configuration.", addedStorages, len(storagesToAdd))
+					added += addedStorages
+				}
+				if len(storagesToRemove) > 0 {
+					removedStorages := cm.removeStorages(storagesToRemove, cm.config)
+					log.Printf("ConfigManager: Removed %d/%d storages from the configuration.", removedStorages, len(storagesToRemove))
+					removed += removedStorages
+				}
 
 				if added + removed > 0 {
 					// Write updated configuration to file
 					err := cm.writeConfig()
+					cm.mutex.Unlock()
 					if err != nil {
 						log.Printf("ConfigManager: Failed writing configuration to file. Error is: %v", err)
 						continue
@@ -74,15 +99,32 @@ func (cm *ConfigManager) Start() {
 					err = cm.ReloadPrometheus()
 					if err != nil {
 						log.Printf("ConfigManager: Failed reloading the Prometheus server. Error is: %v", err)
+						configReloads.Inc("error")
 						continue
 					}
+					configReloads.Inc("ok")
 					log.Printf("ConfigManager: Successfully reloaded the Prometheus server.")
+				} else {
+					cm.mutex.Unlock()
 				}
 			}
 		}
 	}()
 }
 
+func readChannelStorages(channel <-chan *types.Storage) []*types.Storage {
+	var storages []*types.Storage
+	// Non-blocking reading of all values in channel
+	for {
+		select {
+		case storage := <-channel:
+			storages = append(storages, storage)
+		default:
+			return storages
+		}
+	}
+}
+
 func readChannelTargets(channel <-chan *types.Target) []*types.Target {
 	var targets []*types.Target
 	// Non-blocking reading of all values in channel
@@ -116,6 +158,31 @@ func (cm *ConfigManager) RemoveTargets(targets []types.Target) {
 	}
 }
 
+func (cm *ConfigManager) AddStorage(storage types.Storage) {
+	cm.addStorageChannel <- &storage
+}
+
+func (cm *ConfigManager) RemoveStorage(storage types.Storage) {
+	cm.removeStorageChannel <- &storage
+}
+
+// Returns the storages that samples are written to (and read from) through the write proxy
+func (cm *ConfigManager) GetStorages() []*types.Storage {
+	cm.mutex.RLock()
+	defer cm.mutex.RUnlock()
+	storages := []*types.Storage{}
+	for _, rw := range cm.config.RemoteWrites {
+		if rw.ProxyURL != cm.writeProxyURL {
+			continue
+		}
+		storage := storageFromRemoteWrite(rw)
+		if storage != nil {
+			storages = append(storages, storage)
+		}
+	}
+	return storages
+}
+
 func (cm *ConfigManager) ReloadPrometheus() error {
 	resp, err := http.Post(cm.promListenURL+"/-/reload", "application/json", nil)
 	if err != nil {
@@ -215,6 +282,8 @@ func (cm *ConfigManager) removeTargets(targets []*types.Target, configuration *C
 }
 
 func (cm *ConfigManager) GetTargets() []*types.Target {
+	cm.mutex.RLock()
+	defer cm.mutex.RUnlock()
 	var targets []*types.Target
 	for _, sc := range cm.config.ScrapeConfigs {
 		targets = append(targets, targetFromScrapeConfig(sc))
@@ -272,4 +341,66 @@ func targetFromScrapeConfig(scrapeConfig *ScrapeConfig) *types.Target {
 		target.AS = target.Labels["AS"]
 	}
 	return &target
-}
\ No newline at end of file
+}
+
+// Adds a remote write and a remote read configuration for each of the given storages but duplicates and returns the
+// number of added storages.
+func (cm *ConfigManager) addStorages(storages []*types.Storage, configuration *Config) int {
+	added := 0
+	for _, storage := range storages {
+		if configuration.ContainsStorage(storage) {
+			log.Printf("ConfigManager: Storage %s %s is already present in the configuration.", storage.IA, storage.IP)
+			continue
+		}
+		configuration.RemoteWrites = append(configuration.RemoteWrites, &RemoteWriteConfig{
+			URL:      storage.BuildWriteURL(),
+			ProxyURL: cm.writeProxyURL,
+		})
+		configuration.RemoteReads = append(configuration.RemoteReads, &RemoteReadConfig{
+			URL:      storage.BuildReadURL(),
+			ProxyURL: cm.writeProxyURL,
+		})
+		added++
+		log.Printf("ConfigManager: Added storage %s %s to the configuration.", storage.IA, storage.IP)
+	}
+	return added
+}
+
+func (cm *ConfigManager) removeStorages(storages []*types.Storage, configuration *Config) int {
+	removed := 0
+	for _, storage := range storages {
+		if !configuration.ContainsStorage(storage) {
+			log.Printf("ConfigManager: Storage %s %s not found in the configuration.", storage.IA, storage.IP)
+			continue
+		}
+		var newWrites []*RemoteWriteConfig
+		for _, rw := range configuration.RemoteWrites {
+			if rw.URL != storage.BuildWriteURL() {
+				newWrites = append(newWrites, rw)
+			}
+		}
+		configuration.RemoteWrites = newWrites
+		var newReads []*RemoteReadConfig
+		for _, rr := range configuration.RemoteReads {
+			if rr.URL != storage.BuildReadURL() {
+				newReads = append(newReads, rr)
+			}
+		}
+		configuration.RemoteReads = newReads
+		removed++
+		log.Printf("ConfigManager: Removed storage %s %s from the configuration.", storage.IA, storage.IP)
+	}
+	return removed
+}
+
+// Parses a remote write URL built by types.Storage.BuildWriteURL (http://IP:Port/IA/write). The manage port is not
+// part of the configuration and is left empty.
+func storageFromRemoteWrite(rw *RemoteWriteConfig) *types.Storage {
+	re := regexp.MustCompile(`^http://(.+):(\d+)/(.+)/write$`)
+	groups := re.FindStringSubmatch(rw.URL)
+	if len(groups) != 4 {
+		log.Printf("Reading Storage from prometheus configuration: could not parse remote write url '%s'", rw.URL)
+		return nil
+	}
+	return &types.Storage{IP: groups[1], Port: groups[2], IA: groups[3]}
+}
@@ -1,5 +1,6 @@
 package prometheus
 
 type RemoteWriteConfig struct {
-	URL string
-}
\ No newline at end of file
+	URL      string `yaml:"url"`
+	ProxyURL string `yaml:"proxy_url,omitempty"`
+}
@@ -9,6 +9,8 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/netsec-ethz/2SMS/common"
 	"github.com/netsec-ethz/scion-apps/lib/scionutil"
@@ -16,20 +18,54 @@ import (
 	"github.com/scionproto/scion/go/lib/snet"
 )
 
+var (
+	proxyRequests  = common.NewCounterVec("twosms_scraper_proxy_requests_total", "Requests forwarded by the scraping and remote writing proxies, by transport (scion or ip) and result (ok, not_found or error).", "transport", "result")
+	proxyDuration  = common.NewHistogramVec("twosms_scraper_proxy_request_duration_seconds", "Duration of the requests forwarded by the proxies, by transport.", common.DurationBuckets, "transport")
+	scionFallbacks = common.NewCounterVec("twosms_scraper_scion_fallbacks_total", "Requests retried over IP after failing over SCION.")
+)
+
 type scraperProxyHandler struct {
-	ipClient    *http.Client
-	scionClient *http.Client
-	enableQUIC  bool
+	ipClient   *http.Client
+	enableQUIC bool
 }
 
+// Client used by all proxies over SCION, replaced by ReloadSCIONClient
+var (
+	scionClient      *http.Client
+	scionClientMutex sync.RWMutex
+)
+
 func CreateScraperProxyHandler(scraperCACertsDir, scraperCert, scraperPrivKey string, localAddress *snet.Addr, enableQUIC bool) *scraperProxyHandler {
 	ipClient := common.CreateHttpsClient(scraperCACertsDir, scraperCert, scraperPrivKey)
-	scionClient := &http.Client{
+	scionClientMutex.Lock()
+	if scionClient == nil {
+		scionClient = newSCIONClient(localAddress)
+	}
+	scionClientMutex.Unlock()
+	return &scraperProxyHandler{ipClient: ipClient, enableQUIC: enableQUIC}
+}
+
+func newSCIONClient(localAddress *snet.Addr) *http.Client {
+	return &http.Client{
 		Transport: &shttp.Transport{
 			LAddr: localAddress,
 		},
 	}
-	return &scraperProxyHandler{ipClient: ipClient, scionClient: scionClient, enableQUIC: enableQUIC}
+}
+
+// Replaces the SCION client of the proxies with a new one, so that a renewed certificate is used for new requests.
+// Unlike the IP client, the SCION transport loads the certificate only when it is created.
+func ReloadSCIONClient() {
+	scionClientMutex.Lock()
+	defer scionClientMutex.Unlock()
+	scionClient = newSCIONClient(&local)
+	log.Println("Reloaded SCION client with the renewed certificate")
+}
+
+func currentSCIONClient() *http.Client {
+	scionClientMutex.RLock()
+	defer scionClientMutex.RUnlock()
+	return scionClient
 }
 
 // When receiving an HTTP request try to forward it to its destination using HTTPS over SCION. Would an error occur
@@ -67,6 +103,7 @@ func (sph *scraperProxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request
 
 		if err != nil {
 			log.Printf("Failed: SCION/HTTPS request to %s. Error is: %v", requestURL, err)
+			scionFallbacks.Inc()
 		} else if resp.StatusCode == http.StatusNotFound {
 			// If we couldn't find the path then we don't need to try with IP because it will lead to the same result.
 			log.Printf("Failed: SCION/HTTPS request to %s. Path was not found (404).", requestURL)
@@ -118,10 +155,21 @@ func (sph *scraperProxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request
 }
 
 func (sph *scraperProxyHandler) forwardRequest(overSCION bool, w http.ResponseWriter, url string, r *http.Request) (resp *http.Response, err error) {
-	client := sph.scionClient
+	client, transport := currentSCIONClient(), "scion"
 	if !overSCION {
-		client = sph.ipClient
+		client, transport = sph.ipClient, "ip"
 	}
+	start := time.Now()
+	defer func() {
+		proxyDuration.ObserveSince(start, transport)
+		if err != nil {
+			proxyRequests.Inc(transport, "error")
+		} else if resp.StatusCode == http.StatusNotFound {
+			proxyRequests.Inc(transport, "not_found")
+		} else {
+			proxyRequests.Inc(transport, "ok")
+		}
+	}()
 	if r.Method == http.MethodGet {
 		resp, err = client.Get(fmt.Sprintf("https://%s", url))
 	} else if r.Method == http.MethodPost {
@@ -22,6 +22,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net"
+	"net/url"
 	"strings"
 
 	"github.com/netsec-ethz/2SMS/common/types"
@@ -62,8 +63,13 @@ var (
 	sciond                    = flag.String("sciond", "", "Path to sciond socket")
 	dispatcher                = flag.String("dispatcher", "/run/shm/dispatcher/default.sock",
 		"Path to dispatcher socket")
-	isdCoverage string
-	enableSQUIC bool
+	isdCoverage       string
+	enableSQUIC       bool
+	heartbeatInterval time.Duration
+	crlRefresh        time.Duration
+	renewBefore       time.Duration
+	renewCheck        time.Duration
+	enrollToken       string
 )
 
 func initScraper() {
@@ -95,6 +101,11 @@ func initScraper() {
 	flag.StringVar(&managerIP, "manager.IP", "", "ip address of the managers")
 	flag.StringVar(&managerUnverifPort, "manager.unverif-port", "10000", "port where manager listens for certificate request")
 	flag.StringVar(&managerVerifPort, "manager.verif-port", "10001", "port where manager listens for authenticated operations")
+	flag.DurationVar(&heartbeatInterval, "manager.heartbeat", 30*time.Second, "interval between heartbeats sent to the manager")
+	flag.DurationVar(&crlRefresh, "manager.crl-refresh", 5*time.Minute, "interval between downloads of the manager's certificate revocation list")
+	flag.DurationVar(&renewBefore, "scraper.cert-renew-before", 30*24*time.Hour, "time before expiration at which the certificate is renewed")
+	flag.StringVar(&enrollToken, "scraper.enroll-token", "", "one-time enrollment token issued by the manager, the certificate request must be approved otherwise")
+	flag.DurationVar(&renewCheck, "scraper.cert-renew-check", 12*time.Hour, "interval between checks of the certificate's expiration")
 	flag.StringVar(&isdCoverage, "scraper.coverage", "", "comma separated list of ISD numbers for which the scraper should accept targets")
 
 	flag.Parse()
@@ -132,21 +143,30 @@ func initScraper() {
 			Province:           []string{"Zurich"},
 			Locality:           []string{"Zurich"},
 		}
-		bts, _ = common.GenCertSignRequest(name, privKey, []string{scraperDNS}, []net.IP{net.ParseIP(scraperIP)})
+		bts, _ = common.GenCertSignRequest(name, privKey, []string{scraperDNS}, []net.IP{net.ParseIP(scraperIP)}, []*url.URL{common.IAURI(local.IA)})
 		common.WriteToPEMFile(scraperCSR, "CERTIFICATE REQUEST", bts)
 	}
 	if !common.FileExists(scraperCert) {
 		if managerIP != "" {
-			common.RequestAndObtainCert(caCertsDir, managerIP, managerUnverifPort, scraperCert, scraperCSR, "Scraper", scraperIP)
+			common.RequestAndObtainCert(caCertsDir, managerIP, managerUnverifPort, scraperCert, scraperCSR, "Scraper", scraperIP, enrollToken)
 		} else {
 			log.Fatal("No certificate found and no connection with manager. Please manually generate and upload a certificate for the csr.")
 		}
 	}
+	// Reject peers whose certificate was revoked by the manager and renew our own before it expires
+	if managerIP != "" {
+		err = common.StartRevocationCheck(caCertsDir, "https://"+managerIP+":"+managerUnverifPort+"/crl", crlRefresh)
+		if err != nil {
+			log.Fatal("Failed starting revocation check:", err)
+		}
+		common.StartCertRenewal(caCertsDir, scraperCert, scraperPrivKey, scraperCSR, "https://"+managerIP+":"+managerVerifPort+"/certificate/renew", local.IA, renewBefore, renewCheck, ReloadSCIONClient)
+	}
 
 	configManager, err = prometheus.CreateConfigManager(
 		prometheusConfig,
 		"http://127.0.0.1:" + prometheusListenPort + prometheusRoutePrefix,
 		"http://127.0.0.1:" + internalScrapePort,
+		"http://127.0.0.1:" + internalWritePort,
 		prometheusUpdateFrequency,
 		200,
 	)
@@ -177,6 +197,11 @@ func initScraper() {
 			message, _ := ioutil.ReadAll(resp.Body)
 			log.Fatal("Registration failed. Status code:", resp.StatusCode, "Message:", message)
 		}
+		common.StartHeartbeat(client, "https://"+managerIP+":"+managerVerifPort+"/scrapers/heartbeat", types.Heartbeat{
+			IA:         local.IA.String(),
+			IP:         local.Host.L3.IP().String(),
+			ManagePort: managementAPIPort,
+		}, heartbeatInterval)
 	}
 }
 
@@ -248,6 +273,7 @@ func main() {
 	router.HandleFunc("/storages", ListStorages).Methods("GET")
 	router.HandleFunc("/storages", AddStorage).Methods("POST")
 	router.HandleFunc("/storages", RemoveStorage).Methods("DELETE")
+	router.HandleFunc("/metrics", common.SelfMetricsHandler).Methods("GET")
 
 	go func() {
 		srv := &http.Server{
@@ -259,5 +285,5 @@ func main() {
 
 	srv := common.CreateHttpsServer(caCertsDir, scraperCert, scraperPrivKey, "", managementAPIPort, router, tls.RequireAndVerifyClientCert)
 	log.Println("Starting management server")
-	log.Fatal("Management server listening error: ", srv.ListenAndServeTLS(scraperCert, scraperPrivKey))
+	log.Fatal("Management server listening error: ", srv.ListenAndServeTLS("", ""))
 }
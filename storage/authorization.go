@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sync"
+
+	"github.com/netsec-ethz/2SMS/common"
+	"github.com/netsec-ethz/2SMS/common/types"
+	"github.com/pkg/errors"
+)
+
+// Scrapers allowed to write to and read from the storage, as assigned by the Manager. Persisted in a file.
+type scraperAuthorizations struct {
+	file     string
+	scrapers []types.Scraper
+	mutex    sync.RWMutex
+}
+
+func loadScraperAuthorizations(file string) (*scraperAuthorizations, error) {
+	sa := &scraperAuthorizations{file: file, scrapers: []types.Scraper{}}
+	if common.FileExists(file) {
+		bts, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, errors.Wrap(err, "reading authorized scrapers")
+		}
+		err = json.Unmarshal(bts, &sa.scrapers)
+		if err != nil {
+			return nil, errors.Wrap(err, "decoding authorized scrapers")
+		}
+	}
+	return sa, nil
+}
+
+// Persists scrapers and makes them the authorized ones. Must be called with the write lock held.
+func (sa *scraperAuthorizations) save(scrapers []types.Scraper) error {
+	bts, err := json.Marshal(scrapers)
+	if err != nil {
+		return err
+	}
+	err = common.WriteFileAtomic(sa.file, bts, 0600)
+	if err != nil {
+		return err
+	}
+	sa.scrapers = scrapers
+	return nil
+}
+
+func (sa *scraperAuthorizations) add(scr *types.Scraper) error {
+	sa.mutex.Lock()
+	defer sa.mutex.Unlock()
+	for _, s := range sa.scrapers {
+		if s.IA == scr.IA && s.IP == scr.IP {
+			return nil
+		}
+	}
+	return sa.save(append(append([]types.Scraper{}, sa.scrapers...), *scr))
+}
+
+func (sa *scraperAuthorizations) remove(scr *types.Scraper) error {
+	sa.mutex.Lock()
+	defer sa.mutex.Unlock()
+	scrapers := []types.Scraper{}
+	for _, s := range sa.scrapers {
+		if s.IA != scr.IA || s.IP != scr.IP {
+			scrapers = append(scrapers, s)
+		}
+	}
+	return sa.save(scrapers)
+}
+
+func (sa *scraperAuthorizations) list() []types.Scraper {
+	sa.mutex.RLock()
+	defer sa.mutex.RUnlock()
+	return append([]types.Scraper{}, sa.scrapers...)
+}
+
+// Whether a scraper with the given IA and IP is authorized
+func (sa *scraperAuthorizations) authorized(ia, ip string) bool {
+	sa.mutex.RLock()
+	defer sa.mutex.RUnlock()
+	for _, s := range sa.scrapers {
+		if s.IP == ip && s.IA == ia {
+			return true
+		}
+	}
+	return false
+}
+
+// Only lets requests with a Manager certificate through
+func managerOnly(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+			w.WriteHeader(403)
+			return
+		}
+		for _, ou := range r.TLS.PeerCertificates[0].Subject.OrganizationalUnit {
+			if ou == "Manager" {
+				handler.ServeHTTP(w, r)
+				return
+			}
+		}
+		log.Printf("Rejected management request from %s: not the manager", r.RemoteAddr)
+		w.WriteHeader(403)
+	})
+}
+
+func readScraper(r *http.Request) (*types.Scraper, error) {
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	var scr types.Scraper
+	err = json.Unmarshal(data, &scr)
+	if err != nil {
+		return nil, err
+	}
+	return &scr, nil
+}
+
+func listAuthorizedScrapers(w http.ResponseWriter, r *http.Request) {
+	jsonScrapers, err := json.Marshal(authorizations.list())
+	if err != nil {
+		log.Println("Error while marshalling json:", err)
+		w.WriteHeader(500)
+		return
+	}
+	w.Write(jsonScrapers)
+}
+
+func authorizeScraper(w http.ResponseWriter, r *http.Request) {
+	scr, err := readScraper(r)
+	if err != nil {
+		log.Println("Error reading scraper:", err)
+		w.WriteHeader(400)
+		return
+	}
+	err = authorizations.add(scr)
+	if err != nil {
+		log.Println("Error authorizing scraper:", err)
+		w.WriteHeader(500)
+		return
+	}
+	log.Printf("Authorized scraper %s %s", scr.IA, scr.IP)
+	w.WriteHeader(204)
+}
+
+func unauthorizeScraper(w http.ResponseWriter, r *http.Request) {
+	scr, err := readScraper(r)
+	if err != nil {
+		log.Println("Error reading scraper:", err)
+		w.WriteHeader(400)
+		return
+	}
+	err = authorizations.remove(scr)
+	if err != nil {
+		log.Println("Error removing scraper authorization:", err)
+		w.WriteHeader(500)
+		return
+	}
+	log.Printf("Removed authorization of scraper %s %s", scr.IA, scr.IP)
+	w.WriteHeader(204)
+}
@@ -23,6 +23,9 @@ import (
 
 	"io/ioutil"
 	"net"
+	"net/url"
+	"sync"
+	"time"
 
 	quic "github.com/lucas-clemente/quic-go"
 	"github.com/netsec-ethz/2SMS/common/types"
@@ -54,6 +57,13 @@ var (
 	writePath               string
 	readPath                string
 	dbName                  string
+	heartbeatInterval       time.Duration
+	crlRefresh              time.Duration
+	renewBefore             time.Duration
+	renewCheck              time.Duration
+	enrollToken             string
+	authorizedScrapersFile  string
+	authorizations          *scraperAuthorizations
 )
 
 func init() {
@@ -74,10 +84,16 @@ func init() {
 	flag.StringVar(&managerIP, "manager.IP", "", "ip address of the manager")
 	flag.StringVar(&managerUnverifPort, "manager.unverif-port", "10000", "port where manager listens for certificate request")
 	flag.StringVar(&managerVerifPort, "manager.verif-port", "10001", "port where manager listens for authenticated operations")
+	flag.DurationVar(&heartbeatInterval, "manager.heartbeat", 30*time.Second, "interval between heartbeats sent to the manager")
+	flag.DurationVar(&crlRefresh, "manager.crl-refresh", 5*time.Minute, "interval between downloads of the manager's certificate revocation list")
+	flag.DurationVar(&renewBefore, "storage.cert-renew-before", 30*24*time.Hour, "time before expiration at which the certificate is renewed")
+	flag.StringVar(&enrollToken, "storage.enroll-token", "", "one-time enrollment token issued by the manager, the certificate request must be approved otherwise")
+	flag.DurationVar(&renewCheck, "storage.cert-renew-check", 12*time.Hour, "interval between checks of the certificate's expiration")
 
 	flag.StringVar(&writePath, "storage.write", "/api/v1/prom/write", "Path for writing to the database")
 	flag.StringVar(&readPath, "storage.read", "/api/v1/prom/read", "Path for reading from the database")
 	flag.StringVar(&dbName, "storage.database", "prometheus", "Name of the database")
+	flag.StringVar(&authorizedScrapersFile, "storage.authorized-scrapers", "auth/authorized_scrapers.json", "file where the scrapers authorized by the manager are stored")
 
 	flag.Var((*snet.Addr)(&local), "local", "(Mandatory) address to listen on")
 
@@ -97,8 +113,15 @@ func init() {
 	// Initialize scion network
 	common.InitNetwork(local, sciond, dispatcher)
 
+	// Load the scrapers allowed to write and read
+	var err error
+	authorizations, err = loadScraperAuthorizations(authorizedScrapersFile)
+	if err != nil {
+		log.Fatal("Failed loading authorized scrapers:", err)
+	}
+
 	// Bootstrap PKI
-	err := common.Bootstrap(caCertsDir+"/ca.crt", caCertsDir+"/bootstrap.json")
+	err = common.Bootstrap(caCertsDir+"/ca.crt", caCertsDir+"/bootstrap.json")
 	if err != nil {
 		log.Fatal("Verification of ca certificate failed:", err)
 	} else {
@@ -118,16 +141,25 @@ func init() {
 			Province:           []string{"Zurich"},
 			Locality:           []string{"Zurich"},
 		}
-		bts, _ = common.GenCertSignRequest(name, privKey, []string{storageDNS}, []net.IP{net.ParseIP(storageIP)})
+		bts, _ = common.GenCertSignRequest(name, privKey, []string{storageDNS}, []net.IP{net.ParseIP(storageIP)}, []*url.URL{common.IAURI(local.IA)})
 		common.WriteToPEMFile(storageCSR, "CERTIFICATE REQUEST", bts)
 	}
 	if !common.FileExists(storageCert) {
 		if managerIP != "" {
-			common.RequestAndObtainCert(caCertsDir, managerIP, managerUnverifPort, storageCert, storageCSR, "Storage", storageIP)
+			common.RequestAndObtainCert(caCertsDir, managerIP, managerUnverifPort, storageCert, storageCSR, "Storage", storageIP, enrollToken)
 		} else {
 			log.Fatal("No certificate found and no connection with manager. Please manually generate and upload a certificate for the csr.")
 		}
 	}
+	// Reject peers whose certificate was revoked by the manager and renew our own before it expires
+	if managerIP != "" {
+		err = common.StartRevocationCheck(caCertsDir, "https://"+managerIP+":"+managerUnverifPort+"/crl", crlRefresh)
+		if err != nil {
+			log.Fatal("Failed starting revocation check:", err)
+		}
+		// The SCION listener reads the certificate only when it starts, so it is restarted after a renewal
+		common.StartCertRenewal(caCertsDir, storageCert, storagePrivKey, storageCSR, "https://"+managerIP+":"+managerVerifPort+"/certificate/renew", local.IA, renewBefore, renewCheck, restartSCIONListener)
+	}
 
 	// Register at manager
 	if managerIP != "" {
@@ -149,6 +181,11 @@ func init() {
 			message, _ := ioutil.ReadAll(resp.Body)
 			log.Fatal("Registration failed. Status code:", resp.StatusCode, "Message:", message)
 		}
+		common.StartHeartbeat(client, "https://"+managerIP+":"+managerVerifPort+"/storages/heartbeat", types.Heartbeat{
+			IA:         local.IA.String(),
+			IP:         local.Host.IP().String(),
+			ManagePort: managementAPIPort,
+		}, heartbeatInterval)
 	}
 }
 
@@ -159,16 +196,13 @@ func main() {
 	go func() {
 		log.Println("Starting HTTPS server")
 
-		srv := common.CreateHttpsServer(caCertsDir, storageIP, externalPort, &handler{http.Client{}}, tls.RequireAndVerifyClientCert)
+		srv := common.CreateHttpsServer(caCertsDir, storageCert, storagePrivKey, "", externalPort, &handler{http.Client{}}, tls.RequireAndVerifyClientCert)
 
-		log.Fatal("HTTPS server listening error: ", srv.ListenAndServeTLS(storageCert, storagePrivKey))
+		log.Fatal("HTTPS server listening error: ", srv.ListenAndServeTLS("", ""))
 	}()
 
 	// SCION server
 	go func() {
-		log.Println("Starting SCION server")
-		squic.Init(storagePrivKey, storageCert)
-
 		// Initialize HTTP client
 		tr := &http.Transport{
 			DisableCompression: true,
@@ -176,53 +210,122 @@ func main() {
 		client := &http.Client{
 			Transport: tr,
 		}
+		serveSCION(client)
+	}()
+
+	// Management Server
+	router := mux.NewRouter()
+	router.HandleFunc("/scrapers", listAuthorizedScrapers).Methods("GET")
+	router.HandleFunc("/scrapers", authorizeScraper).Methods("POST")
+	router.HandleFunc("/scrapers", unauthorizeScraper).Methods("DELETE")
+	router.HandleFunc("/metrics", common.SelfMetricsHandler).Methods("GET")
 
+	go func() {
+		srv := &http.Server{
+			Addr:    "127.0.0.1:" + localhostManagementPort,
+			Handler: router,
+		}
+		log.Println("localhost HTTP server listening error: ", srv.ListenAndServe())
+	}()
+
+	// Only the manager assigns scrapers to the storage
+	srv := common.CreateHttpsServer(caCertsDir, storageCert, storagePrivKey, "", managementAPIPort, managerOnly(router), tls.RequireAndVerifyClientCert)
+	log.Println("Starting HTTPS management server")
+	log.Fatal("HTTPS server listening error: ", srv.ListenAndServeTLS("", ""))
+}
+
+var (
+	scionListener        quic.Listener
+	scionListenerMutex   sync.Mutex
+	scionListenerRestart = make(chan struct{}, 1)
+)
+
+// Accepts QUIC sessions on the SCION address until the listener fails. When it is closed by restartSCIONListener it
+// listens again, loading the certificate from disk.
+func serveSCION(client *http.Client) {
+	for {
+		log.Println("Starting SCION server")
+		err := squic.Init(storagePrivKey, storageCert)
+		if err != nil {
+			log.Fatal("Unable to load the certificate: ", err)
+		}
 		// Listen on SCION address
 		qsock, err := squic.ListenSCION(nil, &local)
 		if err != nil {
 			log.Fatal("Unable to listen: ", err)
 		}
+		scionListenerMutex.Lock()
+		scionListener = qsock
+		scionListenerMutex.Unlock()
 		log.Println("Listening on: ", qsock.Addr())
 		for {
 			qsess, err := qsock.Accept()
 			if err != nil {
-				// Accept failing means the socket is unusable.
-				log.Fatal("Unable to accept quic session: ", err)
+				select {
+				case <-scionListenerRestart:
+					log.Println("Restarting SCION server with the renewed certificate")
+				default:
+					// Accept failing means the socket is unusable.
+					log.Fatal("Unable to accept quic session: ", err)
+				}
+				break
 			}
 			log.Println("Quic session accepted from: ", qsess.RemoteAddr())
 			go handleQUICSession(qsess, *client)
 		}
-	}()
-
-	// Management Server
-	router := mux.NewRouter()
-	// TODO: add some call here
+	}
+}
 
-	go func() {
-		srv := &http.Server{
-			Addr:    "127.0.0.1:" + localhostManagementPort,
-			Handler: router,
+// Closes the SCION listener so that serveSCION listens again with the renewed certificate. The HTTPS servers already
+// use the new certificate and are not affected.
+func restartSCIONListener() {
+	scionListenerMutex.Lock()
+	defer scionListenerMutex.Unlock()
+	if scionListener == nil {
+		return
+	}
+	select {
+	case scionListenerRestart <- struct{}{}:
+	default:
+	}
+	err := scionListener.Close()
+	if err != nil {
+		log.Printf("Failed closing SCION listener: %v", err)
+		select {
+		case <-scionListenerRestart:
+		default:
 		}
-		log.Println("localhost HTTP server listening error: ", srv.ListenAndServe())
-	}()
+	}
+}
 
-	srv := common.CreateHttpsServer(caCertsDir, storageIP, managementAPIPort, router, tls.RequireAndVerifyClientCert)
-	log.Println("Starting HTTPS management server")
-	log.Fatal("HTTPS server listening error: ", srv.ListenAndServeTLS(storageCert, storagePrivKey))
+var (
+	storageRequests = common.NewCounterVec("twosms_storage_requests_total", "Remote write and read requests, by transport (https or scion), action (write, read or other) and result (ok, unauthorized or error).", "transport", "action", "result")
+	storageDuration = common.NewHistogramVec("twosms_storage_request_duration_seconds", "Duration of the requests forwarded to the database, by action.", common.DurationBuckets, "action")
+)
+
+// Returns the action label of the request to path, without using arbitrary paths as label values
+func storageAction(path string) string {
+	if path == "/write" || path == "/read" {
+		return path[1:]
+	}
+	return "other"
 }
 
 func handleQUICSession(qsess quic.Session, client http.Client) {
 	log.Println("Received SCION request")
-	// TODO: extension
 	// Check if remote is authorized to write/read
-	//if !Authorized(qsess.RemoteAddr()) {
-	//	log.Println("Remote ", qsess.RemoteAddr(), "not authorized to scrape endpoint")
-	//	return
-	//}
+	remote, ok := qsess.RemoteAddr().(*snet.Addr)
+	if !ok || !authorizations.authorized(remote.IA.String(), remote.Host.IP().String()) {
+		log.Println("Remote ", qsess.RemoteAddr(), "not authorized to write/read")
+		storageRequests.Inc("scion", "other", "unauthorized")
+		qsess.Close(nil)
+		return
+	}
 	// Accept a stream over the session
 	qstream, err := qsess.AcceptStream()
 	if err != nil {
 		log.Println("Unable to accept quic stream: ", err)
+		storageRequests.Inc("scion", "other", "error")
 		return
 	}
 
@@ -234,8 +337,10 @@ func handleQUICSession(qsess quic.Session, client http.Client) {
 	err = decoder.Decode(&req)
 	if err != nil {
 		log.Println("Failed decoding request: ", err)
+		storageRequests.Inc("scion", "other", "error")
 		return
 	}
+	action := storageAction(req.URL.Path)
 
 	var path string
 	if req.URL.Path == "/write" {
@@ -243,9 +348,12 @@ func handleQUICSession(qsess quic.Session, client http.Client) {
 	} else if req.URL.Path == "/read" {
 		path = "http://127.0.0.1:" + internalPort + readPath + "?" + "db=" + dbName
 	}
+	start := time.Now()
 	resp, err := client.Post(path, "application/x-protobuf", common.NewRequestFromQUIC(req).Body)
+	storageDuration.ObserveSince(start, action)
 	if err != nil {
 		log.Println("Failed contacting 127.0.0.1: ", err)
+		storageRequests.Inc("scion", action, "error")
 		return
 	}
 
@@ -254,8 +362,10 @@ func handleQUICSession(qsess quic.Session, client http.Client) {
 	err = encoder.Encode(quicResp)
 	if err != nil {
 		log.Println("Failed encoding response: ", err)
+		storageRequests.Inc("scion", action, "error")
 		return
 	}
+	storageRequests.Inc("scion", action, "ok")
 }
 
 type handler struct {
@@ -264,10 +374,25 @@ type handler struct {
 
 func (h *handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	log.Println("Received HTTPS request")
+	// Check if remote is authorized to write/read, identified by the IA and IP in its certificate
+	if len(req.TLS.PeerCertificates) == 0 || len(req.TLS.PeerCertificates[0].IPAddresses) != 1 {
+		log.Println("Remote", req.RemoteAddr, "not authorized to write/read: no certificate with one IP")
+		storageRequests.Inc("https", storageAction(req.URL.Path), "unauthorized")
+		w.WriteHeader(403)
+		return
+	}
+	peerIA, err := common.IAFromURIs(req.TLS.PeerCertificates[0].URIs)
+	if err != nil || !authorizations.authorized(peerIA.String(), req.TLS.PeerCertificates[0].IPAddresses[0].String()) {
+		log.Println("Remote", req.RemoteAddr, "not authorized to write/read")
+		storageRequests.Inc("https", storageAction(req.URL.Path), "unauthorized")
+		w.WriteHeader(403)
+		return
+	}
 	var resp *http.Response
-	var err error
 	//db_name, _ := req.URL.Query()["db"]
 	path := "http://127.0.0.1:" + internalPort // + req.URL.Path + "?" + "db=" + db_name[0]
+	action := storageAction(req.URL.Path)
+	start := time.Now()
 	if req.URL.Path == "/write" {
 		resp, err = h.client.Post(path+writePath+"?"+"db="+dbName, "application/x-protobuf", req.Body)
 	} else if req.URL.Path == "/read" {
@@ -275,11 +400,16 @@ func (h *handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	} else {
 		err = errors.New("Unsupported action: " + req.URL.Path)
 	}
+	if action != "other" {
+		storageDuration.ObserveSince(start, action)
+	}
 	if err != nil {
 		log.Println("Request error:", err)
+		storageRequests.Inc("https", action, "error")
 		w.WriteHeader(500)
 		return
 	}
+	storageRequests.Inc("https", action, "ok")
 	io.Copy(w, resp.Body)
 	for k, vv := range resp.Header {
 		for _, v := range vv {
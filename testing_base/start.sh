@@ -62,6 +62,7 @@ cd $BASEDIR/manager
 rm -f scrapers.json
 rm -f endpoints.json
 rm -f storages.json
+rm -f registry.db
 rm -f approved_certs/*
 rm -f ca/*
 rm -f auth/manager.*
@@ -85,12 +86,9 @@ cd ../scraper
 
 sleep 1
 
-echo 'Creating endpoint mappings file'
-cd ../endpoint
-$BASEDIR/../deployment/create_endpoint_mappings.sh
-
 echo 'Starting endpoint application'
-./endpoint -local "$IA",[$IP]:9199  -endpoint.enable-node true -manager.IP $IP  -endpoint.ports.local 9998 -endpoint.ports.management 9905 > ../endpoint.out 2>&1 &
+cd ../endpoint
+./endpoint -local "$IA",[$IP]:9199  -endpoint.enable-node true -manager.IP $IP  -endpoint.ports.local 9998 -endpoint.ports.management 9905 -gen $SC/gen > ../endpoint.out 2>&1 &
 sleep 1
 ps 
 echo "All started"